@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+//acceptpolicy represents how incoming HELLO requests are answered
+type acceptpolicy byte
+
+// Structure representing accept policies
+const (
+	//Ask user (GUI dialog or console prompt)
+	ACCEPTPROMPT acceptpolicy = iota
+	//Accept only peers we accepted or connected to before
+	ACCEPTKNOWN
+	//Accept only fingerprints listed in allowlist file
+	ACCEPTALLOWLIST
+	//Reject all incoming HELLO requests
+	REJECTALL
+)
+
+var acceptPolicyNames = map[string]acceptpolicy{
+	"prompt":    ACCEPTPROMPT,
+	"known":     ACCEPTKNOWN,
+	"allowlist": ACCEPTALLOWLIST,
+	"reject":    REJECTALL,
+}
+
+//AcceptPolicy decides if client which sent HELLO is accepted
+type AcceptPolicy struct {
+	mode       acceptpolicy
+	knownPeers *KnownPeers
+	allowlist  map[string]bool
+	//Asks user a yes/no question. Set by GUI or console
+	prompt func(question string) bool
+}
+
+//AcceptPolicyInit creates accept policy from its name. Allowlist file is required only for allowlist policy
+func AcceptPolicyInit(name string, allowlistFile string, knownPeers *KnownPeers) (policy AcceptPolicy, err error) {
+	mode, ok := acceptPolicyNames[strings.ToLower(name)]
+	if !ok {
+		return policy, fmt.Errorf("AcceptPolicyInit: unknown policy %q", name)
+	}
+
+	policy.mode = mode
+	policy.knownPeers = knownPeers
+
+	if mode == ACCEPTALLOWLIST {
+		if allowlistFile == "" {
+			return policy, errors.New("AcceptPolicyInit: allowlist policy requires allowlist file")
+		}
+		if policy.allowlist, err = loadAllowlist(allowlistFile); err != nil {
+			return policy, err
+		}
+	}
+
+	return policy, nil
+}
+
+//loadAllowlist reads file with one fingerprint per line. Lines starting with # are comments
+func loadAllowlist(allowlistFile string) (map[string]bool, error) {
+	file, err := os.Open(allowlistFile)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	allowlist := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		allowlist[strings.ToLower(strings.Fields(line)[0])] = true
+	}
+
+	return allowlist, scanner.Err()
+}
+
+//SetPrompt sets function used for asking user in prompt mode
+func (policy *AcceptPolicy) SetPrompt(prompt func(question string) bool) {
+	policy.prompt = prompt
+}
+
+//Accept returns true if peer with given fingerprint connecting from given address should be accepted. Accepted peers become known peers
+func (policy *AcceptPolicy) Accept(fingerprint string, address string) bool {
+	var accepted bool
+
+	switch policy.mode {
+	case ACCEPTPROMPT:
+		if policy.prompt == nil {
+			fmt.Println("No prompt available. Rejecting client")
+			return false
+		}
+		accepted = policy.prompt(fmt.Sprintf("Do you want to accept client %s with public key SHA-256 hash: %s ?", address, fingerprint))
+	case ACCEPTKNOWN:
+		accepted = policy.knownPeers.IsKnown(fingerprint)
+	case ACCEPTALLOWLIST:
+		accepted = policy.allowlist[strings.ToLower(fingerprint)]
+	case REJECTALL:
+		accepted = false
+	}
+
+	if accepted {
+		if err := policy.knownPeers.Add(fingerprint, address); err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	return accepted
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestAcceptPolicies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sstt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	allowlistFile := path.Join(dir, "allowlist")
+	ioutil.WriteFile(allowlistFile, []byte("# Allowed peers\nABCD Alice laptop\n\n"), 0600)
+
+	cases := []struct {
+		policy      string
+		prompt      func(question string) bool
+		fingerprint string
+		accepted    bool
+	}{
+		{"prompt", nil, "abcd", false},
+		{"prompt", func(question string) bool { return true }, "abcd", true},
+		{"prompt", func(question string) bool { return false }, "abcd", false},
+		{"known", nil, "1234", true},
+		{"known", nil, "abcd", false},
+		{"allowlist", nil, "abcd", true},
+		{"allowlist", nil, "1234", false},
+		{"REJECT", nil, "1234", false},
+	}
+	for _, c := range cases {
+		knownPeers, err := KnownPeersLoad(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		knownPeers.peers = map[string]string{"1234": "127.0.0.1:27002"}
+
+		policy, err := AcceptPolicyInit(c.policy, allowlistFile, knownPeers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		policy.SetPrompt(c.prompt)
+		if accepted := policy.Accept(c.fingerprint, "127.0.0.1:27002"); accepted != c.accepted {
+			t.Errorf("%s policy: expected accepted %v for %s, got %v", c.policy, c.accepted, c.fingerprint, accepted)
+		}
+		if knownPeers.IsKnown(c.fingerprint) != (c.accepted || c.fingerprint == "1234") {
+			t.Errorf("%s policy: only accepted peer should become known", c.policy)
+		}
+	}
+
+	if _, err = AcceptPolicyInit("allowlist", "", nil); err == nil {
+		t.Error("Allowlist policy should require allowlist file")
+	}
+	if _, err = AcceptPolicyInit("everyone", "", nil); err == nil {
+		t.Error("Unknown policy should be refused")
+	}
+}
@@ -39,6 +39,9 @@ func GenerateKey(key []byte) (err error) {
 	return
 }
 
+//Size of buffers in which block modes encrypt data (see encryptStream)
+const cipherBufferSize = aes.BlockSize * 16384
+
 //Used for ECB and CBC ciphers only because they implement BlockMode interface
 func encryptStream(mode cipher.BlockMode, reader io.Reader, writer io.Writer, size uint64, app *GUIApp) error {
 	blockSize := mode.BlockSize() * 16384
@@ -52,18 +55,17 @@ func encryptStream(mode cipher.BlockMode, reader io.Reader, writer io.Writer, si
 	duration := time.Now().Sub(timeStart)
 	buf := make([]byte, blockSize)
 	for {
-		nowRead, err := reader.Read(buf)
-		alreadyRead += nowRead
-		if err != nil {
-			if err == io.EOF {
-				break
-			} else if err == io.ErrUnexpectedEOF {
-			} else {
-				return err
-			}
+		//Reader may be pipe or connection returning less than asked, only the last buffer is partial
+		nowRead, err := io.ReadFull(reader, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
 		}
+		alreadyRead += nowRead
 		mode.CryptBlocks(buf, buf)
-		if _, err = writer.Write(buf); err != nil {
+		if _, err := writer.Write(buf); err != nil {
 			return err
 		}
 		if app.encryptProgressBar != nil {
@@ -73,6 +75,9 @@ func encryptStream(mode cipher.BlockMode, reader io.Reader, writer io.Writer, si
 				app.UpdateEncryptionProgress(value, duration.String())
 			})
 		}
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
 	}
 	duration = time.Now().Sub(timeStart)
 	fmt.Print("Duration: " + duration.String())
@@ -174,12 +179,12 @@ func encryptCFB(key []byte, iv []byte, bReader io.Reader, out io.Writer, size ui
 	// Copy the input to the output buffer, encrypting as we go.
 	if app.encryptProgressBar != nil {
 		if _, err := io.Copy(writer, progressReader); err != nil {
-			panic(err)
+			return err
 		}
 		app.UpdateEncryptionProgress(1.0, duration.String())
 	} else {
 		if _, err := io.Copy(writer, bReader); err != nil {
-			panic(err)
+			return err
 		}
 	}
 	duration = time.Now().Sub(startTime)
@@ -195,7 +200,7 @@ func encryptCBC(key []byte, iv []byte, bReader io.Reader, out io.Writer, size ui
 
 	mode := cipher.NewCBCEncrypter(block, iv[:])
 
-	encryptStream(mode, bReader, out, size, app)
+	err = encryptStream(mode, bReader, out, size, app)
 
 	return
 }
@@ -208,7 +213,7 @@ func encryptECB(key []byte, bReader io.Reader, out io.Writer, size uint64, app *
 	}
 
 	mode := aesciphers.NewECBEncrypter(block)
-	encryptStream(mode, bReader, out, size, app)
+	err = encryptStream(mode, bReader, out, size, app)
 
 	return
 }
@@ -244,12 +249,12 @@ func encryptOFB(key []byte, iv []byte, bReader io.Reader, out io.Writer, size ui
 	// Copy the input to the output buffer, encrypting as we go.
 	if app.encryptProgressBar != nil {
 		if _, err := io.Copy(writer, progressReader); err != nil {
-			panic(err)
+			return err
 		}
 		app.UpdateEncryptionProgress(1.0, duration.String())
 	} else {
 		if _, err := io.Copy(writer, bReader); err != nil {
-			panic(err)
+			return err
 		}
 	}
 	duration = time.Now().Sub(startTime)
@@ -287,12 +292,12 @@ func decryptCFB(key []byte, iv []byte, bReader io.Reader, out io.Writer, size ui
 	// Copy the input to the output buffer, encrypting as we go.
 	if app.decryptProgressBar != nil {
 		if _, err := io.Copy(writer, progressReader); err != nil {
-			panic(err)
+			return err
 		}
 		app.UpdateDecryptionProgress(1.0, duration.String())
 	} else {
 		if _, err := io.Copy(writer, bReader); err != nil {
-			panic(err)
+			return err
 		}
 	}
 	duration = time.Now().Sub(startTime)
@@ -362,12 +367,12 @@ func decryptOFB(key []byte, iv []byte, bReader io.Reader, out io.Writer, size ui
 	// Copy the input to the output buffer, encrypting as we go.
 	if app.decryptProgressBar != nil {
 		if _, err := io.Copy(writer, progressReader); err != nil {
-			panic(err)
+			return err
 		}
 		app.UpdateDecryptionProgress(1.0, duration.String())
 	} else {
 		if _, err := io.Copy(writer, bReader); err != nil {
-			panic(err)
+			return err
 		}
 	}
 	duration = time.Now().Sub(startTime)
@@ -438,44 +443,58 @@ func EncryptFile(key []byte, iv []byte, input *os.File, output *os.File, cipherb
 		return
 	}
 
+	return EncryptFileStream(key, iv, input, fi.Size(), output, cipherblockmode, app)
+}
+
+//EncryptFileStream encrypts size bytes read from input and writes them to output as soon as they are encrypted, e.g. to pipe or connection.
+//Output has EncryptedSize bytes
+func EncryptFileStream(key []byte, iv []byte, input io.Reader, size int64, output io.Writer, cipherblockmode cipherblockmode, app *GUIApp) (err error) {
 	switch cipherblockmode {
 	case CBC:
-		err = encryptCBC(key, iv, input, output, uint64(fi.Size()), app)
+		err = encryptCBC(key, iv, input, output, uint64(size), app)
 	case CFB:
-		err = encryptCFB(key, iv, input, output, uint64(fi.Size()), app)
+		err = encryptCFB(key, iv, input, output, uint64(size), app)
 	case OFB:
-		err = encryptOFB(key, iv, input, output, uint64(fi.Size()), app)
+		err = encryptOFB(key, iv, input, output, uint64(size), app)
 	case ECB:
-		err = encryptECB(key, input, output, uint64(fi.Size()), app)
-	}
-
-	if err != nil {
-		return err
+		err = encryptECB(key, input, output, uint64(size), app)
 	}
 
 	return
 }
 
+//EncryptedSize returns length of size bytes encrypted in given mode. Block modes prefix data with its length and encrypt it in whole
+//buffers of cipherBufferSize bytes, stream modes don't change length
+func EncryptedSize(size int64, cipherblockmode cipherblockmode) int64 {
+	if cipherblockmode != CBC && cipherblockmode != ECB {
+		return size
+	}
+	buffers := (size + cipherBufferSize - 1) / cipherBufferSize
+	return 8 + buffers*cipherBufferSize
+}
+
 //DecryptFile decrypts file using given key. It takes key, os.File (twice as input and output) and cipher block mode as argument.
 func DecryptFile(key []byte, iv []byte, input *os.File, output *os.File, cipherblockmode cipherblockmode, app *GUIApp) (err error) {
 	fi, err := input.Stat()
 	if err != nil {
 		return
 	}
+
+	return DecryptFileStream(key, iv, input, fi.Size(), output, cipherblockmode, app)
+}
+
+//DecryptFileStream decrypts data encrypted by EncryptFileStream as it's read from input, e.g. from pipe. Size of encrypted data is used for progress
+func DecryptFileStream(key []byte, iv []byte, input io.Reader, size int64, output io.Writer, cipherblockmode cipherblockmode, app *GUIApp) (err error) {
 	switch cipherblockmode {
 	case CBC:
 		err = decryptCBC(key, iv, input, output, app)
 	case CFB:
-		err = decryptCFB(key, iv, input, output, uint64(fi.Size()), app)
+		err = decryptCFB(key, iv, input, output, uint64(size), app)
 	case OFB:
-		err = decryptOFB(key, iv, input, output, uint64(fi.Size()), app)
+		err = decryptOFB(key, iv, input, output, uint64(size), app)
 	case ECB:
 		err = decryptECB(key, input, output, app)
 	}
 
-	if err != nil {
-		return err
-	}
-
 	return
 }
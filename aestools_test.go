@@ -1,9 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"crypto/aes"
 	"encoding/hex"
+	"errors"
+	"io"
 	"testing"
+	"testing/iotest"
 )
 
 func TestTextMessagesEncryptionECB(t *testing.T) {
@@ -129,3 +133,69 @@ func TestTextMessagesEncryptionOFB(t *testing.T) {
 		t.Error("Encrypted message and encrypted version should not be the same")
 	}
 }
+
+func TestFileStreamThroughPipe(t *testing.T) {
+	key, _ := hex.DecodeString("7368616e676520746869732070617373")
+	iv := make([]byte, aes.BlockSize)
+	var nullGuiApp GUIApp
+
+	for _, mode := range []cipherblockmode{ECB, CBC, CFB, OFB} {
+		for _, size := range []int{0, 1, cipherBufferSize, 2*cipherBufferSize + 5} {
+			content := bytes.Repeat([]byte{'x'}, size)
+
+			//Encrypted data goes through pipe as it's encrypted, its length is known in advance
+			reader, writer := io.Pipe()
+			go func() {
+				writer.CloseWithError(EncryptFileStream(key, iv, bytes.NewReader(content), int64(size), writer, mode, &nullGuiApp))
+			}()
+			encrypted := new(bytes.Buffer)
+			if _, err := io.Copy(encrypted, reader); err != nil {
+				t.Fatal(err)
+			}
+			if int64(encrypted.Len()) != EncryptedSize(int64(size), mode) {
+				t.Errorf("%s %d: Expected %d encrypted bytes, got %d", mode, size, EncryptedSize(int64(size), mode), encrypted.Len())
+			}
+
+			decrypted := new(bytes.Buffer)
+			if err := DecryptFileStream(key, iv, encrypted, int64(encrypted.Len()), decrypted, mode, &nullGuiApp); err != nil || !bytes.Equal(decrypted.Bytes(), content) {
+				t.Errorf("%s %d: Decrypted data differs: %v", mode, size, err)
+			}
+		}
+	}
+
+	//Encryption stops when other side of pipe is gone
+	reader, writer := io.Pipe()
+	reader.CloseWithError(errors.New("receiver gone"))
+	if err := EncryptFileStream(key, iv, bytes.NewReader(make([]byte, cipherBufferSize)), cipherBufferSize, writer, CFB, &nullGuiApp); err == nil {
+		t.Error("Encryption to closed pipe should fail")
+	}
+}
+
+func TestFileStreamShortReads(t *testing.T) {
+	key, _ := hex.DecodeString("7368616e676520746869732070617373")
+	iv := make([]byte, aes.BlockSize)
+	var nullGuiApp GUIApp
+	content := bytes.Repeat([]byte("short reads "), cipherBufferSize/4)
+
+	//Readers returning less than asked and data together with EOF, like pipe or connection can
+	readers := map[string]func() io.Reader{
+		"half":     func() io.Reader { return iotest.HalfReader(bytes.NewReader(content)) },
+		"data+EOF": func() io.Reader { return iotest.DataErrReader(bytes.NewReader(content)) },
+	}
+	for _, mode := range []cipherblockmode{ECB, CBC, CFB, OFB} {
+		for name, reader := range readers {
+			encrypted := new(bytes.Buffer)
+			if err := EncryptFileStream(key, iv, reader(), int64(len(content)), encrypted, mode, &nullGuiApp); err != nil {
+				t.Fatal(err)
+			}
+			if int64(encrypted.Len()) != EncryptedSize(int64(len(content)), mode) {
+				t.Errorf("%s %s: Expected %d encrypted bytes, got %d", mode, name, EncryptedSize(int64(len(content)), mode), encrypted.Len())
+			}
+
+			decrypted := new(bytes.Buffer)
+			if err := DecryptFileStream(key, iv, encrypted, int64(encrypted.Len()), decrypted, mode, &nullGuiApp); err != nil || !bytes.Equal(decrypted.Bytes(), content) {
+				t.Errorf("%s %s: Decrypted data differs: %v", mode, name, err)
+			}
+		}
+	}
+}
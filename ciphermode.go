@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var cipherModeNames = [...]string{"ECB", "CBC", "CFB", "OFB"}
+
+func (mode cipherblockmode) String() string {
+	if int(mode) < len(cipherModeNames) {
+		return cipherModeNames[mode]
+	}
+	return fmt.Sprintf("unknown(%d)", byte(mode))
+}
+
+//parseCipherMode returns cipher mode with given name, e.g. cbc
+func parseCipherMode(name string) (cipherblockmode, error) {
+	for mode, modeName := range cipherModeNames {
+		if strings.EqualFold(name, modeName) {
+			return cipherblockmode(mode), nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown cipher mode %s. Known modes: %s", name, strings.Join(cipherModeNames[:], ", "))
+}
+
+//supportedCipherMode returns error if we can't encrypt using given mode
+func supportedCipherMode(mode cipherblockmode) error {
+	if int(mode) >= len(cipherModeNames) {
+		return fmt.Errorf("Cipher mode %s is not supported", mode)
+	}
+	return nil
+}
+
+//How long requester waits for CIPHERMODEACK. Session is closed if peer doesn't answer
+var cipherModeTimeout = 15 * time.Second
+
+//cipherModeRequest is CIPHERMODE frame. Requester's frames from fromSeq on use new mode if peer accepts it
+// Schema of frame
+// |ciphermode byte|fromSeq uint64|
+type cipherModeRequest struct {
+	mode    cipherblockmode
+	fromSeq uint64
+}
+
+func (request *cipherModeRequest) encode() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, endianness, request.mode)
+	binary.Write(buf, endianness, request.fromSeq)
+	return buf.Bytes()
+}
+
+func decodeCipherModeRequest(payload []byte) (request cipherModeRequest, err error) {
+	if len(payload) != 9 {
+		return request, errors.New("decodeCipherModeRequest: Wrong frame length")
+	}
+	request.mode = cipherblockmode(payload[0])
+	request.fromSeq = endianness.Uint64(payload[1:])
+	return
+}
+
+//cipherModeAck is CIPHERMODEACK frame. If mode is accepted, responder's frames from fromSeq on use it
+// Schema of frame
+// |accepted byte|ciphermode byte|fromSeq uint64|reason [rest]byte|
+type cipherModeAck struct {
+	accepted bool
+	mode     cipherblockmode
+	fromSeq  uint64
+	reason   string
+}
+
+func (ack *cipherModeAck) encode() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, endianness, ack.accepted)
+	binary.Write(buf, endianness, ack.mode)
+	binary.Write(buf, endianness, ack.fromSeq)
+	buf.WriteString(ack.reason)
+	return buf.Bytes()
+}
+
+func decodeCipherModeAck(payload []byte) (ack cipherModeAck, err error) {
+	if len(payload) < 10 {
+		return ack, errors.New("decodeCipherModeAck: Frame too short")
+	}
+	ack.accepted = payload[0] != 0
+	ack.mode = cipherblockmode(payload[1])
+	ack.fromSeq = endianness.Uint64(payload[2:10])
+	ack.reason = string(payload[10:])
+	return
+}
+
+//CipherMode returns cipher mode used for data we send
+func (session *Session) CipherMode() cipherblockmode {
+	session.keyMutex.RLock()
+	defer session.keyMutex.RUnlock()
+
+	if session.auth == nil {
+		return session.messageHandler.cipherMode
+	}
+	return session.auth.send.cipherMode
+}
+
+//RequestCipherMode asks peer to change cipher mode of both directions and waits for answer.
+//Encrypted data waits for the answer, so peer knows the exact frame from which new mode is used. Session keys are not held
+//meanwhile, so other frames, key updates and closing session go on
+func (session *Session) RequestCipherMode(mode cipherblockmode) error {
+	if err := session.messageHandler.cipherPolicy.CheckMode(mode); err != nil {
+		return err
+	}
+
+	answer := make(chan cipherModeAck, 1)
+	session.modeMutex.Lock()
+	if session.modeAnswer != nil || session.modeChanging {
+		session.modeMutex.Unlock()
+		return errors.New("Session.RequestCipherMode: Other cipher mode change is in progress")
+	}
+	session.modeAnswer = answer
+	session.modeMutex.Unlock()
+
+	defer func() {
+		session.modeMutex.Lock()
+		session.modeAnswer = nil
+		session.modeMutex.Unlock()
+	}()
+
+	switched := make(chan struct{})
+	session.keyMutex.Lock()
+	err := session.writeWithSeq(CIPHERMODE, func(seq uint64) []byte {
+		request := cipherModeRequest{mode: mode, fromSeq: seq + 1}
+		return request.encode()
+	})
+	if err == nil {
+		session.modeSwitch = switched
+	}
+	session.keyMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case ack := <-answer:
+		if !ack.accepted {
+			err = fmt.Errorf("Peer refused cipher mode %s: %s", mode, ack.reason)
+		} else if ack.mode != mode {
+			session.closeWithError(sessionErrorf(ERRORPROTOCOL, "Cipher mode %s acknowledged instead of %s", ack.mode, mode))
+			err = errors.New("Session.RequestCipherMode: Peer acknowledged other cipher mode")
+		}
+	case <-session.done:
+		err = errors.New("Session.RequestCipherMode: Session closed")
+	case <-time.After(cipherModeTimeout):
+		session.closeWithError(sessionErrorf(ERRORTIMEOUT, "Cipher mode change was not acknowledged"))
+		err = errors.New("Session.RequestCipherMode: Peer did not acknowledge cipher mode change")
+	}
+
+	//Waiting data is encrypted with new mode if peer accepted it
+	session.keyMutex.Lock()
+	if err == nil && session.auth != nil {
+		session.auth.send.cipherMode = mode
+	}
+	session.modeSwitch = nil
+	session.keyMutex.Unlock()
+	close(switched)
+
+	return err
+}
+
+//handleCipherModeRequest accepts or refuses mode requested by peer and queues CIPHERMODEACK. Returns queued answer
+func (session *Session) handleCipherModeRequest(frame Frame) (cipherModeAck, error) {
+	request, err := decodeCipherModeRequest(frame.payload)
+	if err != nil {
+		return cipherModeAck{}, sessionErrorf(ERRORPROTOCOL, "%v", err)
+	}
+
+	if request.fromSeq != frame.seq+1 {
+		return cipherModeAck{}, sessionErrorf(ERRORPROTOCOL, "Cipher mode change from frame %d requested in frame %d", request.fromSeq, frame.seq)
+	}
+
+	session.modeMutex.Lock()
+	concurrent := session.modeAnswer != nil
+	session.modeChanging = !concurrent
+	session.modeMutex.Unlock()
+
+	changed := func() {
+		session.modeMutex.Lock()
+		session.modeChanging = false
+		session.modeMutex.Unlock()
+	}
+
+	refuse := func(reason string) (cipherModeAck, error) {
+		changed()
+		ack := cipherModeAck{mode: request.mode, reason: reason}
+		return ack, session.reply(func() error {
+			return session.writePacket(CIPHERMODEACK, ack.encode())
+		})
+	}
+
+	if concurrent {
+		return refuse("cipher mode change requested by both sides at once")
+	}
+
+	if err = session.messageHandler.cipherPolicy.CheckMode(request.mode); err != nil {
+		return refuse(err.Error())
+	}
+
+	//Peer sends no encrypted data until it gets our answer, so all its following frames use new mode
+	session.auth.recv.cipherMode = request.mode
+
+	ack := cipherModeAck{accepted: true, mode: request.mode}
+	err = session.reply(func() error {
+		defer changed()
+
+		session.keyMutex.Lock()
+		defer session.keyMutex.Unlock()
+
+		sent := ack
+		err := session.writeWithSeq(CIPHERMODEACK, func(seq uint64) []byte {
+			sent.fromSeq = seq + 1
+			return sent.encode()
+		})
+		if err != nil {
+			return err
+		}
+
+		session.auth.send.cipherMode = request.mode
+		return nil
+	})
+	if err != nil {
+		changed()
+	}
+	return ack, err
+}
+
+//handleCipherModeAck passes peer answer to waiting RequestCipherMode
+func (session *Session) handleCipherModeAck(frame Frame) error {
+	ack, err := decodeCipherModeAck(frame.payload)
+	if err != nil {
+		return sessionErrorf(ERRORPROTOCOL, "%v", err)
+	}
+
+	session.modeMutex.Lock()
+	answer := session.modeAnswer
+	session.modeMutex.Unlock()
+
+	if answer == nil {
+		return sessionErrorf(ERRORPROTOCOL, "Unexpected cipher mode acknowledgement")
+	}
+
+	if ack.accepted {
+		if ack.fromSeq != frame.seq+1 {
+			return sessionErrorf(ERRORPROTOCOL, "Cipher mode change from frame %d acknowledged in frame %d", ack.fromSeq, frame.seq)
+		}
+		session.auth.recv.cipherMode = ack.mode
+	}
+
+	select {
+	case answer <- ack:
+	default:
+	}
+
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+//serveTestSession handles cipher mode and text message frames until session is closed. Received messages are sent to channel
+func serveTestSession(t *testing.T, session *Session, messages chan<- string) {
+	var nullGuiApp GUIApp
+	for {
+		frame, err := session.readFrame()
+		if err != nil {
+			close(messages)
+			return
+		}
+
+		switch frame.ptype {
+		case CIPHERMODE:
+			_, err = session.handleCipherModeRequest(frame)
+		case CIPHERMODEACK:
+			err = session.handleCipherModeAck(frame)
+		case TEXTMESSAGE:
+			var message string
+			message, err = session.messageHandler.HandleTextMessage(frame.payload, session.auth.recv, &nullGuiApp)
+			messages <- message
+		}
+
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func sendTestMessage(session *Session, message string) error {
+	var nullGuiApp GUIApp
+	return session.writeEncrypted(TEXTMESSAGE, func(keys *directionKeys) ([]byte, error) {
+		return session.messageHandler.GenerateTextMessage(message, keys, &nullGuiApp)
+	})
+}
+
+func TestCipherModeChangeDuringMessages(t *testing.T) {
+	initiator, responder := authenticatedSessionPair()
+	defer initiator.Close()
+	defer responder.Close()
+
+	toInitiator, toResponder := make(chan string), make(chan string)
+	go serveTestSession(t, initiator, toInitiator)
+	go serveTestSession(t, responder, toResponder)
+
+	changed := make(chan error)
+	go func() {
+		changed <- initiator.RequestCipherMode(OFB)
+	}()
+
+	//Messages sent by both sides while mode is being changed must be decrypted with the mode they were encrypted with
+	for i := 0; i < 10; i++ {
+		message := fmt.Sprintf("message %d", i)
+		go sendTestMessage(initiator, message)
+		if got := <-toResponder; got != message {
+			t.Fatalf("Responder expected %q, got %q", message, got)
+		}
+		go sendTestMessage(responder, message)
+		if got := <-toInitiator; got != message {
+			t.Fatalf("Initiator expected %q, got %q", message, got)
+		}
+	}
+
+	if err := <-changed; err != nil {
+		t.Fatal(err)
+	}
+
+	if initiator.CipherMode() != OFB || responder.CipherMode() != OFB {
+		t.Errorf("Both sides should use OFB, initiator uses %s, responder %s", initiator.CipherMode(), responder.CipherMode())
+	}
+}
+
+func TestCipherModeUnsupportedRefused(t *testing.T) {
+	initiator, responder := authenticatedSessionPair()
+	defer initiator.Close()
+	defer responder.Close()
+
+	if err := initiator.RequestCipherMode(cipherblockmode(len(cipherModeNames))); err == nil {
+		t.Error("Unsupported mode should not be requested")
+	}
+
+	go serveTestSession(t, responder, make(chan string))
+
+	answer := make(chan cipherModeAck, 1)
+	initiator.modeAnswer = answer
+	go serveTestSession(t, initiator, make(chan string))
+
+	err := initiator.writeWithSeq(CIPHERMODE, func(seq uint64) []byte {
+		request := cipherModeRequest{mode: 42, fromSeq: seq + 1}
+		return request.encode()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ack := <-answer; ack.accepted || ack.reason == "" {
+		t.Error("Unsupported mode should be refused with reason")
+	}
+
+	if responder.CipherMode() != CBC {
+		t.Errorf("Refused request should not change mode, responder uses %s", responder.CipherMode())
+	}
+}
+
+func TestCipherModeRequestKeepsKeysFree(t *testing.T) {
+	initiator, responder := authenticatedSessionPair()
+	defer responder.Close()
+
+	//Responder reads frames but never answers
+	go func() {
+		for {
+			if _, err := responder.readFrame(); err != nil {
+				return
+			}
+		}
+	}()
+
+	changed := make(chan error, 1)
+	go func() {
+		changed <- initiator.RequestCipherMode(OFB)
+	}()
+	if !waitFor(func() bool {
+		initiator.keyMutex.RLock()
+		defer initiator.keyMutex.RUnlock()
+		return initiator.modeSwitch != nil
+	}) {
+		t.Fatal("Cipher mode request should be pending")
+	}
+
+	//Key updates go on while request waits, encrypted data waits for answer
+	if err := initiator.UpdateSendKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if initiator.CipherMode() != CBC {
+		t.Errorf("Mode should not change before answer, got %s", initiator.CipherMode())
+	}
+	sent := make(chan error, 1)
+	go func() {
+		sent <- sendTestMessage(initiator, "waiting")
+	}()
+	select {
+	case err := <-sent:
+		t.Fatalf("Encrypted data should wait for answer, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	//Closing session ends request and waiting data
+	initiator.Close()
+	for _, result := range []chan error{changed, sent} {
+		select {
+		case err := <-result:
+			if err == nil {
+				t.Error("Request and data of closed session should fail")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Closed session should not wait for answer")
+		}
+	}
+}
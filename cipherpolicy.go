@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+//Names of session key algorithms. Index is alghorytm byte sent in CONNECTIONPROPERTIES
+var algorithmNames = [...]string{"AES"}
+
+//PolicyError is returned when peer proposes session parameters not allowed by local cipher policy
+type PolicyError struct {
+	message string
+}
+
+func (err *PolicyError) Error() string {
+	return err.message
+}
+
+func policyErrorf(format string, args ...interface{}) *PolicyError {
+	return &PolicyError{message: fmt.Sprintf(format, args...)}
+}
+
+//CipherPolicy is local security policy. Algorithms, cipher modes and key sizes proposed by peer outside of it are refused
+type CipherPolicy struct {
+	algorithms map[byte]bool
+	modes      map[cipherblockmode]bool
+	//Minimal session key size in bytes
+	minKeySize uint32
+}
+
+//CipherPolicyInit creates cipher policy from comma separated algorithm and mode names and minimal key size in bits
+func CipherPolicyInit(algorithms string, modes string, minKeyBits int) (*CipherPolicy, error) {
+	policy := &CipherPolicy{algorithms: make(map[byte]bool), modes: make(map[cipherblockmode]bool)}
+
+	for _, name := range splitList(algorithms) {
+		algorithm, err := parseAlgorithm(name)
+		if err != nil {
+			return nil, err
+		}
+		policy.algorithms[algorithm] = true
+	}
+
+	for _, name := range splitList(modes) {
+		mode, err := parseCipherMode(name)
+		if err != nil {
+			return nil, err
+		}
+		policy.modes[mode] = true
+	}
+
+	if len(policy.algorithms) == 0 || len(policy.modes) == 0 {
+		return nil, fmt.Errorf("CipherPolicyInit: at least one algorithm and one cipher mode must be allowed")
+	}
+
+	if minKeyBits <= 0 || minKeyBits%8 != 0 {
+		return nil, fmt.Errorf("CipherPolicyInit: wrong minimal key size %d", minKeyBits)
+	}
+	policy.minKeySize = uint32(minKeyBits / 8)
+
+	return policy, nil
+}
+
+//splitList returns non empty elements of comma separated list
+func splitList(list string) (elements []string) {
+	for _, element := range strings.Split(list, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			elements = append(elements, element)
+		}
+	}
+	return
+}
+
+//parseAlgorithm returns algorithm with given name, e.g. aes
+func parseAlgorithm(name string) (byte, error) {
+	for algorithm, algorithmName := range algorithmNames {
+		if strings.EqualFold(name, algorithmName) {
+			return byte(algorithm), nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown algorithm %s. Known algorithms: %s", name, strings.Join(algorithmNames[:], ", "))
+}
+
+//CheckMode returns error if cipher mode is not allowed. Without policy every supported mode is allowed
+func (policy *CipherPolicy) CheckMode(mode cipherblockmode) error {
+	if err := supportedCipherMode(mode); err != nil {
+		return err
+	}
+	if policy != nil && !policy.modes[mode] {
+		return policyErrorf("Cipher mode %s is not allowed by local policy", mode)
+	}
+	return nil
+}
+
+//CheckProperties returns error if session parameters proposed by peer are not allowed
+func (policy *CipherPolicy) CheckProperties(algorithm byte, keySize uint32, mode cipherblockmode) error {
+	if policy == nil {
+		return nil
+	}
+	if !policy.algorithms[algorithm] {
+		return policyErrorf("Algorithm %d is not allowed by local policy", algorithm)
+	}
+	if keySize < policy.minKeySize {
+		return policyErrorf("Key size of %d bits is below minimum of %d bits", keySize*8, policy.minKeySize*8)
+	}
+	return policy.CheckMode(mode)
+}
+
+//allowedMode returns the first allowed cipher mode in ECB, CBC, CFB, OFB order
+func (policy *CipherPolicy) allowedMode() cipherblockmode {
+	for mode := range cipherModeNames {
+		if policy.CheckMode(cipherblockmode(mode)) == nil {
+			return cipherblockmode(mode)
+		}
+	}
+	return CBC
+}
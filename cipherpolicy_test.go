@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCipherPolicyInit(t *testing.T) {
+	if _, err := CipherPolicyInit("aes", "cbc,xts", 256); err == nil {
+		t.Error("Unknown cipher mode should not be accepted")
+	}
+
+	if _, err := CipherPolicyInit("des", "cbc", 256); err == nil {
+		t.Error("Unknown algorithm should not be accepted")
+	}
+
+	if _, err := CipherPolicyInit("aes", " , ", 256); err == nil {
+		t.Error("Policy without cipher modes should not be accepted")
+	}
+
+	if _, err := CipherPolicyInit("aes", "cbc", 100); err == nil {
+		t.Error("Key size not being multiple of 8 should not be accepted")
+	}
+}
+
+func TestCipherPolicyCheck(t *testing.T) {
+	policy, err := CipherPolicyInit("AES", "cbc, OFB", 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = policy.CheckProperties(0, 32, CBC); err != nil {
+		t.Error(err)
+	}
+
+	if _, ok := policy.CheckProperties(0, 32, ECB).(*PolicyError); !ok {
+		t.Error("ECB should be refused with policy error")
+	}
+
+	if _, ok := policy.CheckProperties(0, 16, OFB).(*PolicyError); !ok {
+		t.Error("128 bit key should be refused with policy error")
+	}
+
+	if _, ok := policy.CheckProperties(1, 32, CBC).(*PolicyError); !ok {
+		t.Error("Unknown algorithm should be refused with policy error")
+	}
+
+	if policy.allowedMode() != CBC {
+		t.Errorf("CBC should be the first allowed mode, got %s", policy.allowedMode())
+	}
+
+	var noPolicy *CipherPolicy
+	if err = noPolicy.CheckMode(ECB); err != nil {
+		t.Error("Without policy every supported mode should be allowed")
+	}
+	if err = noPolicy.CheckMode(cipherblockmode(len(cipherModeNames))); err == nil {
+		t.Error("Unsupported mode should be refused without policy too")
+	}
+}
+
+func TestCipherModeRefusedByPolicy(t *testing.T) {
+	initiator, responder := authenticatedSessionPair()
+	defer initiator.Close()
+	defer responder.Close()
+
+	policy, err := CipherPolicyInit("aes", "cbc,cfb,ofb", 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder.messageHandler.cipherPolicy = policy
+
+	go serveTestSession(t, initiator, make(chan string))
+	go serveTestSession(t, responder, make(chan string))
+
+	err = initiator.RequestCipherMode(ECB)
+	if err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("ECB should be refused by peer policy with reason, got %v", err)
+	}
+
+	if initiator.CipherMode() != CBC || responder.CipherMode() != CBC {
+		t.Errorf("Refused change should keep CBC, initiator uses %s, responder %s", initiator.CipherMode(), responder.CipherMode())
+	}
+
+	initiator.messageHandler.cipherPolicy = policy
+	if err = initiator.RequestCipherMode(ECB); err == nil {
+		t.Error("Mode not allowed by own policy should not be requested")
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+//loadConfig reads config file with name=value lines (names are the same as flag names) and sets flags not given on command line
+func loadConfig(configFile string) error {
+	file, err := os.Open(configFile)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	setOnCommandLine := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		setOnCommandLine[f.Name] = true
+	})
+
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		nameValue := strings.SplitN(line, "=", 2)
+		if len(nameValue) != 2 {
+			return fmt.Errorf("loadConfig: %s:%d: expected name=value", configFile, lineNumber)
+		}
+		name := strings.TrimSpace(nameValue[0])
+		if setOnCommandLine[name] {
+			continue
+		}
+		if err = flag.Set(name, strings.TrimSpace(nameValue[1])); err != nil {
+			return fmt.Errorf("loadConfig: %s:%d: %v", configFile, lineNumber, err)
+		}
+	}
+
+	return scanner.Err()
+}
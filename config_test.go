@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	defer func(commandLine *flag.FlagSet) { flag.CommandLine = commandLine }(flag.CommandLine)
+	flag.CommandLine = flag.NewFlagSet("sstt", flag.ContinueOnError)
+	accept := flag.String("accept", "prompt", "")
+	port := flag.Int("port", 27002, "")
+	console := flag.Bool("console", false, "")
+
+	dir, err := ioutil.TempDir("", "sstt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := path.Join(dir, "config")
+	ioutil.WriteFile(configFile, []byte("# Settings\naccept = known\n\nport=27010\nconsole=true\n"), 0600)
+
+	//Flag given on command line takes precedence
+	if err = flag.CommandLine.Parse([]string{"-port", "27003"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = loadConfig(configFile); err != nil {
+		t.Fatal(err)
+	}
+	if *accept != "known" || *port != 27003 || !*console {
+		t.Errorf("Expected accept=known from file, port=27003 from command line and console from file, got %s %d %v", *accept, *port, *console)
+	}
+
+	for _, content := range []string{"accept\n", "unknown=1\n", "port=many\n"} {
+		flag.CommandLine = flag.NewFlagSet("sstt", flag.ContinueOnError)
+		flag.String("accept", "prompt", "")
+		flag.Int("port", 27002, "")
+		ioutil.WriteFile(configFile, []byte(content), 0600)
+		if err = loadConfig(configFile); err == nil {
+			t.Errorf("Config %q should be refused", content)
+		}
+	}
+	if err = loadConfig(path.Join(dir, "missing")); err == nil {
+		t.Error("Missing config file should be reported")
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+)
+
+//Console is used for reading user input in console mode. Every line goes to handler unless some question is waiting for an answer
+type Console struct {
+	reader  *bufio.Reader
+	answers chan string
+}
+
+//ConsoleInit creates console reading lines from given reader
+func ConsoleInit(reader *bufio.Reader) *Console {
+	return &Console{reader: reader, answers: make(chan string)}
+}
+
+//Run reads lines until input is closed. Lines not being an answer are passed to handler
+func (console *Console) Run(handler func(line string)) {
+	for {
+		line, err := console.reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		select {
+		case console.answers <- line:
+		default:
+			handler(line)
+		}
+	}
+}
+
+//Ask prints question and waits for next line typed by user
+func (console *Console) Ask(question string) string {
+	fmt.Print(question)
+	return strings.TrimSpace(<-console.answers)
+}
+
+//Confirm asks yes/no question. Anything other than y or yes means no
+func (console *Console) Confirm(question string) bool {
+	answer := strings.ToLower(console.Ask(question + " [y/N]: "))
+	return answer == "y" || answer == "yes"
+}
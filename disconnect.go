@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+)
+
+//disconnectreason tells peer why session was closed without error
+type disconnectreason byte
+
+// Structure representing disconnect reasons sent in DISCONNECT frame
+const (
+	//User closed session
+	DISCONNECTUSER = iota + 1
+	//Application is shutting down
+	DISCONNECTSHUTDOWN
+)
+
+var disconnectReasonNames = [...]string{"", "user request", "application shutdown"}
+
+func (reason disconnectreason) String() string {
+	if int(reason) < len(disconnectReasonNames) && reason != 0 {
+		return disconnectReasonNames[reason]
+	}
+	return fmt.Sprintf("reason %d", byte(reason))
+}
+
+//Disconnect is DISCONNECT frame received from peer. It's returned as error by frame handler so session read loop ends
+// Schema of frame
+// |reason byte|
+type Disconnect struct {
+	reason disconnectreason
+}
+
+func (disconnect *Disconnect) Error() string {
+	return disconnect.reason.String()
+}
+
+func encodeDisconnect(reason disconnectreason) []byte {
+	return []byte{byte(reason)}
+}
+
+func decodeDisconnect(payload []byte) (*Disconnect, error) {
+	if len(payload) != 1 {
+		return nil, sessionErrorf(ERRORPROTOCOL, "Wrong disconnect frame length %d", len(payload))
+	}
+	return &Disconnect{reason: disconnectreason(payload[0])}, nil
+}
+
+//Disconnect tells client in given session that user closed it and closes session
+func (netClient *NetClient) Disconnect(sessionID uint32, app *GUIApp) error {
+	session, err := netClient.sessions.Get(sessionID)
+	if err != nil {
+		return err
+	}
+	netClient.disconnect(session, DISCONNECTUSER, app)
+	return nil
+}
+
+//DisconnectAll tells clients in all sessions that application is shutting down and closes sessions
+func (netClient *NetClient) DisconnectAll(app *GUIApp) {
+	for _, session := range netClient.Sessions() {
+		netClient.disconnect(session, DISCONNECTSHUTDOWN, app)
+	}
+}
+
+//disconnect sends DISCONNECT frame and closes session. Read loop of session wipes its keys
+func (netClient *NetClient) disconnect(session *Session, reason disconnectreason, app *GUIApp) {
+	session.setCloseReason(reason.String())
+	if err := session.writePacket(DISCONNECT, encodeDisconnect(reason)); err != nil {
+		fmt.Println(err)
+	}
+	netClient.endSession(session, app)
+}
+
+//wipeKeys overwrites session key and keys of both directions when session is over
+func (session *Session) wipeKeys() {
+	session.keyMutex.Lock()
+	defer session.keyMutex.Unlock()
+
+	session.writeMutex.Lock()
+	defer session.writeMutex.Unlock()
+
+	session.messageHandler.zeroizeSessionKeys()
+	zeroize(session.responderKey)
+	zeroize(session.responderIV)
+
+	//Hybrid secret is left only if session ended during handshake
+	for i := range session.hybridSecret {
+		session.hybridSecret[i] = 0
+	}
+
+	if session.auth != nil {
+		session.auth.send.wipe()
+		session.auth.recv.wipe()
+		session.auth = nil
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDisconnect(t *testing.T) {
+	var nullGuiApp GUIApp
+	initiator, responder := authenticatedSessionPair()
+	netClient := NetClientInit(0, EncMess{}, AcceptPolicy{})
+
+	done := make(chan bool)
+	for _, session := range []*Session{initiator, responder} {
+		session.handshake = handshakeInState(t, session.initiator, STATEESTABLISHED)
+		netClient.sessions.Add(session)
+		go func(session *Session) {
+			netClient.serveSession(session, &nullGuiApp)
+			done <- true
+		}(session)
+	}
+
+	//Responder is receiving file when initiator disconnects
+	partialFile, err := ioutil.TempFile("", "sstt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileKeys := responder.auth.recv.snapshot()
+	responder.incomingFile = netClient.startFileDecryption("file", 100, partialFile, fileKeys, &nullGuiApp)
+	sendKey, recvKey := responder.auth.send.aesKey, responder.auth.recv.aesKey
+
+	if err = netClient.Disconnect(initiator.id, &nullGuiApp); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	<-done
+
+	if reason := responder.CloseReason(); reason != "by peer, user request" {
+		t.Errorf("Responder should know peer user disconnected, got %q", reason)
+	}
+
+	if responder.handshake.State() != STATECLOSED || len(netClient.Sessions()) != 0 {
+		t.Error("Both sessions should be closed and removed")
+	}
+
+	if _, err = os.Stat(partialFile.Name()); !os.IsNotExist(err) {
+		t.Error("Partially received file should be removed")
+	}
+
+	zero := make([]byte, len(sendKey))
+	if responder.auth != nil || !bytes.Equal(sendKey, zero) || !bytes.Equal(recvKey, zero) || !bytes.Equal(fileKeys.aesKey, zero) {
+		t.Error("Session keys should be wiped")
+	}
+}
+
+func TestDecodeDisconnect(t *testing.T) {
+	disconnect, err := decodeDisconnect(encodeDisconnect(DISCONNECTSHUTDOWN))
+	if err != nil || disconnect.reason != DISCONNECTSHUTDOWN {
+		t.Errorf("Expected shutdown reason, got %v %v", disconnect, err)
+	}
+
+	if _, err = decodeDisconnect(nil); err == nil {
+		t.Error("Empty disconnect frame should not be accepted")
+	}
+}
+
+func TestCloseReasonKeepsFirst(t *testing.T) {
+	var session Session
+	done := make(chan struct{})
+	go func() {
+		session.setCloseReason("3 heartbeats in a row not answered")
+		close(done)
+	}()
+	<-done
+	session.setCloseReason("by peer, user request")
+
+	if reason := session.CloseReason(); reason != "3 heartbeats in a row not answered" {
+		t.Errorf("First close reason should be kept, got %q", reason)
+	}
+}
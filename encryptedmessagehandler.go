@@ -1,21 +1,18 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"crypto/aes"
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"math/rand"
 	"os"
 	"path"
-	"strings"
 	"time"
 	"unicode/utf8"
-
-	"github.com/gotk3/gotk3/glib"
 )
 
 const rsaSize = 4096 / 8
@@ -35,6 +32,8 @@ type EncMess struct {
 	aesKey    []byte
 	//When changed by GUI connection properties must be sent to second client
 	cipherMode cipherblockmode
+	//Session parameters and cipher modes accepted from peer. nil allows every supported one
+	cipherPolicy *CipherPolicy
 }
 
 //EncryptedMessageHandler creates instance of encrypted message handler
@@ -52,45 +51,6 @@ func EncryptedMessageHandler(keySize uint32, cipher cipherblockmode) (encMess En
 	return
 }
 
-//HandleCipherMode decrypts cipher mode using privateKey
-//  Schema of frame
-// |ciphermode byte|
-//
-func (encMess *EncMess) HandleCipherMode(props []byte, app *GUIApp) error {
-
-	var decrypted []byte
-	var err error
-
-	if decrypted, err = DecryptRSA(props, encMess.myPrivateKey); err != nil {
-		encMess.cipherMode = 0
-		if app.cipherChoiceBox != nil {
-			glib.IdleAdd(func() {
-				app.UpdateCipherMode()
-			})
-		}
-		return nil
-	}
-
-	buf := bytes.NewBuffer(decrypted)
-
-	if err = binary.Read(buf, endianness, &encMess.cipherMode); err != nil {
-		return err
-	}
-
-	//Wrong cipher properties - assume defaults - don't throw error, it's project requirement
-	if encMess.cipherMode > 4 {
-		encMess.cipherMode = 0
-	}
-
-	if app.cipherChoiceBox != nil {
-		glib.IdleAdd(func() {
-			app.UpdateCipherMode()
-		})
-	}
-
-	return nil
-}
-
 //HandleConnectionPropertiesResponse decrypts connection properties using private key and sets all properties
 //  Schema of frame
 // |aesKey [keysize]byte|IV [blocksize]byte|
@@ -101,27 +61,15 @@ func (encMess *EncMess) HandleConnectionPropertiesResponse(props []byte, app *GU
 	var err error
 
 	if decrypted, err = DecryptRSA(props, encMess.myPrivateKey); err != nil {
-		if app.cipherChoiceBox != nil {
-			glib.IdleAdd(func() {
-				app.UpdateCipherMode()
-			})
-		}
-		return nil
+		return err
 	}
 
-	buf := bytes.NewBuffer(decrypted)
-
-	aesKeyRv := make([]byte, encMess.keySize)
-
-	if err = binary.Read(buf, endianness, aesKeyRv); err != nil {
-		//	return err
+	if len(decrypted) != int(encMess.keySize+encMess.blockSize) {
+		return errors.New("EncMess.HandleConnectionPropertiesResponse: Wrong frame length")
 	}
 
-	ivRv := make([]byte, encMess.blockSize)
-
-	if err = binary.Read(buf, endianness, ivRv); err != nil {
-		//return err
-	}
+	aesKeyRv := decrypted[:encMess.keySize]
+	ivRv := decrypted[encMess.keySize:]
 
 	//XORing our aes key and iv with received iv to improve security. Both clients are now responsible for generating these properties
 	for i := 0; i < int(encMess.keySize); i++ {
@@ -135,7 +83,8 @@ func (encMess *EncMess) HandleConnectionPropertiesResponse(props []byte, app *GU
 	return nil
 }
 
-//HandleConnectionProperties decrypts connection properties using private key and sets all properties
+//HandleConnectionProperties decrypts connection properties using private key and sets all properties.
+//Properties not allowed by cipher policy are refused with PolicyError
 //  Schema of frame
 // |alghorytm byte|keysize int32|blocksize int32|ciphermode byte|aesKey [keysize]byte|IV [blocksize]byte|
 //
@@ -145,67 +94,51 @@ func (encMess *EncMess) HandleConnectionProperties(props []byte, app *GUIApp) er
 	var err error
 
 	if decrypted, err = DecryptRSA(props, encMess.myPrivateKey); err != nil {
-		encMess.setDefaultConnectionParameters()
-		if app.cipherChoiceBox != nil {
-			glib.IdleAdd(func() {
-				app.UpdateCipherMode()
-			})
-		}
-		return nil
+		return err
 	}
 
 	buf := bytes.NewBuffer(decrypted)
 
-	if err = binary.Read(buf, endianness, &encMess.alghorytm); err != nil {
+	var alghorytm byte
+	var keySize, blockSize uint32
+	var cipherMode cipherblockmode
+
+	if err = binary.Read(buf, endianness, &alghorytm); err != nil {
 		return err
 	}
 
-	if err = binary.Read(buf, endianness, &encMess.keySize); err != nil {
+	if err = binary.Read(buf, endianness, &keySize); err != nil {
 		return err
 	}
 
-	if err = binary.Read(buf, endianness, &encMess.blockSize); err != nil {
+	if err = binary.Read(buf, endianness, &blockSize); err != nil {
 		return err
 	}
 
-	if err = binary.Read(buf, endianness, &encMess.cipherMode); err != nil {
+	if err = binary.Read(buf, endianness, &cipherMode); err != nil {
 		return err
 	}
 
-	encMess.aesKey = make([]byte, encMess.keySize)
-
-	if err = binary.Read(buf, endianness, encMess.aesKey); err != nil {
-		//	return err
+	if err = encMess.cipherPolicy.CheckProperties(alghorytm, keySize, cipherMode); err != nil {
+		return err
 	}
 
-	encMess.iv = make([]byte, encMess.blockSize)
-
-	if err = binary.Read(buf, endianness, encMess.iv); err != nil {
-		//return err
+	if (keySize != 16 && keySize != 24 && keySize != 32) || blockSize != aes.BlockSize {
+		return fmt.Errorf("EncMess.HandleConnectionProperties: Unsupported key size %d or block size %d", keySize, blockSize)
 	}
 
-	if encMess.cipherMode > 4 || encMess.blockSize%8 != 0 || encMess.keySize%8 != 0 {
-		encMess.setDefaultConnectionParameters()
-		if app.cipherChoiceBox != nil {
-			glib.IdleAdd(func() {
-				app.UpdateCipherMode()
-			})
-		}
+	if buf.Len() != int(keySize+blockSize) {
+		return errors.New("EncMess.HandleConnectionProperties: Wrong frame length")
 	}
 
-	return nil
-}
-
-func (encMess *EncMess) setDefaultConnectionParameters() {
-	fmt.Println("Setting default connection parameters")
-	encMess.keySize = 32
-	encMess.blockSize = aes.BlockSize
-	encMess.cipherMode = 0
-	encMess.alghorytm = 0
-	//encMess.iv = make([]byte, encMess.blockSize)
-	//encMess.aesKey = make([]byte, encMess.keySize)
-	//encMess.generateRandomKeyandIV()
+	encMess.alghorytm = alghorytm
+	encMess.keySize = keySize
+	encMess.blockSize = blockSize
+	encMess.cipherMode = cipherMode
+	encMess.aesKey = buf.Next(int(keySize))
+	encMess.iv = buf.Next(int(blockSize))
 
+	return nil
 }
 
 //HandleReceivedPublicKey is being executed when we receive client's public key
@@ -221,6 +154,14 @@ func (encMess *EncMess) HandleReceivedPublicKey(key []byte) error {
 		return err
 	}
 
+	if int(bits) > maxPublicKeySize {
+		return fmt.Errorf("EncMess.HandleReceivedPublicKey: Key of %d bytes exceeds limit of %d bytes", bits, maxPublicKeySize)
+	}
+
+	if bits <= 0 || int(bits) != buf.Len() {
+		return errors.New("EncMess.HandleReceivedPublicKey: Key size does not match frame length")
+	}
+
 	encMess.publicKeyClient = make([]byte, bits)
 
 	if err = binary.Read(buf, endianness, &encMess.publicKeyClient); err != nil {
@@ -233,76 +174,37 @@ func (encMess *EncMess) HandleReceivedPublicKey(key []byte) error {
 
 }
 
-//HandleTextMessage reader message from buffer and decrypts it
-func (encMess *EncMess) HandleTextMessage(reader *bufio.Reader, app *GUIApp) error {
+//HandleTextMessage decrypts message frame using keys of receiving direction. Message not being valid UTF-8 is returned as hex
+// Schema of frame
+// |message (encrypted) [length]byte|
+func (encMess *EncMess) HandleTextMessage(message []byte, keys *directionKeys, app *GUIApp) (string, error) {
 
 	var err error
 	var decrypted string
-	var size int32
 
-	if err = binary.Read(reader, endianness, &size); err != nil {
-		return err
+	if decrypted, err = DecryptTextMessage(keys.aesKey, keys.iv, message, keys.cipherMode, app); err != nil {
+		return "", err
 	}
 
-	var buf []byte = make([]byte, size)
-
-	if err = binary.Read(reader, endianness, buf); err != nil {
-		return err
+	if !utf8.ValidString(decrypted) {
+		return "(hex) " + hex.EncodeToString([]byte(decrypted)), nil
 	}
 
-	if decrypted, err = DecryptTextMessage(encMess.aesKey, encMess.iv, buf, encMess.cipherMode, app); err != nil {
-		return err
-	}
-
-	//TEST PRINTLN TODO GUI
-	fmt.Printf("Received message: %s\n", decrypted)
-	if app.messageTextIter != nil {
-		suffix := ""
-		if !strings.HasSuffix(decrypted, "\n") {
-			suffix = "\n"
-		}
-		if utf8.ValidString(decrypted) {
-			glib.IdleAdd(func() {
-				app.ShowMessage(decrypted + suffix)
-			})
-		} else {
-			glib.IdleAdd(func() {
-				app.ShowMessage("(hex) " + hex.EncodeToString([]byte(decrypted)) + suffix)
-			})
-		}
-	}
-	return nil
+	return decrypted, nil
 
 }
 
-//GenerateHelloMessage generates hello message and rsa keypair
-func (encMess *EncMess) GenerateHelloMessage(listenPort int32) (out []byte, err error) {
+//GenerateHelloMessage generates hello message containing our public key
+func (encMess *EncMess) GenerateHelloMessage() (out []byte, err error) {
 
 	buf := new(bytes.Buffer)
 
-	binary.Write(buf, endianness, listenPort)
-	binary.Write(buf, endianness, int32(cap(encMess.myPublicKey)))
+	binary.Write(buf, endianness, int32(len(encMess.myPublicKey)))
 	binary.Write(buf, endianness, encMess.myPublicKey)
 
 	return buf.Bytes(), nil
 }
 
-//GenerateCipherMode generates encrypted cipher mode frame using current settings
-// Schema of frame
-// |ciphermode byte|
-//
-func (encMess *EncMess) GenerateCipherMode() ([]byte, error) {
-	buf := new(bytes.Buffer)
-	binary.Write(buf, endianness, encMess.cipherMode)
-
-	out, err := EncryptRSA(buf.Bytes(), encMess.publicKeyClient)
-	if err != nil {
-		return nil, err
-	}
-
-	return out, nil
-}
-
 //GenerateConnectionProperties generates encrypted connection properties frame using current settings
 // Schema of frame
 // |alghorytm byte|keysize int32|blocksize int32|ciphermode byte|aesKey [keysize]byte|IV (if exists) [blocksize]byte|
@@ -358,19 +260,9 @@ func (encMess *EncMess) GenerateConnectionPropertiesResponse() ([]byte, error) {
 	return out, nil
 }
 
-//GenerateTextMessage generates aes encrypted text byte array
-func (encMess *EncMess) GenerateTextMessage(origText string, app *GUIApp) ([]byte, error) {
-	encrypted, err := EncryptTextMessage(encMess.aesKey, encMess.iv, origText, encMess.cipherMode, app)
-
-	if err != nil {
-		return nil, err
-	}
-
-	buf := new(bytes.Buffer)
-	binary.Write(buf, endianness, int32(len(encrypted)))
-	binary.Write(buf, endianness, encrypted)
-
-	return buf.Bytes(), nil
+//GenerateTextMessage generates aes encrypted text byte array using keys of sending direction
+func (encMess *EncMess) GenerateTextMessage(origText string, keys *directionKeys, app *GUIApp) ([]byte, error) {
+	return EncryptTextMessage(keys.aesKey, keys.iv, origText, keys.cipherMode, app)
 }
 
 //LoadKeys load keys encrypted by AES-CBC using SHA-256 hash
@@ -461,6 +353,20 @@ func (encMess *EncMess) CreateKeys(dir string, password string, app *GUIApp) (er
 	return nil
 }
 
+//sessionCopy returns handler for new session. It shares our keys and settings but has its own session key
+func (encMess *EncMess) sessionCopy() EncMess {
+	copied := *encMess
+	copied.publicKeyClient = nil
+	copied.generateRandomKeyandIV()
+	return copied
+}
+
+//zeroizeSessionKeys overwrites session key and IV when session is over
+func (encMess *EncMess) zeroizeSessionKeys() {
+	zeroize(encMess.aesKey)
+	zeroize(encMess.iv)
+}
+
 func (encMess *EncMess) generateRandomKeyandIV() {
 	encMess.iv = make([]byte, encMess.blockSize)
 	encMess.aesKey = make([]byte, encMess.keySize)
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+//Maximal length of frame payload
+const maxFrameSize = 4 * bufsize
+
+//Protocol versions we can speak, from the oldest. Version 1 agrees session key with CONNECTIONPROPERTIES, noiseVersion with Noise handshake.
+//Set from command line
+var supportedVersions, _ = handshakeVersions("any")
+
+//featureflags is bitmask of optional protocol features advertised in HELLO
+type featureflags uint32
+
+// Structure representing optional protocol features
+const (
+	//Peer accepts files
+	FEATUREFILES featureflags = 1 << iota
+	//Peer does hybrid X25519 + ML-KEM-768 key exchange (HYBRIDKEM frames)
+	FEATUREHYBRIDKEM
+	//Peer receives files by FILEOFFER and continues interrupted transfers
+	FEATURERESUME
+)
+
+//Features advertised by us. Hybrid key exchange depends on Go version app is built with
+var supportedFeatures = FEATUREFILES | hybridKEMFeature | FEATURERESUME
+
+// Structure representing frame flags
+const (
+	//Last FILEDATA frame of file
+	FLAGLAST byte = 1 << iota
+)
+
+//Frame is single unit of data sent through session
+// Schema of frame
+// |version byte|ptype byte|flags byte|length uint32|payload [length]byte|
+type Frame struct {
+	version byte
+	ptype   packettype
+	flags   byte
+	payload []byte
+	//Sequence number of authenticated frame (sent in payload). 0 for handshake frames
+	seq uint64
+}
+
+func writeFrame(writer io.Writer, frame Frame) error {
+	if len(frame.payload) > maxFrameSize {
+		return fmt.Errorf("writeFrame: payload of %d bytes exceeds frame size limit", len(frame.payload))
+	}
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, endianness, frame.version)
+	binary.Write(buf, endianness, frame.ptype)
+	binary.Write(buf, endianness, frame.flags)
+	binary.Write(buf, endianness, uint32(len(frame.payload)))
+	buf.Write(frame.payload)
+
+	_, err := writer.Write(buf.Bytes())
+	return err
+}
+
+//readFrame reads frame whose payload is at most limit(ptype) bytes, maxFrameSize if limit is nil.
+//Larger frames are refused with SessionError before payload is allocated
+func readFrame(reader io.Reader, limit func(packettype) uint32) (frame Frame, err error) {
+	header := make([]byte, 7)
+	if _, err = io.ReadFull(reader, header); err != nil {
+		return
+	}
+
+	frame.version = header[0]
+	frame.ptype = packettype(header[1])
+	frame.flags = header[2]
+	length := endianness.Uint32(header[3:])
+
+	maxLength := uint32(maxFrameSize)
+	if limit != nil {
+		maxLength = limit(frame.ptype)
+	}
+	if length > maxLength {
+		return frame, sessionErrorf(ERRORLIMIT, "Payload of %d bytes exceeds limit of %d bytes for frame type %d", length, maxLength, frame.ptype)
+	}
+
+	frame.payload = make([]byte, length)
+	_, err = io.ReadFull(reader, frame.payload)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+//Hello is protocol part of HELLO and HELLORESPONSE frames. HELLO lists all supported versions, HELLORESPONSE the chosen one
+// Schema of frame
+// |versionsCount byte|versions [versionsCount]byte|features uint32|public key part|
+type Hello struct {
+	versions []byte
+	features featureflags
+	key      []byte
+}
+
+func (hello *Hello) encode() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, endianness, byte(len(hello.versions)))
+	buf.Write(hello.versions)
+	binary.Write(buf, endianness, hello.features)
+	buf.Write(hello.key)
+	return buf.Bytes()
+}
+
+func decodeHello(payload []byte) (hello Hello, err error) {
+	reader := bytes.NewReader(payload)
+
+	var versionsCount byte
+	if err = binary.Read(reader, endianness, &versionsCount); err != nil {
+		return
+	}
+
+	if versionsCount == 0 || int(versionsCount) > reader.Len() {
+		return hello, errors.New("decodeHello: Wrong versions count")
+	}
+
+	hello.versions = make([]byte, versionsCount)
+	reader.Read(hello.versions)
+
+	if err = binary.Read(reader, endianness, &hello.features); err != nil {
+		return
+	}
+
+	hello.key = payload[len(payload)-reader.Len():]
+	return
+}
+
+//chooseVersion returns the highest version supported by both sides
+func chooseVersion(offered []byte) (byte, error) {
+	var chosen byte
+	for _, version := range offered {
+		for _, supported := range supportedVersions {
+			if version == supported && version > chosen {
+				chosen = version
+			}
+		}
+	}
+
+	if chosen == 0 {
+		return 0, fmt.Errorf("chooseVersion: No common protocol version. Offered %v, supported %v", offered, supportedVersions)
+	}
+
+	return chosen, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	buf := new(bytes.Buffer)
+	frame := Frame{version: 1, ptype: FILEDATA, flags: FLAGLAST, payload: []byte("encrypted file part")}
+
+	if err := writeFrame(buf, frame); err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := readFrame(buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if read.version != frame.version || read.ptype != frame.ptype || read.flags != frame.flags || !bytes.Equal(read.payload, frame.payload) {
+		t.Error("Read frame differs from written one")
+	}
+
+	if buf.Len() != 0 {
+		t.Error("Frame should be read exactly")
+	}
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, endianness, []byte{1, TEXTMESSAGE, 0})
+	binary.Write(buf, endianness, uint32(maxFrameSize+1))
+
+	if _, err := readFrame(buf, nil); err == nil {
+		t.Error("Frame exceeding size limit should be refused before reading payload")
+	}
+}
+
+func TestHelloVersionNegotiation(t *testing.T) {
+	hello := Hello{versions: []byte{1, 200}, features: FEATUREFILES, key: []byte("key")}
+
+	decoded, err := decodeHello(hello.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(decoded.versions, hello.versions) || decoded.features != hello.features || !bytes.Equal(decoded.key, hello.key) {
+		t.Error("Decoded hello differs from encoded one")
+	}
+
+	version, err := chooseVersion(decoded.versions)
+	if err != nil || version != 1 {
+		t.Errorf("Expected version 1, got %d (%v)", version, err)
+	}
+
+	if _, err = chooseVersion([]byte{200}); err == nil {
+		t.Error("Unsupported versions only should be refused")
+	}
+}
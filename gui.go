@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -27,6 +28,11 @@ type GUIApp struct {
 	//Connection Layout
 	connectionStatusLabel *gtk.Label
 	addressBox            *gtk.Entry
+	pairingCodeBox        *gtk.Entry
+	sessionChoiceBox      *gtk.ComboBoxText
+	disconnectButton      *gtk.Button
+	//Set while session list is rebuilt so choice box changes are not treated as user choice
+	refreshingSessions bool
 
 	//CipherChoice Layout
 	cipherChoiceBox *gtk.ComboBoxText
@@ -51,15 +57,34 @@ type GUIApp struct {
 	enterButton        *gtk.Button
 
 	//NetClient
-	port      int32
-	encryptor EncMess
-	netClient NetClient
+	port            int32
+	listenAddresses []string
+	encryptor       EncMess
+	netClient       NetClient
+	acceptPolicy    AcceptPolicy
+	revocations     *RevocationList
+	cipherPolicy    *CipherPolicy
+	proxy           *Proxy
+	tlsMode         tlsmode
 }
 
-//GUIAppNew return new instance of application
-func GUIAppNew(port int32) (app GUIApp) {
+//GUIAppNew return new instance of application listening on given port or bind addresses. Incoming connections are answered using given accept
+//policy and checked against revocation list and cipher policy. Outgoing connections go through proxy if it's not nil.
+//Sessions are wrapped in TLS according to tlsMode
+func GUIAppNew(port int32, listenAddresses []string, acceptPolicy AcceptPolicy, revocations *RevocationList, cipherPolicy *CipherPolicy,
+	proxy *Proxy, tlsMode tlsmode) (app GUIApp) {
+	app.proxy = proxy
+	app.tlsMode = tlsMode
 	app.port = port
-	app.mainWindow = initWindow(fmt.Sprintf("SimpleSecureTransferTool - listening on port %d", port))
+	app.listenAddresses = listenAddresses
+	app.acceptPolicy = acceptPolicy
+	app.revocations = revocations
+	app.cipherPolicy = cipherPolicy
+	listening := fmt.Sprintf("port %d", port)
+	if len(listenAddresses) > 0 {
+		listening = strings.Join(listenAddresses, ", ")
+	}
+	app.mainWindow = initWindow("SimpleSecureTransferTool - listening on " + listening)
 	app.mainLayout = getGridLayout()
 	if isPasswordSet() {
 		app.mainLayout.Add(app.getLoginLayout())
@@ -127,28 +152,62 @@ func (app *GUIApp) getConnectLayout() *gtk.Grid {
 	}
 	addressBox := getTextBox(addressCallback)
 	enterCallback := func(button *gtk.Button) {
-		if !app.netClient.connected {
-			text, _ := addressBox.GetText()
-			app.addressChosenCallback(text)
-		} else {
-			app.SetConnected(false)
-		}
+		text, _ := addressBox.GetText()
+		app.addressChosenCallback(text)
 	}
 	app.enterButton = getButton("Connect", enterCallback)
+	codeLabel, _ := gtk.LabelNew("Pairing code: ")
+	codeBox := getTextBox(func(textBox *gtk.Entry) {})
+	pairButton := getButton("Pair (empty code generates one)", func(button *gtk.Button) {
+		address, _ := addressBox.GetText()
+		code, _ := codeBox.GetText()
+		app.pairCallback(address, code)
+	})
 	layout.Attach(titleLabel, 0, 0, 1, 1)
 	layout.Attach(addressBox, 1, 0, 1, 1)
 	layout.Attach(app.enterButton, 0, 1, 2, 1)
+	layout.Attach(codeLabel, 0, 2, 1, 1)
+	layout.Attach(codeBox, 1, 2, 1, 1)
+	layout.Attach(pairButton, 0, 3, 2, 1)
 	app.addressBox = addressBox
+	app.pairingCodeBox = codeBox
+	return layout
+}
+
+func (app *GUIApp) getSessionChoiceLayout() *gtk.Grid {
+	layout := getGridLayout()
+	titleLabel, _ := gtk.LabelNew("Session: ")
+	choicesBox, _ := gtk.ComboBoxTextNew()
+	choicesBox.Connect("changed", func() {
+		if app.refreshingSessions {
+			return
+		}
+		sessionID, err := strconv.ParseUint(choicesBox.GetActiveID(), 10, 32)
+		if err != nil {
+			return
+		}
+		if err = app.netClient.SetActiveSession(uint32(sessionID), app); err != nil {
+			println(err.Error())
+		}
+	})
+	disconnectButton := getButton("Disconnect", func(button *gtk.Button) {
+		app.netClient.Disconnect(app.netClient.ActiveSession(), app)
+	})
+	disconnectButton.SetSensitive(false)
+	layout.Attach(titleLabel, 0, 0, 1, 1)
+	layout.Attach(choicesBox, 1, 0, 1, 1)
+	layout.Attach(disconnectButton, 0, 1, 2, 1)
+	app.sessionChoiceBox = choicesBox
+	app.disconnectButton = disconnectButton
 	return layout
 }
 
 func (app *GUIApp) getCipherChoiceLayout() *gtk.Grid {
 	layout := getGridLayout()
 	titleLabel, _ := gtk.LabelNew("Choose cipher mode: ")
-	choices := [4]string{"ECB", "CBC", "CFB", "OFB"}
 	choicesBox, _ := gtk.ComboBoxTextNew()
-	for i := 0; i < len(choices); i++ {
-		choicesBox.AppendText(choices[i])
+	for _, name := range cipherModeNames {
+		choicesBox.AppendText(name)
 	}
 	choicesBox.SetActive(1)
 	choicesBox.SetSensitive(false)
@@ -219,7 +278,7 @@ func (app *GUIApp) getMessagesLayout() *gtk.Grid {
 	titleLabel, _ := gtk.LabelNew("Messages: ")
 	textBoxCallback := func(textBox *gtk.Entry) {
 		text, _ := textBox.GetText()
-		str := fmt.Sprintf("%s You: %s\n", time.Now().Format("15:04"), text)
+		str := fmt.Sprintf("%s You to %s: %s\n", time.Now().Format("15:04"), app.activeSessionName(), text)
 		textBuffer.Insert(iter, str)
 		textBox.SetText("")
 		app.messageWrittenCallback(text)
@@ -229,7 +288,7 @@ func (app *GUIApp) getMessagesLayout() *gtk.Grid {
 	promptLabel, _ := gtk.LabelNew("Write message: ")
 	enterButtonCallback := func(button *gtk.Button) {
 		text, _ := textInput.GetText()
-		str := fmt.Sprintf("%s You: %s\n", time.Now().Format("15:04"), text)
+		str := fmt.Sprintf("%s You to %s: %s\n", time.Now().Format("15:04"), app.activeSessionName(), text)
 		textBuffer.Insert(iter, str)
 		textInput.SetText("")
 		app.messageWrittenCallback(text)
@@ -253,6 +312,7 @@ func (app *GUIApp) getMessagesLayout() *gtk.Grid {
 func (app *GUIApp) getConfigLayout() *gtk.Grid {
 	layout := getGridLayout()
 	addressLayout := app.getConnectLayout()
+	sessionLayout := app.getSessionChoiceLayout()
 	cipherLayout := app.getCipherChoiceLayout()
 	connectedLabel, _ := gtk.LabelNew("Connected: ")
 	statusLabel, _ := gtk.LabelNew("No")
@@ -267,18 +327,21 @@ func (app *GUIApp) getConfigLayout() *gtk.Grid {
 	layout.Attach(separator, 0, 1, 2, 1)
 	layout.Attach(addressLayout, 0, 2, 2, 1)
 	layout.Attach(separator, 0, 3, 2, 1)
-	layout.Attach(cipherLayout, 0, 4, 2, 1)
+	layout.Attach(sessionLayout, 0, 4, 2, 1)
 	layout.Attach(separator, 0, 5, 2, 1)
-	layout.Attach(sendFileButton, 0, 6, 2, 2)
+	layout.Attach(cipherLayout, 0, 6, 2, 1)
+	layout.Attach(separator, 0, 7, 2, 1)
+	layout.Attach(sendFileButton, 0, 8, 2, 2)
 	app.sendFileButton = sendFileButton
 	app.connectionStatusLabel = statusLabel
 	return layout
 }
 
 func (app *GUIApp) messageWrittenCallback(message string) {
-	err := app.netClient.SendTextMessage(message, app)
+	err := app.netClient.SendTextMessage(app.netClient.ActiveSession(), message, app)
 	if err != nil {
 		println(err.Error())
+		app.messageTextBuffer.Insert(app.messageTextIter, fmt.Sprintf("%v\n", err))
 	}
 	println("sending message: ", message)
 	for {
@@ -293,19 +356,32 @@ func (app *GUIApp) messageWrittenCallback(message string) {
 }
 
 func (app *GUIApp) cipherChosenCallback(cipher int) {
-	app.netClient.setCipher(cipherblockmode(cipher))
-	err := app.netClient.SendCipherMode()
-	if err != nil {
-		println(err.Error())
-	}
+	sessionID := app.netClient.ActiveSession()
 	println("Sending new cipher: ", cipher)
+	go func() {
+		if err := app.netClient.SendCipherMode(sessionID, cipherblockmode(cipher), app); err != nil {
+			app.ShowStatus(err.Error())
+		}
+	}()
 }
 
 func (app *GUIApp) passwordCallback(encryptor EncMess) {
 	leftLayout := app.getMessagesLayout()
 	app.encryptor = encryptor
-	app.netClient = NetClientInit(app.port, app.encryptor)
-	go app.netClient.NetClientListen(app)
+	app.acceptPolicy.SetPrompt(app.confirmDialog)
+	app.netClient = NetClientInit(app.port, app.encryptor, app.acceptPolicy)
+	app.netClient.SetRevocationList(app.revocations)
+	app.netClient.SetCipherPolicy(app.cipherPolicy)
+	app.netClient.SetProxy(app.proxy)
+	if transport, err := TLSTransportInit(app.encryptor.myPrivateKey, app.tlsMode); err != nil {
+		app.showErrorPopup(err)
+	} else {
+		app.netClient.SetTLSTransport(transport)
+	}
+	app.netClient.SetListenAddresses(app.listenAddresses)
+	if err := app.netClient.NetClientListen(app); err != nil {
+		app.showErrorPopup(err)
+	}
 	pane, _ := gtk.PanedNew(gtk.ORIENTATION_HORIZONTAL)
 	pane.Pack1(leftLayout, true, true)
 	rightLayout := app.getConfigLayout()
@@ -317,15 +393,50 @@ func (app *GUIApp) passwordCallback(encryptor EncMess) {
 	app.mainWindow.ShowAll()
 }
 
+//pairCallback pairs with peer using code it generated. Without code new one is generated and shown, then peer pairs with us
+//(through relay if its address is given)
+func (app *GUIApp) pairCallback(address string, code string) {
+	if strings.TrimSpace(code) == "" {
+		var err error
+		if code, err = app.netClient.NewPairingCode(); err != nil {
+			app.ShowStatus(err.Error())
+			return
+		}
+		app.pairingCodeBox.SetText(code)
+		app.ShowStatus(fmt.Sprintf("Pairing code: %s. Tell it to peer", code))
+		if !isRelayAddress(address) {
+			return
+		}
+	}
+
+	if isRelayAddress(address) {
+		//Waiting for peer on relay may take long
+		go func() {
+			if _, err := app.netClient.Pair(address, code, app); err != nil {
+				app.ShowStatus(err.Error())
+			}
+		}()
+		return
+	}
+	if _, err := app.netClient.Pair(address, code, app); err != nil {
+		app.ShowStatus(err.Error())
+	}
+}
+
 func (app *GUIApp) addressChosenCallback(address string) {
-	if len(strings.Split(address, ":")) == 1 {
-		address = fmt.Sprintf("%s:%d", address, 27002)
+	if isRelayAddress(address) {
+		//Waiting for peer on relay may take long
+		go func() {
+			if _, err := app.netClient.SendHello(address, app); err != nil {
+				app.ShowStatus(err.Error())
+			}
+		}()
+		return
 	}
-	err := app.netClient.SendHello(address)
+	_, err := app.netClient.SendHello(address, app)
 	if err != nil {
 		println("not connected")
 		app.messageTextBuffer.Insert(app.messageTextIter, fmt.Sprintf("%v\n", err))
-		app.SetConnected(false)
 	}
 }
 
@@ -334,7 +445,13 @@ func (app *GUIApp) sendFileCallback(filename string) {
 	if err != nil {
 		app.showErrorPopup(err)
 	} else {
-		go app.netClient.SendFile(file, app)
+		sessionID := app.netClient.ActiveSession()
+		go func() {
+			defer file.Close()
+			if err := app.netClient.SendFile(sessionID, file, app); err != nil {
+				app.ShowStatus(err.Error())
+			}
+		}()
 	}
 }
 
@@ -346,6 +463,23 @@ func (app *GUIApp) showErrorPopup(err error) {
 	popup.Run()
 }
 
+//confirmDialog shows yes/no dialog and waits for user answer. It must not be called from GTK main loop
+func (app *GUIApp) confirmDialog(question string) bool {
+	response := make(chan gtk.ResponseType, 1)
+	glib.IdleAdd(func() {
+		messagedialog := gtk.MessageDialogNew(
+			app.mainWindow,
+			gtk.DIALOG_MODAL,
+			gtk.MESSAGE_INFO,
+			gtk.BUTTONS_YES_NO,
+			question)
+
+		response <- messagedialog.Run()
+		messagedialog.Destroy()
+	})
+	return <-response == gtk.RESPONSE_YES
+}
+
 //ShowDownloadFilePopup shows dialog containing downloading and decrypting file progress bar
 func (app *GUIApp) ShowDownloadFilePopup(filename string) {
 	window, _ := gtk.WindowNew(gtk.WINDOW_TOPLEVEL)
@@ -394,14 +528,22 @@ func (app *GUIApp) UpdateUploadProgress(value float64, duration string) {
 	app.uploadTimeLabel.SetText(duration)
 }
 
-//UpdateCipherMode updates cipher mode choice box
+//UpdateCipherMode updates cipher mode choice box to mode of active session
 func (app *GUIApp) UpdateCipherMode() {
-	app.cipherChoiceBox.SetActive(int(app.netClient.getCipher()))
+	app.cipherChoiceBox.SetActive(int(app.netClient.getCipher(app.netClient.ActiveSession())))
 }
 
-//ShowMessage shows user message in the messaging box
-func (app *GUIApp) ShowMessage(message string) {
-	app.PushMessageToBuffer("Friend: " + message)
+//ShowMessage prints message received in session and shows it in the messaging box if GUI is running
+func (app *GUIApp) ShowMessage(session *Session, message string) {
+	fmt.Printf("Received message from %s: %s\n", session, message)
+	if app.messageTextBuffer != nil {
+		if !strings.HasSuffix(message, "\n") {
+			message += "\n"
+		}
+		glib.IdleAdd(func() {
+			app.PushMessageToBuffer(fmt.Sprintf("%s: %s", session, message))
+		})
+	}
 }
 
 //PushMessageToBuffer shows message in the messaging box
@@ -419,46 +561,80 @@ func (app *GUIApp) PushMessageToBuffer(message string) {
 	app.messagesTextView.ScrollToIter(autoIter, 0.0, true, 0.5, 0.5)
 }
 
-//ChangeAddress sets showed address to value
-func (app *GUIApp) ChangeAddress(address string) {
-	if app.addressBox != nil {
+//ShowStatus prints status message and shows it in the messaging box if GUI is running
+func (app *GUIApp) ShowStatus(message string) {
+	fmt.Println(message)
+	if app.messageTextBuffer != nil {
 		glib.IdleAdd(func() {
-			app.addressBox.SetText(address)
+			app.PushMessageToBuffer(message + "\n")
 		})
 	}
 }
 
-//SetConnected sets label to Yes if given true
-func (app *GUIApp) SetConnected(connected bool) {
-	app.netClient.SetClientState(connected)
+//RefreshSessions updates session choice box and enables controls if active session is established
+func (app *GUIApp) RefreshSessions() {
+	if app.sessionChoiceBox != nil {
+		glib.IdleAdd(app.updateSessionWidgets)
+	}
+}
+
+func (app *GUIApp) updateSessionWidgets() {
+	activeID := app.netClient.ActiveSession()
+	app.refreshingSessions = true
+	app.sessionChoiceBox.RemoveAll()
+	for _, session := range app.netClient.Sessions() {
+		app.sessionChoiceBox.Append(strconv.FormatUint(uint64(session.id), 10),
+			fmt.Sprintf("%s (%s)", session, session.handshake.State()))
+	}
+	app.sessionChoiceBox.SetActiveID(strconv.FormatUint(uint64(activeID), 10))
+	app.refreshingSessions = false
 
+	connected := app.netClient.IsConnected(activeID)
+	app.updateConnectionStatus()
 	if connected {
-		go app.netClient.StartPinging(app)
+		app.UpdateCipherMode()
 	}
 
-	if app.connectionStatusLabel != nil {
-		glib.IdleAdd(func() {
-			if connected {
-				app.connectionStatusLabel.SetText("Yes")
-				app.PushMessageToBuffer("Connected\n")
-				app.enterButton.SetLabel("Disconnect")
-			} else {
-				app.connectionStatusLabel.SetText("No")
-				app.PushMessageToBuffer("Disconnected\n")
-				app.enterButton.SetLabel("Connect")
-			}
+	app.disconnectButton.SetSensitive(activeID != 0)
+	app.textInput.SetSensitive(connected)
+	app.sendTextButton.SetSensitive(connected)
+	app.cipherChoiceBox.SetSensitive(connected)
+	app.cipherSelectButton.SetSensitive(connected)
+	app.sendFileButton.SetSensitive(connected)
+}
 
-			app.textInput.SetSensitive(connected)
-			app.sendTextButton.SetSensitive(connected)
-			app.cipherChoiceBox.SetSensitive(connected)
-			app.cipherSelectButton.SetSensitive(connected)
-			app.sendFileButton.SetSensitive(connected)
-		})
+//ShowConnectionQuality updates connection status if given session is the active one
+func (app *GUIApp) ShowConnectionQuality(session *Session) {
+	if app.connectionStatusLabel != nil && session.id == app.netClient.ActiveSession() {
+		glib.IdleAdd(app.updateConnectionStatus)
+	}
+}
+
+//updateConnectionStatus shows if active session is established and its connection quality
+func (app *GUIApp) updateConnectionStatus() {
+	session, err := app.netClient.establishedSession(app.netClient.ActiveSession())
+	if err != nil {
+		app.connectionStatusLabel.SetText("No")
+		return
+	}
+	app.connectionStatusLabel.SetText("Yes (" + session.heartbeat.Quality().String() + ")")
+}
+
+//activeSessionName returns description of session messages are sent to
+func (app *GUIApp) activeSessionName() string {
+	for _, session := range app.netClient.Sessions() {
+		if session.id == app.netClient.ActiveSession() {
+			return session.String()
+		}
 	}
+	return "nobody"
 }
 
 //RunGUI starts gui of the application
 func (app *GUIApp) RunGUI() {
 	app.mainWindow.ShowAll()
 	gtk.Main()
+	if app.netClient.sessions != nil {
+		app.netClient.DisconnectAll(app)
+	}
 }
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+//sessionstate represents state of session handshake
+type sessionstate byte
+
+// Structure representing session states
+const (
+	//Connection opened, nothing sent yet
+	STATEIDLE = iota
+	//We sent HELLO and wait for HELLORESPONSE
+	STATEHELLOSENT
+	//We received HELLO and wait for local decision (accept policy)
+	STATEAWAITINGACCEPT
+	//Public keys exchanged, waiting for session key (CONNECTIONPROPERTIES, its response or Noise handshake)
+	STATEKEYSEXCHANGED
+	//Session key agreed. Messages and files can be sent
+	STATEESTABLISHED
+	//Session is over
+	STATECLOSED
+	//We sent PAIR and wait for PAIRRESPONSE
+	STATEPAIRSENT
+	//We answered PAIR and wait for key confirmation of peer
+	STATEPAIRING
+)
+
+var sessionStateNames = [...]string{"idle", "hello-sent", "awaiting-accept", "keys-exchanged", "established", "closed", "pair-sent", "pairing"}
+
+func (state sessionstate) String() string {
+	if int(state) < len(sessionStateNames) {
+		return sessionStateNames[state]
+	}
+	return fmt.Sprintf("unknown(%d)", byte(state))
+}
+
+//handshakeevent represents event changing session state
+type handshakeevent byte
+
+// Structure representing handshake events
+const (
+	EVENTSENDHELLO = iota
+	EVENTRECVHELLO
+	EVENTACCEPT
+	EVENTRECVHELLORESPONSE
+	EVENTRECVPROPERTIES
+	EVENTRECVPROPERTIESRESPONSE
+	EVENTRECVNOISE
+	EVENTRECVNOISEFINAL
+	EVENTSENDPAIR
+	EVENTRECVPAIR
+	EVENTRECVPAIRRESPONSE
+	EVENTRECVPAIRCONFIRM
+	EVENTRECVHYBRIDKEM
+	EVENTRECVHYBRIDKEMRESPONSE
+	//Events below close session from any state
+	EVENTREJECT
+	EVENTTIMEOUT
+	EVENTERROR
+	EVENTCLOSE
+)
+
+var handshakeEventNames = [...]string{"send-hello", "recv-hello", "accept", "recv-hello-response", "recv-properties",
+	"recv-properties-response", "recv-noise", "recv-noise-final", "send-pair", "recv-pair", "recv-pair-response", "recv-pair-confirm",
+	"recv-hybrid-kem", "recv-hybrid-kem-response", "reject", "timeout", "error", "close"}
+
+func (event handshakeevent) String() string {
+	if int(event) < len(handshakeEventNames) {
+		return handshakeEventNames[event]
+	}
+	return fmt.Sprintf("unknown(%d)", byte(event))
+}
+
+//Transitions of client which sent HELLO
+var initiatorTransitions = map[sessionstate]map[handshakeevent]sessionstate{
+	STATEIDLE:          {EVENTSENDHELLO: STATEHELLOSENT, EVENTSENDPAIR: STATEPAIRSENT},
+	STATEHELLOSENT:     {EVENTRECVHELLORESPONSE: STATEKEYSEXCHANGED},
+	STATEKEYSEXCHANGED: {EVENTRECVPROPERTIESRESPONSE: STATEESTABLISHED, EVENTRECVNOISEFINAL: STATEESTABLISHED, EVENTRECVHYBRIDKEMRESPONSE: STATEKEYSEXCHANGED},
+	STATEPAIRSENT:      {EVENTRECVPAIRRESPONSE: STATEESTABLISHED},
+}
+
+//Transitions of client which received HELLO
+var responderTransitions = map[sessionstate]map[handshakeevent]sessionstate{
+	STATEIDLE:           {EVENTRECVHELLO: STATEAWAITINGACCEPT, EVENTRECVPAIR: STATEPAIRING},
+	STATEAWAITINGACCEPT: {EVENTACCEPT: STATEKEYSEXCHANGED},
+	STATEKEYSEXCHANGED:  {EVENTRECVPROPERTIES: STATEESTABLISHED, EVENTRECVNOISE: STATEKEYSEXCHANGED, EVENTRECVNOISEFINAL: STATEESTABLISHED, EVENTRECVHYBRIDKEM: STATEKEYSEXCHANGED},
+	STATEPAIRING:        {EVENTRECVPAIRCONFIRM: STATEESTABLISHED},
+}
+
+//How long session can stay in given state. States not listed have no timeout
+var stateTimeouts = map[sessionstate]time.Duration{
+	STATEIDLE:           10 * time.Second,
+	STATEHELLOSENT:      75 * time.Second,
+	STATEAWAITINGACCEPT: 60 * time.Second,
+	STATEKEYSEXCHANGED:  15 * time.Second,
+	STATEPAIRSENT:       15 * time.Second,
+	STATEPAIRING:        15 * time.Second,
+}
+
+//Handshake is state machine of single session. It's safe to use from many goroutines
+type Handshake struct {
+	mutex       sync.Mutex
+	state       sessionstate
+	transitions map[sessionstate]map[handshakeevent]sessionstate
+	timer       *time.Timer
+	//Increased on every transition so timer of old state does nothing
+	generation int
+	onTimeout  func(state sessionstate)
+	//True if session ever reached established state
+	established bool
+}
+
+//HandshakeInit creates state machine in idle state. onTimeout is called (in separate thread) when session stays in some state for too long
+func HandshakeInit(initiator bool, onTimeout func(state sessionstate)) *Handshake {
+	handshake := &Handshake{state: STATEIDLE, onTimeout: onTimeout, transitions: responderTransitions}
+	if initiator {
+		handshake.transitions = initiatorTransitions
+	}
+	handshake.mutex.Lock()
+	handshake.armTimer()
+	handshake.mutex.Unlock()
+	return handshake
+}
+
+//State returns current state
+func (handshake *Handshake) State() sessionstate {
+	handshake.mutex.Lock()
+	defer handshake.mutex.Unlock()
+	return handshake.state
+}
+
+//WasEstablished returns true if session reached established state, even if it's closed now
+func (handshake *Handshake) WasEstablished() bool {
+	handshake.mutex.Lock()
+	defer handshake.mutex.Unlock()
+	return handshake.established
+}
+
+//Check returns error if event is not allowed in current state. State is not changed
+func (handshake *Handshake) Check(event handshakeevent) error {
+	handshake.mutex.Lock()
+	defer handshake.mutex.Unlock()
+
+	if handshake.state == STATECLOSED {
+		return fmt.Errorf("Handshake: %s not allowed, session is closed", event)
+	}
+
+	if _, ok := handshake.transitions[handshake.state][event]; !ok && event < EVENTREJECT {
+		return fmt.Errorf("Handshake: %s not allowed in %s state", event, handshake.state)
+	}
+
+	return nil
+}
+
+//Fire changes state according to event. Error is returned if event is not allowed in current state
+func (handshake *Handshake) Fire(event handshakeevent) (sessionstate, error) {
+	handshake.mutex.Lock()
+	defer handshake.mutex.Unlock()
+
+	if handshake.state == STATECLOSED {
+		return handshake.state, fmt.Errorf("Handshake: %s not allowed, session is closed", event)
+	}
+
+	next := sessionstate(STATECLOSED)
+	if event < EVENTREJECT {
+		var ok bool
+		if next, ok = handshake.transitions[handshake.state][event]; !ok {
+			return handshake.state, fmt.Errorf("Handshake: %s not allowed in %s state", event, handshake.state)
+		}
+	}
+
+	handshake.state = next
+	if next == STATEESTABLISHED {
+		handshake.established = true
+	}
+	handshake.generation++
+	handshake.armTimer()
+
+	return handshake.state, nil
+}
+
+//armTimer starts timeout of current state. Mutex must be locked
+func (handshake *Handshake) armTimer() {
+	if handshake.timer != nil {
+		handshake.timer.Stop()
+		handshake.timer = nil
+	}
+
+	timeout, ok := stateTimeouts[handshake.state]
+	if !ok {
+		return
+	}
+
+	generation := handshake.generation
+	state := handshake.state
+	handshake.timer = time.AfterFunc(timeout, func() {
+		handshake.mutex.Lock()
+		if handshake.generation != generation {
+			handshake.mutex.Unlock()
+			return
+		}
+		handshake.state = STATECLOSED
+		handshake.generation++
+		handshake.mutex.Unlock()
+
+		if handshake.onTimeout != nil {
+			handshake.onTimeout(state)
+		}
+	})
+}
+
+//eventForFrame returns handshake event caused by receiving frame. Frames not being part of handshake are allowed only in established state
+func eventForFrame(ptype packettype) (event handshakeevent, isHandshake bool) {
+	switch ptype {
+	case HELLO:
+		return EVENTRECVHELLO, true
+	case HELLORESPONSE:
+		return EVENTRECVHELLORESPONSE, true
+	case CONNECTIONPROPERTIES:
+		return EVENTRECVPROPERTIES, true
+	case CONNECTIONPROPERTIESRESPONSE:
+		return EVENTRECVPROPERTIESRESPONSE, true
+	case NOISE:
+		return EVENTRECVNOISE, true
+	case NOISEFINAL:
+		return EVENTRECVNOISEFINAL, true
+	case PAIR:
+		return EVENTRECVPAIR, true
+	case PAIRRESPONSE:
+		return EVENTRECVPAIRRESPONSE, true
+	case PAIRCONFIRM:
+		return EVENTRECVPAIRCONFIRM, true
+	case HYBRIDKEM:
+		return EVENTRECVHYBRIDKEM, true
+	case HYBRIDKEMRESPONSE:
+		return EVENTRECVHYBRIDKEMRESPONSE, true
+	case ERROR:
+		return EVENTERROR, true
+	case DISCONNECT:
+		return EVENTCLOSE, true
+	}
+	return 0, false
+}
+
+//errorcode tells peer why session was refused or closed
+type errorcode byte
+
+// Structure representing error codes sent in ERROR frame
+const (
+	//Malformed or unexpected frame
+	ERRORPROTOCOL = iota + 1
+	ERRORREJECTED
+	ERRORREVOKED
+	ERRORVERSION
+	ERRORTIMEOUT
+	ERRORBUSY
+	ERRORINTERNAL
+	ERRORAUTHENTICATION
+	//Proposed session parameters are not allowed by cipher policy
+	ERRORPOLICY
+	//TLS certificate key differs from public key sent in HELLO
+	ERRORCERTIFICATE
+	//Frame, public key or file exceeds our limits
+	ERRORLIMIT
+)
+
+var errorCodeNames = [...]string{"", "protocol error", "rejected", "key revoked", "no common protocol version", "timeout", "busy",
+	"internal error", "authentication failed", "refused by security policy",
+	"certificate mismatch", "limit exceeded"}
+
+func (code errorcode) String() string {
+	if int(code) < len(errorCodeNames) && code != 0 {
+		return errorCodeNames[code]
+	}
+	return fmt.Sprintf("error %d", byte(code))
+}
+
+//SessionError is error which ends session. Its code and message are sent to peer in ERROR frame
+type SessionError struct {
+	code    errorcode
+	message string
+	//Error was received from peer so it must not be sent back
+	fromPeer bool
+}
+
+func (err *SessionError) Error() string {
+	return fmt.Sprintf("%s: %s", err.code, err.message)
+}
+
+func sessionErrorf(code errorcode, format string, args ...interface{}) *SessionError {
+	return &SessionError{code: code, message: fmt.Sprintf(format, args...)}
+}
+
+//encodeError generates ERROR frame
+// Schema of frame
+// |code byte|message [rest]byte|
+func encodeError(err *SessionError) []byte {
+	return append([]byte{byte(err.code)}, err.message...)
+}
+
+func decodeError(payload []byte) *SessionError {
+	if len(payload) == 0 {
+		return &SessionError{code: ERRORPROTOCOL, message: "empty error frame", fromPeer: true}
+	}
+	return &SessionError{code: errorcode(payload[0]), message: string(payload[1:]), fromPeer: true}
+}
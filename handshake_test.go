@@ -0,0 +1,232 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+//Events leading from idle state to given state
+var initiatorPaths = map[sessionstate][]handshakeevent{
+	STATEIDLE:          {},
+	STATEHELLOSENT:     {EVENTSENDHELLO},
+	STATEKEYSEXCHANGED: {EVENTSENDHELLO, EVENTRECVHELLORESPONSE},
+	STATEESTABLISHED:   {EVENTSENDHELLO, EVENTRECVHELLORESPONSE, EVENTRECVPROPERTIESRESPONSE},
+	STATEPAIRSENT:      {EVENTSENDPAIR},
+}
+
+var responderPaths = map[sessionstate][]handshakeevent{
+	STATEIDLE:           {},
+	STATEAWAITINGACCEPT: {EVENTRECVHELLO},
+	STATEKEYSEXCHANGED:  {EVENTRECVHELLO, EVENTACCEPT},
+	STATEESTABLISHED:    {EVENTRECVHELLO, EVENTACCEPT, EVENTRECVPROPERTIES},
+	STATEPAIRING:        {EVENTRECVPAIR},
+}
+
+func handshakeInState(t *testing.T, initiator bool, state sessionstate) *Handshake {
+	paths := responderPaths
+	if initiator {
+		paths = initiatorPaths
+	}
+
+	handshake := HandshakeInit(initiator, nil)
+	for _, event := range paths[state] {
+		if _, err := handshake.Fire(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if handshake.State() != state {
+		t.Fatalf("Expected %s state, got %s", state, handshake.State())
+	}
+
+	return handshake
+}
+
+func TestHandshakeInitiator(t *testing.T) {
+	handshake := handshakeInState(t, true, STATEESTABLISHED)
+
+	if !handshake.WasEstablished() {
+		t.Error("Handshake should remember it was established")
+	}
+
+	handshake.Fire(EVENTCLOSE)
+
+	if handshake.State() != STATECLOSED || !handshake.WasEstablished() {
+		t.Error("Closed session should remember it was established")
+	}
+}
+
+func TestHandshakeResponder(t *testing.T) {
+	handshake := handshakeInState(t, false, STATEESTABLISHED)
+
+	if !handshake.WasEstablished() {
+		t.Error("Handshake should remember it was established")
+	}
+}
+
+func TestHandshakeOtherPaths(t *testing.T) {
+	cases := []struct {
+		initiator bool
+		events    []handshakeevent
+	}{
+		//Noise handshake with hybrid key exchange
+		{true, []handshakeevent{EVENTSENDHELLO, EVENTRECVHELLORESPONSE, EVENTRECVHYBRIDKEMRESPONSE, EVENTRECVNOISEFINAL}},
+		{false, []handshakeevent{EVENTRECVHELLO, EVENTACCEPT, EVENTRECVHYBRIDKEM, EVENTRECVNOISE, EVENTRECVNOISEFINAL}},
+		//RSA key exchange with hybrid key exchange
+		{true, []handshakeevent{EVENTSENDHELLO, EVENTRECVHELLORESPONSE, EVENTRECVHYBRIDKEMRESPONSE, EVENTRECVPROPERTIESRESPONSE}},
+		{false, []handshakeevent{EVENTRECVHELLO, EVENTACCEPT, EVENTRECVHYBRIDKEM, EVENTRECVPROPERTIES}},
+		//Pairing
+		{true, []handshakeevent{EVENTSENDPAIR, EVENTRECVPAIRRESPONSE}},
+		{false, []handshakeevent{EVENTRECVPAIR, EVENTRECVPAIRCONFIRM}},
+	}
+
+	for _, c := range cases {
+		handshake := HandshakeInit(c.initiator, nil)
+		for _, event := range c.events {
+			if _, err := handshake.Fire(event); err != nil {
+				t.Fatalf("Initiator %v: %v", c.initiator, err)
+			}
+		}
+		if handshake.State() != STATEESTABLISHED || !handshake.WasEstablished() {
+			t.Errorf("Initiator %v: %v should establish session, got %s", c.initiator, c.events, handshake.State())
+		}
+	}
+
+	//Frames of the other side of handshake and of other handshake are refused
+	illegal := []struct {
+		initiator bool
+		state     sessionstate
+		event     handshakeevent
+	}{
+		{true, STATEKEYSEXCHANGED, EVENTRECVNOISE},
+		{true, STATEKEYSEXCHANGED, EVENTRECVHYBRIDKEM},
+		{false, STATEKEYSEXCHANGED, EVENTRECVHYBRIDKEMRESPONSE},
+		{true, STATEPAIRSENT, EVENTRECVHELLORESPONSE},
+		{true, STATEPAIRSENT, EVENTRECVPAIRCONFIRM},
+		{false, STATEPAIRING, EVENTRECVPAIRRESPONSE},
+		{false, STATEPAIRING, EVENTRECVNOISEFINAL},
+		{false, STATEESTABLISHED, EVENTRECVHYBRIDKEM},
+		{false, STATEESTABLISHED, EVENTRECVPAIR},
+	}
+	for _, c := range illegal {
+		handshake := handshakeInState(t, c.initiator, c.state)
+		if _, err := handshake.Fire(c.event); err == nil || handshake.State() != c.state {
+			t.Errorf("Initiator %v: %s should not be allowed in %s state", c.initiator, c.event, c.state)
+		}
+	}
+}
+
+func TestHandshakeUnexpectedEvents(t *testing.T) {
+	for _, initiator := range []bool{true, false} {
+		transitions, paths := responderTransitions, responderPaths
+		if initiator {
+			transitions, paths = initiatorTransitions, initiatorPaths
+		}
+
+		for state := range paths {
+			for event := handshakeevent(EVENTSENDHELLO); event < EVENTREJECT; event++ {
+				if _, allowed := transitions[state][event]; allowed {
+					continue
+				}
+
+				handshake := handshakeInState(t, initiator, state)
+				if _, err := handshake.Fire(event); err == nil {
+					t.Errorf("Initiator %v: %s should not be allowed in %s state", initiator, event, state)
+				}
+
+				if handshake.State() != state {
+					t.Errorf("Initiator %v: unexpected %s changed %s state to %s", initiator, event, state, handshake.State())
+				}
+			}
+		}
+	}
+}
+
+func TestHandshakeClosingEvents(t *testing.T) {
+	for _, initiator := range []bool{true, false} {
+		paths := responderPaths
+		if initiator {
+			paths = initiatorPaths
+		}
+
+		for state := range paths {
+			for _, event := range []handshakeevent{EVENTREJECT, EVENTTIMEOUT, EVENTERROR, EVENTCLOSE} {
+				handshake := handshakeInState(t, initiator, state)
+
+				if next, err := handshake.Fire(event); err != nil || next != STATECLOSED {
+					t.Errorf("Initiator %v: %s in %s state should close session, got %s (%v)", initiator, event, state, next, err)
+				}
+
+				if _, err := handshake.Fire(EVENTCLOSE); err == nil {
+					t.Error("No event should be allowed in closed state")
+				}
+			}
+		}
+	}
+}
+
+func TestHandshakeTimeouts(t *testing.T) {
+	savedTimeouts := stateTimeouts
+	defer func() {
+		stateTimeouts = savedTimeouts
+	}()
+
+	//All states with timeout time out quickly
+	stateTimeouts = make(map[sessionstate]time.Duration)
+	for state := range savedTimeouts {
+		stateTimeouts[state] = 20 * time.Millisecond
+	}
+
+	for _, initiator := range []bool{true, false} {
+		paths := responderPaths
+		if initiator {
+			paths = initiatorPaths
+		}
+
+		for state, path := range paths {
+			timedOut := make(chan sessionstate, 1)
+			handshake := HandshakeInit(initiator, func(state sessionstate) {
+				timedOut <- state
+			})
+			for _, event := range path {
+				handshake.Fire(event)
+			}
+
+			if _, hasTimeout := stateTimeouts[state]; !hasTimeout {
+				select {
+				case <-timedOut:
+					t.Errorf("%s state should not time out", state)
+				case <-time.After(100 * time.Millisecond):
+				}
+				continue
+			}
+
+			select {
+			case timedOutState := <-timedOut:
+				if timedOutState != state {
+					t.Errorf("Expected timeout in %s state, got %s", state, timedOutState)
+				}
+			case <-time.After(time.Second):
+				t.Errorf("%s state should time out", state)
+			}
+
+			if handshake.State() != STATECLOSED {
+				t.Errorf("Timed out session should be closed, is %s", handshake.State())
+			}
+		}
+	}
+}
+
+func TestEventForFrame(t *testing.T) {
+	if event, isHandshake := eventForFrame(HELLO); !isHandshake || event != EVENTRECVHELLO {
+		t.Error("HELLO should be handshake frame")
+	}
+
+	if event, isHandshake := eventForFrame(ERROR); !isHandshake || event != EVENTERROR {
+		t.Error("ERROR should close session in any state")
+	}
+
+	if _, isHandshake := eventForFrame(TEXTMESSAGE); isHandshake {
+		t.Error("TEXTMESSAGE should be allowed only in established session")
+	}
+}
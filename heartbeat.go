@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+//PING is sent every heartbeatInterval. Peer is gone when heartbeatMisses PINGs in a row are not answered. Set from command line
+var heartbeatInterval = 2 * time.Second
+var heartbeatMisses = 3
+
+//ConnectionQuality is measured by heartbeats of session
+type ConnectionQuality struct {
+	//Round trip time of the last answered PING and its smoothed variation
+	RTT    time.Duration
+	Jitter time.Duration
+	//PINGs not answered in a row
+	Missed int
+	//PINGs sent and answered during whole session
+	Sent     uint64
+	Answered uint64
+}
+
+func (quality ConnectionQuality) String() string {
+	if quality.Answered == 0 {
+		return fmt.Sprintf("no heartbeat answered yet, missed %d/%d", quality.Missed, heartbeatMisses)
+	}
+	return fmt.Sprintf("RTT %v, jitter %v, missed %d/%d, answered %d of %d", quality.RTT.Round(10*time.Microsecond),
+		quality.Jitter.Round(10*time.Microsecond), quality.Missed, heartbeatMisses, quality.Answered, quality.Sent)
+}
+
+//Heartbeat keeps PING waiting for answer and measures connection quality. It's safe to use from many goroutines
+// Schema of PING and PONG frame
+// |id uint64|
+type Heartbeat struct {
+	mutex   sync.Mutex
+	quality ConnectionQuality
+	//ID and send time of the last PING. Answers to older ones are ignored
+	lastID   uint64
+	lastSent time.Time
+	answered bool
+}
+
+//ping returns payload of next PING. Previous PING not answered by now is counted as missed.
+//Returns false if too many PINGs in a row were missed
+func (heartbeat *Heartbeat) ping(now time.Time) ([]byte, bool) {
+	heartbeat.mutex.Lock()
+	defer heartbeat.mutex.Unlock()
+
+	if heartbeat.lastID != 0 && !heartbeat.answered {
+		heartbeat.quality.Missed++
+		if heartbeat.quality.Missed >= heartbeatMisses {
+			return nil, false
+		}
+	}
+
+	heartbeat.lastID++
+	heartbeat.lastSent = now
+	heartbeat.answered = false
+	heartbeat.quality.Sent++
+
+	payload := make([]byte, 8)
+	endianness.PutUint64(payload, heartbeat.lastID)
+	return payload, true
+}
+
+//pong handles answer to PING. Returns true if it answers the last PING and quality was updated
+func (heartbeat *Heartbeat) pong(payload []byte, now time.Time) (bool, error) {
+	if len(payload) != 8 {
+		return false, errors.New("Heartbeat.pong: Wrong frame length")
+	}
+
+	heartbeat.mutex.Lock()
+	defer heartbeat.mutex.Unlock()
+
+	id := endianness.Uint64(payload)
+	if id > heartbeat.lastID {
+		return false, fmt.Errorf("Heartbeat.pong: Answer to PING %d which was not sent", id)
+	}
+	if id != heartbeat.lastID || heartbeat.answered {
+		return false, nil
+	}
+
+	rtt := now.Sub(heartbeat.lastSent)
+	quality := &heartbeat.quality
+	if quality.Answered > 0 {
+		//Smoothed like interarrival jitter of RTP (RFC 3550)
+		difference := rtt - quality.RTT
+		if difference < 0 {
+			difference = -difference
+		}
+		quality.Jitter += (difference - quality.Jitter) / 16
+	}
+	quality.RTT = rtt
+	quality.Missed = 0
+	quality.Answered++
+	heartbeat.answered = true
+
+	return true, nil
+}
+
+//Quality returns connection quality measured so far
+func (heartbeat *Heartbeat) Quality() ConnectionQuality {
+	heartbeat.mutex.Lock()
+	defer heartbeat.mutex.Unlock()
+	return heartbeat.quality
+}
+
+//runHeartbeat sends PING every heartbeatInterval until session ends. Session is closed if peer stops answering
+func (netClient *NetClient) runHeartbeat(session *Session) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-session.done:
+			return
+		case <-ticker.C:
+		}
+
+		payload, alive := session.heartbeat.ping(time.Now())
+		if !alive {
+			session.setCloseReason(fmt.Sprintf("%d heartbeats in a row not answered", heartbeatMisses))
+			session.closeWithError(sessionErrorf(ERRORTIMEOUT, "No answer to %d heartbeats", heartbeatMisses))
+			return
+		}
+
+		if err := session.writePacket(PING, payload); err != nil {
+			return
+		}
+	}
+}
+
+//handleHeartbeat queues answer to PING and updates connection quality when PONG is received
+func (netClient *NetClient) handleHeartbeat(session *Session, frame Frame, app *GUIApp) error {
+	if frame.ptype == PING {
+		if len(frame.payload) != 8 {
+			return sessionErrorf(ERRORPROTOCOL, "Wrong ping frame length %d", len(frame.payload))
+		}
+		return session.reply(func() error {
+			return session.writePacket(PONG, frame.payload)
+		})
+	}
+
+	answered, err := session.heartbeat.pong(frame.payload, time.Now())
+	if err != nil {
+		return sessionErrorf(ERRORPROTOCOL, "%v", err)
+	}
+	if answered {
+		app.ShowConnectionQuality(session)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHeartbeatQuality(t *testing.T) {
+	var heartbeat Heartbeat
+	now := time.Now()
+
+	for i, rtt := range []time.Duration{10 * time.Millisecond, 26 * time.Millisecond} {
+		payload, alive := heartbeat.ping(now)
+		if !alive {
+			t.Fatal("Answered heartbeats should keep session alive")
+		}
+		now = now.Add(rtt)
+		if answered, err := heartbeat.pong(payload, now); !answered || err != nil {
+			t.Fatalf("PONG %d should be accepted, got %v %v", i, answered, err)
+		}
+	}
+
+	quality := heartbeat.Quality()
+	if quality.RTT != 26*time.Millisecond || quality.Jitter != time.Millisecond || quality.Answered != 2 || quality.Sent != 2 {
+		t.Errorf("Unexpected quality %+v", quality)
+	}
+
+	payload, _ := heartbeat.ping(now)
+	if answered, _ := heartbeat.pong(payload, now); !answered {
+		t.Fatal("PONG should be accepted")
+	}
+	if answered, err := heartbeat.pong(payload, now); answered || err != nil {
+		t.Error("Repeated PONG should be ignored")
+	}
+
+	endianness.PutUint64(payload, 100)
+	if _, err := heartbeat.pong(payload, now); err == nil {
+		t.Error("PONG to PING which was not sent should not be accepted")
+	}
+}
+
+func TestHeartbeatMisses(t *testing.T) {
+	var heartbeat Heartbeat
+	now := time.Now()
+
+	stale, _ := heartbeat.ping(now)
+	for i := 1; i < heartbeatMisses; i++ {
+		if _, alive := heartbeat.ping(now); !alive {
+			t.Fatalf("Session should be alive after %d missed heartbeats", i)
+		}
+	}
+
+	if answered, _ := heartbeat.pong(stale, now); answered {
+		t.Error("Answer to old PING should be ignored")
+	}
+
+	if missed := heartbeat.Quality().Missed; missed != heartbeatMisses-1 {
+		t.Errorf("Expected %d missed heartbeats, got %d", heartbeatMisses-1, missed)
+	}
+
+	if _, alive := heartbeat.ping(now); alive {
+		t.Errorf("Session should be dead after %d missed heartbeats", heartbeatMisses)
+	}
+}
+
+func TestPongWhileWriterWaits(t *testing.T) {
+	var nullGuiApp GUIApp
+	var netClient NetClient
+	initiator, responder := authenticatedSessionPair()
+	defer initiator.Close()
+	defer responder.Close()
+
+	//Writer of file waits until peer reads. Read loop must not wait for it to answer PING
+	responder.writeMutex.Lock()
+	answered := make(chan error, 1)
+	go func() {
+		answered <- netClient.handleHeartbeat(responder, Frame{ptype: PING, payload: make([]byte, 8)}, &nullGuiApp)
+	}()
+	select {
+	case err := <-answered:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("PING answer should not wait for writer")
+	}
+	responder.writeMutex.Unlock()
+
+	if frame, err := initiator.readFrame(); err != nil || frame.ptype != PONG {
+		t.Errorf("Expected PONG, got %d %v", frame.ptype, err)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+)
+
+//hybridKEM is hybrid X25519 + ML-KEM-768 key exchange done next to RSA or Noise handshake when both peers advertise FEATUREHYBRIDKEM.
+//Its secret is mixed into session key, so recorded session stays confidential even if RSA or X25519 falls to quantum computer later,
+//as long as ML-KEM holds
+// Schema of HYBRIDKEM frame sent by initiator after HELLORESPONSE
+// |x25519 public [32]byte|mlkem encapsulation key [mlkemEncapsulationKeyLen]byte|
+// Schema of HYBRIDKEMRESPONSE frame
+// |x25519 public [32]byte|mlkem ciphertext [mlkemCiphertextLen]byte|
+type hybridKEM struct {
+	x25519      noiseKeyPair
+	decapsulate func(ciphertext []byte) ([]byte, error)
+	//Sent HYBRIDKEM frame
+	request []byte
+}
+
+//newX25519KeyPair generates ephemeral X25519 keypair
+func newX25519KeyPair() (noiseKeyPair, error) {
+	private := make([]byte, noiseKeyLen)
+	if _, err := rand.Read(private); err != nil {
+		return noiseKeyPair{}, err
+	}
+	return noiseKeyPairInit(private)
+}
+
+//hybridSecret combines both shared secrets with public values of exchange
+func hybridSecret(mlkemShared []byte, x25519Shared []byte, request []byte, response []byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte("sstt hybrid X25519 ML-KEM-768"))
+	for _, part := range [][]byte{mlkemShared, x25519Shared, request, response} {
+		hash.Write(part)
+	}
+	return hash.Sum(nil)
+}
+
+//sendHybridKEM starts hybrid key exchange if peer supports it. Initiator sends it after HELLORESPONSE before other key exchange frames
+func (netClient *NetClient) sendHybridKEM(session *Session) error {
+	if session.features&FEATUREHYBRIDKEM == 0 {
+		return nil
+	}
+
+	ephemeral, err := newX25519KeyPair()
+	if err != nil {
+		return err
+	}
+	encapsulationKey, decapsulate, err := mlkemKeyPair()
+	if err != nil {
+		return err
+	}
+
+	request := append(append([]byte{}, ephemeral.public...), encapsulationKey...)
+	session.hybrid = &hybridKEM{x25519: ephemeral, decapsulate: decapsulate, request: request}
+	return session.writePacket(HYBRIDKEM, request)
+}
+
+//handleHybridKEM encapsulates secret for initiator and answers with HYBRIDKEMRESPONSE
+func (netClient *NetClient) handleHybridKEM(session *Session, payload []byte) error {
+	if session.features&FEATUREHYBRIDKEM == 0 || session.hybridSecret != nil {
+		return sessionErrorf(ERRORPROTOCOL, "Unexpected hybrid key exchange")
+	}
+	if len(payload) != noiseKeyLen+mlkemEncapsulationKeyLen {
+		return sessionErrorf(ERRORPROTOCOL, "Wrong length of hybrid key exchange frame")
+	}
+
+	mlkemShared, ciphertext, err := mlkemEncapsulate(payload[noiseKeyLen:])
+	if err != nil {
+		return sessionErrorf(ERRORPROTOCOL, "%v", err)
+	}
+	ephemeral, err := newX25519KeyPair()
+	if err != nil {
+		return err
+	}
+	x25519Shared, err := x25519(ephemeral.private, payload[:noiseKeyLen])
+	if err != nil {
+		return sessionErrorf(ERRORPROTOCOL, "%v", err)
+	}
+
+	response := append(append([]byte{}, ephemeral.public...), ciphertext...)
+	session.hybridSecret = hybridSecret(mlkemShared, x25519Shared, payload, response)
+	return session.writePacket(HYBRIDKEMRESPONSE, response)
+}
+
+//handleHybridKEMResponse decapsulates secret sent by responder
+func (netClient *NetClient) handleHybridKEMResponse(session *Session, payload []byte) error {
+	if session.hybrid == nil {
+		return sessionErrorf(ERRORPROTOCOL, "Unexpected hybrid key exchange response")
+	}
+	if len(payload) != noiseKeyLen+mlkemCiphertextLen {
+		return sessionErrorf(ERRORPROTOCOL, "Wrong length of hybrid key exchange response")
+	}
+	hybrid := session.hybrid
+	session.hybrid = nil
+
+	mlkemShared, err := hybrid.decapsulate(payload[noiseKeyLen:])
+	if err != nil {
+		return sessionErrorf(ERRORPROTOCOL, "%v", err)
+	}
+	x25519Shared, err := x25519(hybrid.x25519.private, payload[:noiseKeyLen])
+	if err != nil {
+		return sessionErrorf(ERRORPROTOCOL, "%v", err)
+	}
+
+	session.hybridSecret = hybridSecret(mlkemShared, x25519Shared, hybrid.request, payload)
+	return nil
+}
+
+//bindHelloTranscript derives key and IV of version 1 session from ones sent in CONNECTIONPROPERTIES and both HELLO frames.
+//HELLO frames aren't authenticated, so if features were changed on the way (e.g. FEATUREHYBRIDKEM cleared to skip hybrid key exchange)
+//peers end up with different keys and first authenticated frame fails. Noise handshake binds them as prologue instead
+func bindHelloTranscript(session *Session) error {
+	if session.helloTranscript == nil {
+		return sessionErrorf(ERRORPROTOCOL, "Session key can't be bound to missing HELLO frames")
+	}
+
+	transcript := sha256.Sum256(session.helloTranscript)
+	if !mixSessionKey(transcript[:], session.messageHandler.aesKey, session.messageHandler.iv) {
+		return sessionErrorf(ERRORINTERNAL, "Session key too long to bind HELLO frames")
+	}
+	return nil
+}
+
+//mixSessionKey replaces key and IV with ones derived from them and secret. It returns false if they are longer than derived ones
+func mixSessionKey(secret []byte, aesKey []byte, iv []byte) bool {
+	derivedKey, derivedIV := noiseHKDF(secret, append(append([]byte{}, aesKey...), iv...))
+	if len(aesKey) > len(derivedKey) || len(iv) > len(derivedIV) {
+		return false
+	}
+	copy(aesKey, derivedKey)
+	copy(iv, derivedIV)
+	return true
+}
+
+//mixHybridSecret derives session keys and IVs from ones agreed by handshake and secret of hybrid key exchange.
+//Session of peers which both advertised FEATUREHYBRIDKEM is refused without it. Paired sessions don't negotiate it, see pairingFeatures
+func mixHybridSecret(session *Session) error {
+	if session.features&FEATUREHYBRIDKEM == 0 {
+		return nil
+	}
+	if session.hybridSecret == nil {
+		return sessionErrorf(ERRORPROTOCOL, "Hybrid key exchange was not done")
+	}
+
+	if !mixSessionKey(session.hybridSecret, session.messageHandler.aesKey, session.messageHandler.iv) ||
+		session.responderKey != nil && !mixSessionKey(session.hybridSecret, session.responderKey, session.responderIV) {
+		return sessionErrorf(ERRORINTERNAL, "Session key too long for hybrid key exchange")
+	}
+
+	for i := range session.hybridSecret {
+		session.hybridSecret[i] = 0
+	}
+	session.hybridSecret = nil
+	fmt.Printf("Session key of %s mixed with hybrid X25519 + ML-KEM-768 secret\n", session)
+	return nil
+}
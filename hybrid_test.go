@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestHybridKEMExchange(t *testing.T) {
+	if hybridKEMFeature == 0 {
+		t.Skip("ML-KEM is not available")
+	}
+	initiator, responder := authenticatedSessionPair()
+	defer initiator.Close()
+	defer responder.Close()
+	for _, session := range []*Session{initiator, responder} {
+		session.features = FEATUREHYBRIDKEM
+		session.messageHandler.aesKey = bytes.Repeat([]byte{1}, 32)
+		session.messageHandler.iv = bytes.Repeat([]byte{2}, 16)
+	}
+
+	var netClient NetClient
+	go netClient.sendHybridKEM(initiator)
+	frame, err := responder.readFrame()
+	if err != nil || frame.ptype != HYBRIDKEM {
+		t.Fatalf("Expected HYBRIDKEM frame, got %d %v", frame.ptype, err)
+	}
+	go func() {
+		if err := netClient.handleHybridKEM(responder, frame.payload); err != nil {
+			t.Error(err)
+		}
+	}()
+	if frame, err = initiator.readFrame(); err != nil || frame.ptype != HYBRIDKEMRESPONSE {
+		t.Fatalf("Expected HYBRIDKEMRESPONSE frame, got %d %v", frame.ptype, err)
+	}
+	if err = netClient.handleHybridKEMResponse(initiator, frame.payload); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(initiator.hybridSecret, responder.hybridSecret) {
+		t.Fatal("Both sides should agree on hybrid secret")
+	}
+	for _, session := range []*Session{initiator, responder} {
+		if err = mixHybridSecret(session); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(initiator.messageHandler.aesKey, responder.messageHandler.aesKey) ||
+		bytes.Equal(initiator.messageHandler.aesKey, bytes.Repeat([]byte{1}, 32)) {
+		t.Error("Session key should be replaced by the same mixed one on both sides")
+	}
+
+	//Peers which advertised hybrid key exchange must do it
+	if err, ok := mixHybridSecret(initiator).(*SessionError); !ok || err.code != ERRORPROTOCOL {
+		t.Errorf("Session without hybrid secret should be refused, got %v", err)
+	}
+	if err, ok := netClient.handleHybridKEM(responder, make([]byte, 10)).(*SessionError); !ok || err.code != ERRORPROTOCOL {
+		t.Errorf("Malformed HYBRIDKEM should be refused, got %v", err)
+	}
+}
+
+func TestHandshakeWithHybridKEM(t *testing.T) {
+	if hybridKEMFeature == 0 {
+		t.Skip("ML-KEM is not available")
+	}
+	defer func(versions []byte) { supportedVersions = versions }(supportedVersions)
+	for _, versions := range [][]byte{{1}, {noiseVersion}} {
+		supportedVersions = versions
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		testTransfer(t, listener, listener.Addr().String(), nil)
+	}
+}
+
+func TestHandshakeWithoutHybridKEM(t *testing.T) {
+	defer func(features featureflags) { supportedFeatures = features }(supportedFeatures)
+	supportedFeatures = FEATUREFILES
+
+	var nullGuiApp GUIApp
+	initiator, responder := testNetClient(t), testNetClient(t)
+	defer os.RemoveAll(initiator.receiveDir)
+	defer os.RemoveAll(responder.receiveDir)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go responder.serveListener(listener, &nullGuiApp)
+
+	sessionID, err := initiator.SendHello(listener.Addr().String(), &nullGuiApp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer initiator.Disconnect(sessionID, &nullGuiApp)
+	if !waitFor(func() bool { return initiator.IsConnected(sessionID) }) {
+		t.Fatal("Session without hybrid key exchange should be established")
+	}
+	if session, _ := initiator.establishedSession(sessionID); session.features&FEATUREHYBRIDKEM != 0 {
+		t.Error("Hybrid key exchange should not be negotiated")
+	}
+}
+
+//stripHybridKEM relays connection to address and clears FEATUREHYBRIDKEM in HELLO frames going both ways
+func stripHybridKEM(t *testing.T, listener net.Listener, address string) {
+	strip := func(from io.Reader, to io.Writer) error {
+		frame, err := readFrame(from, nil)
+		if err != nil {
+			return err
+		}
+		hello, err := decodeHello(frame.payload)
+		if err != nil {
+			return err
+		}
+		hello.features &^= FEATUREHYBRIDKEM
+		frame.payload = hello.encode()
+		if err = writeFrame(to, frame); err != nil {
+			return err
+		}
+		_, err = io.Copy(to, from)
+		return err
+	}
+
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	server, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer server.Close()
+
+	var magic uint32
+	if err = binary.Read(conn, endianness, &magic); err != nil {
+		return
+	}
+	binary.Write(server, endianness, magic)
+	go strip(server, conn)
+	strip(conn, server)
+}
+
+func TestHandshakeWithStrippedHybridKEM(t *testing.T) {
+	if hybridKEMFeature == 0 {
+		t.Skip("ML-KEM is not available")
+	}
+	defer func(versions []byte) { supportedVersions = versions }(supportedVersions)
+	supportedVersions = []byte{1}
+
+	var nullGuiApp GUIApp
+	initiator, responder := testNetClient(t), testNetClient(t)
+	defer os.RemoveAll(initiator.receiveDir)
+	defer os.RemoveAll(responder.receiveDir)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go responder.serveListener(listener, &nullGuiApp)
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go stripHybridKEM(t, proxy, listener.Addr().String())
+
+	//Peers see each other's changed HELLO, so their session keys differ and first authenticated frame ends session
+	sessionID, err := initiator.SendHello(proxy.Addr().String(), &nullGuiApp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer initiator.Disconnect(sessionID, &nullGuiApp)
+	if !waitFor(func() bool { return initiator.IsConnected(sessionID) }) {
+		t.Fatal("Handshake should finish before first authenticated frame")
+	}
+	if err = initiator.SendTextMessage(sessionID, "Stripped", &nullGuiApp); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(func() bool { return !initiator.IsConnected(sessionID) && len(responder.sessions.List()) == 0 }) {
+		t.Error("Session with stripped hybrid key exchange should fail")
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+//Prefix of optional known peers field holding Noise static key of peer
+const noiseKeyField = "noise:"
+
+//Directory of knownPeers file. Console and GUI mode share it, so peer known in one mode is known in the other
+const knownPeersDir = "peers"
+
+//KnownPeers is structure holding public key fingerprints of clients we already accepted or connected to
+type KnownPeers struct {
+	file  string
+	mutex sync.Mutex
+	peers map[string]string
+	//Noise static keys learned by XX handshake. Known peers are then connected using IK
+	staticKeys map[string][]byte
+}
+
+//KnownPeersLoad loads known peers from knownPeers file in given directory. Missing file means no known peers
+// Schema of line
+// |fingerprint hex|address|noise:static key hex (optional)|
+func KnownPeersLoad(dir string) (*KnownPeers, error) {
+	knownPeers := &KnownPeers{file: path.Join(dir, "knownPeers"), peers: make(map[string]string), staticKeys: make(map[string][]byte)}
+
+	file, err := os.Open(knownPeers.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return knownPeers, nil
+		}
+		return nil, err
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		peer := strings.ToLower(fields[0])
+		var address []string
+		for _, field := range fields[1:] {
+			if strings.HasPrefix(field, noiseKeyField) {
+				if key, err := hex.DecodeString(strings.TrimPrefix(field, noiseKeyField)); err == nil && len(key) == noiseKeyLen {
+					knownPeers.staticKeys[peer] = key
+				}
+				continue
+			}
+			address = append(address, field)
+		}
+		knownPeers.peers[peer] = strings.Join(address, " ")
+	}
+
+	return knownPeers, scanner.Err()
+}
+
+//IsKnown returns true if peer with given fingerprint was accepted before
+func (knownPeers *KnownPeers) IsKnown(fingerprint string) bool {
+	if knownPeers == nil {
+		return false
+	}
+	knownPeers.mutex.Lock()
+	defer knownPeers.mutex.Unlock()
+	_, ok := knownPeers.peers[strings.ToLower(fingerprint)]
+	return ok
+}
+
+//Add remembers peer and saves whole list to file
+func (knownPeers *KnownPeers) Add(fingerprint string, address string) error {
+	if knownPeers == nil {
+		return nil
+	}
+	knownPeers.mutex.Lock()
+	defer knownPeers.mutex.Unlock()
+
+	knownPeers.peers[strings.ToLower(fingerprint)] = address
+	return knownPeers.save()
+}
+
+//StaticKey returns Noise static key of known peer. nil if it's not known
+func (knownPeers *KnownPeers) StaticKey(fingerprint string) []byte {
+	if knownPeers == nil {
+		return nil
+	}
+	knownPeers.mutex.Lock()
+	defer knownPeers.mutex.Unlock()
+	return knownPeers.staticKeys[strings.ToLower(fingerprint)]
+}
+
+//SetStaticKey remembers Noise static key of known peer and saves whole list to file
+func (knownPeers *KnownPeers) SetStaticKey(fingerprint string, key []byte) error {
+	if knownPeers == nil {
+		return nil
+	}
+	knownPeers.mutex.Lock()
+	defer knownPeers.mutex.Unlock()
+
+	fingerprint = strings.ToLower(fingerprint)
+	if _, ok := knownPeers.peers[fingerprint]; !ok {
+		return fmt.Errorf("KnownPeers.SetStaticKey: Peer %s is not known", fingerprint)
+	}
+	knownPeers.staticKeys[fingerprint] = key
+	return knownPeers.save()
+}
+
+//save writes whole list to file. Mutex must be locked
+func (knownPeers *KnownPeers) save() error {
+	file, err := os.Create(knownPeers.file)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	for peer, peerAddress := range knownPeers.peers {
+		if key, ok := knownPeers.staticKeys[peer]; ok {
+			peerAddress += " " + noiseKeyField + hex.EncodeToString(key)
+		}
+		if _, err = fmt.Fprintf(file, "%s %s\n", peer, peerAddress); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestKnownPeersSaveAndLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sstt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	knownPeers, err := KnownPeersLoad(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	staticKey := bytes.Repeat([]byte{7}, noiseKeyLen)
+	knownPeers.Add("ABCD", "192.0.2.1:27002")
+	knownPeers.Add("1234", "unix:///run/sstt.sock")
+	if err = knownPeers.SetStaticKey("abcd", staticKey); err != nil {
+		t.Fatal(err)
+	}
+	if err = knownPeers.SetStaticKey("ffff", staticKey); err == nil {
+		t.Error("Static key of unknown peer should not be remembered")
+	}
+
+	reloaded, err := KnownPeersLoad(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reloaded.IsKnown("abcd") || !reloaded.IsKnown("1234") || reloaded.peers["1234"] != "unix:///run/sstt.sock" {
+		t.Errorf("Expected both peers after reload, got %v", reloaded.peers)
+	}
+	if !bytes.Equal(reloaded.StaticKey("ABCD"), staticKey) {
+		t.Error("Static key should be reloaded")
+	}
+
+	//Peer whose key changed is other peer, even on the same address
+	if reloaded.IsKnown("abce") {
+		t.Error("Changed key of known address should not be known")
+	}
+	policy, _ := AcceptPolicyInit("known", "", reloaded)
+	if policy.Accept("abce", "192.0.2.1:27002") {
+		t.Error("Changed key of known address should not be accepted")
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+//Limits of resources which peers can make us spend. Set from command line
+var (
+	//Largest encrypted text message accepted
+	maxMessageSize = 64 * 1024
+	//Largest public key accepted in HELLO
+	maxPublicKeySize = 16 * 1024
+	//Largest file accepted, 0 means no limit
+	maxFileSize int64 = 16 << 30
+	//Most incoming connections served at once, including established sessions
+	maxIncomingConnections = 64
+	//Accepted connection must send preface and finish TLS handshake in this time
+	prefaceTimeout = 10 * time.Second
+	//Peer must send next frame in this time. It's longer than handshake timeouts and heartbeat interval
+	readTimeout = 2 * time.Minute
+	//Frame must be written in this time. Peer which stops reading can't block our writers for longer
+	writeTimeout = time.Minute
+)
+
+//Time given to ERROR frame sent before session is closed
+const errorWriteTimeout = 2 * time.Second
+
+//Room for version lists, key exchange data and framing next to public key and signature in handshake frames
+const handshakeFrameOverhead = 4096
+
+//checkLimits validates limits given on command line
+func checkLimits() error {
+	if maxMessageSize <= 0 || maxPublicKeySize <= 0 || maxFileSize < 0 || maxIncomingConnections <= 0 || maxRelayWaiting <= 0 {
+		return errors.New("Message, public key and file size limits, incoming connections and relay waiting peers limits must be positive")
+	}
+	if prefaceTimeout <= 0 || writeTimeout <= 0 || readTimeout <= heartbeatInterval {
+		return errors.New("Accept and write timeouts must be positive and read timeout longer than heartbeat interval")
+	}
+	if connectionRate <= 0 || connectionBurst <= 0 || maxPendingPrompts <= 0 || banAfterFailures <= 0 || banDuration < 0 {
+		return errors.New("Connection rate and burst, pending prompts and failures before ban must be positive")
+	}
+	return nil
+}
+
+//frameLimit returns largest payload of frame of given type accepted from peer.
+//Until session is authenticated only handshake frames are expected, so they can't be larger than public key with its signature
+func (session *Session) frameLimit(ptype packettype) uint32 {
+	limit := maxFrameSize
+	if session.auth == nil {
+		limit = 2*maxPublicKeySize + handshakeFrameOverhead
+	} else if ptype == TEXTMESSAGE {
+		//Block modes make the longest messages
+		limit = int(EncryptedSize(int64(maxMessageSize), CBC)) + frameAuthOverhead
+	}
+
+	if limit > maxFrameSize {
+		limit = maxFrameSize
+	}
+	return uint32(limit)
+}
+
+//checkTextMessageSize refuses encrypted text message longer than maxMessageSize before it's decrypted.
+//Block modes send message length in front of padded message, stream modes encrypt it as is
+func checkTextMessageSize(message []byte, mode cipherblockmode) error {
+	size := uint64(len(message))
+	if mode == ECB || mode == CBC {
+		if len(message) < 8 {
+			return sessionErrorf(ERRORPROTOCOL, "Text message too short")
+		}
+		size = endianness.Uint64(message)
+	}
+
+	if size > uint64(maxMessageSize) {
+		return sessionErrorf(ERRORLIMIT, "Text message of %d bytes exceeds limit of %d bytes", size, maxMessageSize)
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//hasErrorCode tells if err is SessionError with given code
+func hasErrorCode(err error, code errorcode) bool {
+	sessionError, ok := err.(*SessionError)
+	return ok && sessionError.code == code
+}
+
+func TestFrameLimits(t *testing.T) {
+	initiator, responder := authenticatedSessionPair()
+	defer initiator.Close()
+	defer responder.Close()
+	var handshaking Session
+
+	cases := []struct {
+		session *Session
+		ptype   packettype
+		length  uint32
+		refused bool
+	}{
+		{&handshaking, HELLO, uint32(2*maxPublicKeySize + handshakeFrameOverhead), false},
+		{&handshaking, HELLO, uint32(2*maxPublicKeySize + handshakeFrameOverhead + 1), true},
+		{&handshaking, FILEDATA, bufsize, true},
+		{responder, FILEDATA, maxFrameSize, false},
+		{responder, TEXTMESSAGE, 8 + cipherBufferSize + frameAuthOverhead, false},
+		{responder, TEXTMESSAGE, 8 + 2*cipherBufferSize + frameAuthOverhead, true},
+	}
+	for _, c := range cases {
+		//Only header is sent, so frame is refused before payload is read
+		buf := new(bytes.Buffer)
+		binary.Write(buf, endianness, []byte{1, byte(c.ptype), 0})
+		binary.Write(buf, endianness, c.length)
+
+		_, err := readFrame(buf, c.session.frameLimit)
+		if hasErrorCode(err, ERRORLIMIT) != c.refused {
+			t.Errorf("Frame type %d of %d bytes: expected refused %v, got %v", c.ptype, c.length, c.refused, err)
+		}
+	}
+}
+
+func TestTextMessageLimit(t *testing.T) {
+	defer func(size int) { maxMessageSize = size }(maxMessageSize)
+	maxMessageSize = 10
+
+	key, iv := make([]byte, 32), make([]byte, 16)
+	var nullGuiApp GUIApp
+	for _, mode := range []cipherblockmode{ECB, CBC, CFB, OFB} {
+		for message, refused := range map[string]bool{"short": false, "longer than ten": true} {
+			encrypted, err := EncryptTextMessage(key, iv, message, mode, &nullGuiApp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = checkTextMessageSize(encrypted, mode); hasErrorCode(err, ERRORLIMIT) != refused {
+				t.Errorf("%s %q: expected refused %v, got %v", mode, message, refused, err)
+			}
+		}
+	}
+}
+
+func TestPublicKeyAndFileLimits(t *testing.T) {
+	encMess := EncryptedMessageHandler(32, CBC)
+	key := make([]byte, maxPublicKeySize+1)
+	buf := new(bytes.Buffer)
+	binary.Write(buf, endianness, int32(len(key)))
+	buf.Write(key)
+	if err := encMess.HandleReceivedPublicKey(buf.Bytes()); err == nil || encMess.publicKeyClient != nil {
+		t.Error("Public key exceeding limit should be refused")
+	}
+
+	netClient := testNetClient(t)
+	defer os.RemoveAll(netClient.receiveDir)
+	initiator, responder := authenticatedSessionPair()
+	defer initiator.Close()
+	defer responder.Close()
+
+	var nullGuiApp GUIApp
+	header := make([]byte, 8)
+	endianness.PutUint64(header, uint64(maxFileSize+1))
+	if err := netClient.ReceiveFile(responder, header, &nullGuiApp); !hasErrorCode(err, ERRORLIMIT) || responder.incomingFile != nil {
+		t.Errorf("File exceeding limit should be refused, got %v", err)
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { readTimeout = timeout }(readTimeout)
+	readTimeout = 50 * time.Millisecond
+
+	initiator, responder := authenticatedSessionPair()
+	defer initiator.Close()
+	defer responder.Close()
+
+	if _, err := responder.readFrame(); !hasErrorCode(err, ERRORTIMEOUT) {
+		t.Errorf("Silent peer should time out, got %v", err)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	//Responder never reads what initiator sends
+	initiator, responder := authenticatedSessionPair()
+	defer responder.Close()
+
+	defaultTimeout := writeTimeout
+	writeTimeout = 50 * time.Millisecond
+	err := initiator.writePacket(PING, make([]byte, 8))
+	writeTimeout = defaultTimeout
+	if !hasErrorCode(err, ERRORTIMEOUT) || !initiator.Closed() {
+		t.Errorf("Write to peer which doesn't read should time out and close session, got %v", err)
+	}
+
+	//Writer stuck before timeout doesn't keep session open when it's closed with error
+	initiator, responder = authenticatedSessionPair()
+	defer responder.Close()
+	stuck := make(chan error, 1)
+	go func() {
+		stuck <- initiator.writePacket(PING, make([]byte, 8))
+	}()
+
+	closed := make(chan struct{})
+	go func() {
+		initiator.closeWithError(sessionErrorf(ERRORTIMEOUT, "Test"))
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(errorWriteTimeout + 5*time.Second):
+		t.Fatal("Session with stuck writer should be closed")
+	}
+	if !initiator.Closed() || <-stuck == nil {
+		t.Error("Session should be closed and stuck write should fail")
+	}
+}
+
+func TestIncomingConnectionsLimit(t *testing.T) {
+	defer func(limit int) { maxIncomingConnections = limit }(maxIncomingConnections)
+	maxIncomingConnections = 1
+
+	var nullGuiApp GUIApp
+	netClient := testNetClient(t)
+	defer os.RemoveAll(netClient.receiveDir)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go netClient.serveListener(listener, &nullGuiApp)
+
+	//First connection waits for preface, second one is over limit
+	first, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(func() bool { return atomic.LoadInt32(&netClient.incoming) == 1 }) {
+		t.Fatal("First connection should be served")
+	}
+
+	second, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = second.Read(make([]byte, 1)); err == nil {
+		t.Error("Connection over limit should be closed")
+	} else if netError, ok := err.(net.Error); ok && netError.Timeout() {
+		t.Error("Connection over limit should be closed right after accept")
+	}
+
+	first.Close()
+	if !waitFor(func() bool { return atomic.LoadInt32(&netClient.incoming) == 0 }) {
+		t.Error("Closed connection should not count to limit")
+	}
+}
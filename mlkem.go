@@ -0,0 +1,34 @@
+//go:build go1.24
+// +build go1.24
+
+package main
+
+import "crypto/mlkem"
+
+//ML-KEM is in standard library since Go 1.24, so hybrid key exchange is advertised
+const hybridKEMFeature = FEATUREHYBRIDKEM
+
+//Lengths of ML-KEM-768 encapsulation key and ciphertext
+const (
+	mlkemEncapsulationKeyLen = mlkem.EncapsulationKeySize768
+	mlkemCiphertextLen       = mlkem.CiphertextSize768
+)
+
+//mlkemKeyPair generates ML-KEM-768 keypair. Returns encapsulation key sent to peer and function decapsulating its ciphertext
+func mlkemKeyPair() ([]byte, func(ciphertext []byte) ([]byte, error), error) {
+	decapsulationKey, err := mlkem.GenerateKey768()
+	if err != nil {
+		return nil, nil, err
+	}
+	return decapsulationKey.EncapsulationKey().Bytes(), decapsulationKey.Decapsulate, nil
+}
+
+//mlkemEncapsulate returns shared key and ciphertext peer decapsulates it from
+func mlkemEncapsulate(encapsulationKey []byte) (shared []byte, ciphertext []byte, err error) {
+	key, err := mlkem.NewEncapsulationKey768(encapsulationKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	shared, ciphertext = key.Encapsulate()
+	return shared, ciphertext, nil
+}
@@ -0,0 +1,25 @@
+//go:build !go1.24
+// +build !go1.24
+
+package main
+
+import "errors"
+
+//ML-KEM is not available before Go 1.24, so hybrid key exchange is not advertised and peers fall back to classic one
+const hybridKEMFeature featureflags = 0
+
+//Lengths of ML-KEM-768 encapsulation key and ciphertext
+const (
+	mlkemEncapsulationKeyLen = 1184
+	mlkemCiphertextLen       = 1088
+)
+
+var errMLKEMUnsupported = errors.New("mlkem: ML-KEM needs Go 1.24 or newer")
+
+func mlkemKeyPair() ([]byte, func(ciphertext []byte) ([]byte, error), error) {
+	return nil, nil, errMLKEMUnsupported
+}
+
+func mlkemEncapsulate(encapsulationKey []byte) (shared []byte, ciphertext []byte, err error) {
+	return nil, nil, errMLKEMUnsupported
+}
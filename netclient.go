@@ -1,41 +1,58 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
-	"crypto/sha256"
 	"encoding/binary"
-	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"net"
 	"os"
 	"path"
 	"strconv"
-	"strings"
+	"sync/atomic"
 	"time"
 	"unicode/utf8"
 
-	"github.com/gotk3/gotk3/gtk"
-
 	"github.com/gotk3/gotk3/glib"
 )
 
 const magicnumber uint32 = 0x1337ABCD
 const bufsize = 262144
 
+//Port used when address doesn't contain one
+const defaultPort = 27002
+
 var endianness = binary.BigEndian
 
 type packettype byte
 
 //NetClient is structure representing netClient for receiving and sending tcp packets
 type NetClient struct {
-	listenport     int32
-	connected      bool
-	remoteIP       string
+	listenport int32
+	//Bind addresses given by user. All interfaces on listenport if empty
+	listenAddresses []string
+	listeners       []net.Listener
+	//Outbound TCP connections go through it if set
+	proxy *Proxy
+	//Wraps sessions in TLS. Only plain sessions are possible if nil
+	tlsTransport *TLSTransport
+	//Holds our keypair and default settings. Every session gets its own copy
 	messageHandler EncMess
 	receiveDir     string
+	acceptPolicy   AcceptPolicy
+	revocationList *RevocationList
+	//Connections to other clients
+	sessions *SessionManager
+	//Pairing codes generated by us waiting for peers
+	pairings *Pairings
+	//Incoming connections being served, at most maxIncomingConnections. Accessed atomically
+	incoming int32
+	//Limits connection rate per IP address and pending prompts, bans addresses with failing handshakes
+	throttle *Throttle
+	//Files not sent completely, sent again when their peer connects
+	outgoing *OutgoingTransfers
 }
 
 // Structure representing packet types
@@ -49,650 +66,1074 @@ const (
 	TEXTMESSAGE
 	FILE
 	PING
+	//Part of encrypted file announced by FILE packet
+	FILEDATA
+	//Tells peer why session was refused or closed
+	ERROR
+	//Keys of frames sent after this one are derived from current ones
+	KEYUPDATE
+	//Answer to CIPHERMODE request
+	CIPHERMODEACK
+	//Tells peer that session is closed on purpose
+	DISCONNECT
+	//Answer to PING heartbeat
+	PONG
+	//Noise handshake message after which receiver waits for more
+	NOISE
+	//Last Noise handshake message received by peer. Session keys are ready after it
+	NOISEFINAL
+	//Pairing request with SPAKE2 element of code known to both peers
+	PAIR
+	//Answer to PAIR with key confirmation
+	PAIRRESPONSE
+	//Key confirmation of peer which sent PAIR
+	PAIRCONFIRM
+	//Hybrid key exchange request with X25519 and ML-KEM-768 public keys
+	HYBRIDKEM
+	//Answer to HYBRIDKEM with X25519 public key and ML-KEM-768 ciphertext
+	HYBRIDKEMRESPONSE
+	//Resumable file announced with transfer ID
+	FILEOFFER
+	//Answer to FILEOFFER with bytes of file receiver already has
+	FILEOFFSET
+	//Content hash of resumable file sent after its last part
+	FILEDONE
+	//Tells sender of resumable file whether content hash of received file matches
+	FILERESULT
 )
 
-//NetClientInit initializes netClient with listen port number
-func NetClientInit(listenPort int32, encMess EncMess) (netClient NetClient) {
-	netClient.SetClientState(false)
+//NetClientInit initializes netClient with listen port number and policy used for answering incoming HELLO
+func NetClientInit(listenPort int32, encMess EncMess, acceptPolicy AcceptPolicy) (netClient NetClient) {
 	netClient.messageHandler = encMess
+	netClient.acceptPolicy = acceptPolicy
 	netClient.listenport = listenPort
 	netClient.receiveDir = "./files/"
+	netClient.sessions = SessionManagerInit()
+	netClient.pairings = PairingsInit()
+	netClient.throttle = ThrottleInit()
+	netClient.outgoing = &OutgoingTransfers{}
 	return
 }
 
-func (netClient *NetClient) setCipher(cipher cipherblockmode) {
-	netClient.messageHandler.cipherMode = cipher
+//getCipher returns cipher mode of session with given ID or default one if there is no such session
+func (netClient *NetClient) getCipher(sessionID uint32) cipherblockmode {
+	session, err := netClient.sessions.Get(sessionID)
+	if err != nil {
+		return netClient.messageHandler.cipherMode
+	}
+	return session.CipherMode()
 }
 
-func (netClient *NetClient) getCipher() cipherblockmode {
-	return netClient.messageHandler.cipherMode
+//SetListenAddresses sets addresses NetClientListen binds to instead of all interfaces. See parseListenAddress for their format
+func (netClient *NetClient) SetListenAddresses(addresses []string) {
+	netClient.listenAddresses = addresses
 }
 
-//NetClientListen is main function for receiving connection. It's recommended to run it in separate thread
-func (netClient *NetClient) NetClientListen(app *GUIApp) {
-	connection, err := net.Listen("tcp", fmt.Sprintf(":%d", netClient.listenport))
+//NetClientListen opens listeners on all bind addresses and receives connections in separate threads.
+//Without bind addresses it listens on all interfaces (dual-stack, so both IPv4 and IPv6 clients can connect)
+func (netClient *NetClient) NetClientListen(app *GUIApp) error {
+	addresses := netClient.listenAddresses
+	if len(addresses) == 0 {
+		addresses = []string{net.JoinHostPort("", strconv.Itoa(int(netClient.listenport)))}
+	}
+
+	listeners, err := listenAll(addresses, int(netClient.listenport))
 	if err != nil {
-		panic(err)
+		return err
 	}
-	fmt.Printf("Listening on port %d\n", netClient.listenport)
-	defer connection.Close()
-	for {
-		c, err := connection.Accept()
-		if err != nil {
-			fmt.Println(err)
-			c.Close()
-			continue
-		}
+	netClient.listeners = listeners
 
-		var magicbuffer = make([]byte, 4)
-		_, err = c.Read(magicbuffer)
+	for _, listener := range netClient.listeners {
+		go netClient.serveListener(listener, app)
+	}
+
+	return nil
+}
 
+//listenAll opens listeners on all bind addresses. None is left open if any of them fails
+func listenAll(addresses []string, defaultPort int) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, address := range addresses {
+		network, bindAddress, err := parseListenAddress(address, defaultPort)
+		if err == nil {
+			err = listenInit(network, bindAddress, &listeners)
+		}
 		if err != nil {
-			fmt.Println(err)
-			c.Close()
-			continue
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			return nil, err
 		}
+	}
 
-		if endianness.Uint32(magicbuffer) != magicnumber {
-			c.Close()
-			continue
+	for _, listener := range listeners {
+		fmt.Printf("Listening on %s\n", addressName(listener.Addr().Network(), listener.Addr().String()))
+	}
+	return listeners, nil
+}
+
+//listenInit opens listener and appends it to listeners. Stale Unix domain socket is removed and new one is accessible only by owner.
+//Socket on which other running instance listens is left alone
+func listenInit(network string, address string, listeners *[]net.Listener) error {
+	var listener net.Listener
+	var err error
+	if network == "unix" {
+		if stat, err := os.Lstat(address); err == nil && stat.Mode()&os.ModeSocket != 0 {
+			if conn, err := net.DialTimeout("unix", address, time.Second); err == nil {
+				conn.Close()
+				return fmt.Errorf("listenInit: Other instance listens on %s", address)
+			}
+			os.Remove(address)
 		}
+		listener, err = listenUnix(address)
+	} else {
+		listener, err = net.Listen(network, address)
+	}
+	if err != nil {
+		return err
+	}
 
-		if netClient.connected && strings.Split(c.RemoteAddr().String(), ":")[0] != strings.Split(netClient.remoteIP, ":")[0] {
-			c.Close()
-			continue
+	if network == "unix" {
+		if err = os.Chmod(address, 0600); err != nil {
+			listener.Close()
+			return err
 		}
+	}
 
-		go netClient.handleIncomingConnection(c, app)
+	*listeners = append(*listeners, listener)
+	return nil
+}
 
+//ListenAddrs returns addresses of open listeners. Ephemeral ports are replaced by ones chosen by system
+func (netClient *NetClient) ListenAddrs() []net.Addr {
+	addrs := make([]net.Addr, 0, len(netClient.listeners))
+	for _, listener := range netClient.listeners {
+		addrs = append(addrs, listener.Addr())
 	}
+	return addrs
 }
 
-func (netClient *NetClient) handleIncomingConnection(c net.Conn, app *GUIApp) {
-
-	reader := bufio.NewReader(c)
-	netData, err := reader.ReadByte()
-
-	if err != nil {
-		fmt.Println(err)
-		return
+//StopListening closes all listeners. Established sessions are not closed
+func (netClient *NetClient) StopListening() {
+	for _, listener := range netClient.listeners {
+		listener.Close()
 	}
+	netClient.listeners = nil
+}
 
-	buffer := make([]byte, bufsize)
-
-	switch netData {
-	case HELLO:
-		if !netClient.connected {
-			var port int32
-			if err := binary.Read(reader, endianness, &port); err != nil {
+//serveListener accepts connections until listener is closed
+func (netClient *NetClient) serveListener(listener net.Listener, app *GUIApp) {
+	defer listener.Close()
+	for {
+		c, err := listener.Accept()
+		if err != nil {
+			if netError, ok := err.(net.Error); ok && netError.Temporary() {
 				fmt.Println(err)
-				c.Close()
-				return
+				continue
 			}
+			return
+		}
 
-			netClient.remoteIP = fmt.Sprintf("%s:%d", strings.Split(c.RemoteAddr().String(), ":")[0], port)
-
-			_, err = reader.Read(buffer)
+		//Connection over limits is closed before anything is read from it
+		if err = netClient.throttle.Allow(addressIP(c.RemoteAddr()), time.Now()); err != nil {
+			fmt.Println(err)
+			c.Close()
+			continue
+		}
+		if atomic.AddInt32(&netClient.incoming, 1) > int32(maxIncomingConnections) {
+			atomic.AddInt32(&netClient.incoming, -1)
+			fmt.Printf("Refused connection from %s: %d incoming connections already served\n", c.RemoteAddr(), maxIncomingConnections)
+			c.Close()
+			continue
+		}
 
+		go func() {
+			defer atomic.AddInt32(&netClient.incoming, -1)
+			conn, err := netClient.tlsTransport.Server(c)
 			if err != nil {
 				fmt.Println(err)
+				netClient.throttle.Failure(addressIP(c.RemoteAddr()), time.Now())
 				c.Close()
 				return
 			}
 
-			err = netClient.messageHandler.HandleReceivedPublicKey(buffer)
+			session, err := acceptSession(conn)
 			if err != nil {
 				fmt.Println(err)
+				netClient.throttle.Failure(addressIP(c.RemoteAddr()), time.Now())
 				c.Close()
+				return
 			}
 
-			closeConnection(c)
+			netClient.startSession(session, false, app)
+			netClient.serveSession(session, app)
+		}()
+	}
+}
 
-			hash := sha256.Sum256(netClient.messageHandler.publicKeyClient)
+//startSession gives session its own copy of message handler, adds it to session manager and starts its handshake
+func (netClient *NetClient) startSession(session *Session, initiator bool, app *GUIApp) {
+	session.messageHandler = netClient.messageHandler.sessionCopy()
+	session.initiator = initiator
+	session.handshake = HandshakeInit(initiator, func(state sessionstate) {
+		app.ShowStatus(fmt.Sprintf("Handshake with %s timed out in %s state", session, state))
+		session.closeWithError(sessionErrorf(ERRORTIMEOUT, "Handshake timed out in %s state", state))
+	})
+	netClient.sessions.Add(session)
+	app.RefreshSessions()
+}
 
-			fmt.Printf("Received hello from: IP: %s PubKey Hash: %s\n", netClient.remoteIP, hex.EncodeToString(hash[:]))
-			var response gtk.ResponseType
-			glib.IdleAdd(func() {
-				messagedialog := gtk.MessageDialogNew(
-					app.mainWindow,
-					gtk.DIALOG_MODAL,
-					gtk.MESSAGE_INFO,
-					gtk.BUTTONS_YES_NO,
-					fmt.Sprintf("Do you want to accept client with public key SHA-256 hash: %s ?\n", hex.EncodeToString(hash[:])))
-
-				response = messagedialog.Run()
-				messagedialog.Destroy()
-			})
+//IsConnected returns true if session with given ID is established
+func (netClient *NetClient) IsConnected(sessionID uint32) bool {
+	session, err := netClient.sessions.Get(sessionID)
+	return err == nil && session.handshake.State() == STATEESTABLISHED
+}
 
-			for response != gtk.RESPONSE_YES && response != gtk.RESPONSE_NO {
-			}
+//ActiveSession returns ID of session used when user doesn't choose other one. 0 if there are no sessions
+func (netClient *NetClient) ActiveSession() uint32 {
+	return netClient.sessions.Active()
+}
 
-			if response == gtk.RESPONSE_YES {
+//SetActiveSession chooses session used when user doesn't choose other one
+func (netClient *NetClient) SetActiveSession(sessionID uint32, app *GUIApp) error {
+	if err := netClient.sessions.SetActive(sessionID); err != nil {
+		return err
+	}
+	app.RefreshSessions()
+	return nil
+}
 
-				if err := netClient.SendHelloResponse(); err != nil {
-					fmt.Println(err)
-					//c.Close()
-					return
-				}
+//Sessions returns all sessions ordered by ID
+func (netClient *NetClient) Sessions() []*Session {
+	return netClient.sessions.List()
+}
 
-				//	app.SetConnected(true)
-				//app.ChangeAddress(netClient.remoteIP)
+//establishedSession returns session with given ID if it's established
+func (netClient *NetClient) establishedSession(sessionID uint32) (*Session, error) {
+	session, err := netClient.sessions.Get(sessionID)
+	if err != nil {
+		return nil, err
+	}
 
-			}
+	if state := session.handshake.State(); state != STATEESTABLISHED {
+		return nil, fmt.Errorf("NetClient: Session %s is in %s state", session, state)
+	}
 
-			///	if response == gtk.RESPONSE_NO {
-			//c.Close()
-			//	}
+	return session, nil
+}
 
-			//TODO GUI: Ask if user accepts connection. If yes set status to: exchanging session keys
+//serveSession reads packets until connection is closed
+func (netClient *NetClient) serveSession(session *Session, app *GUIApp) {
+	defer func() {
+		netClient.endSession(session, app)
+
+		//Only read loop touches incoming file and receive keys, so they are cleaned up after it ends
+		if incomingFile := session.incomingFile; incomingFile != nil {
+			session.incomingFile = nil
+			incomingFile.abort()
+			if incomingFile.offer != nil {
+				app.ShowStatus(fmt.Sprintf("Receiving file %s from %s interrupted at %d of %d bytes, it continues when peer sends it again",
+					incomingFile.name, session, incomingFile.received, incomingFile.size))
+			} else {
+				app.ShowStatus(fmt.Sprintf("Receiving file %s from %s cancelled", incomingFile.name, session))
+			}
 		}
-	case HELLORESPONSE:
-		if !netClient.connected {
-			var port int32
-			if err := binary.Read(reader, endianness, &port); err != nil {
+		session.wipeKeys()
+	}()
+
+	for {
+		frame, err := session.readFrame()
+		if replayError, ok := err.(*ReplayError); ok {
+			app.ShowStatus(fmt.Sprintf("Dropped frame from %s: %v", session, replayError))
+			continue
+		}
+		if _, ok := err.(*SessionError); err != nil && !ok {
+			//Closed state means we closed connection ourselves
+			if err != io.EOF && session.handshake.State() != STATECLOSED {
 				fmt.Println(err)
-				c.Close()
-				return
 			}
+			return
+		}
 
-			netClient.remoteIP = fmt.Sprintf("%s:%d", strings.Split(c.RemoteAddr().String(), ":")[0], port)
+		if err == nil {
+			err = netClient.handleFrame(session, frame, app)
+		}
 
-			reader.Read(buffer)
-			if err != nil {
-				fmt.Println(err)
-				c.Close()
-				return
-			}
+		if disconnect, ok := err.(*Disconnect); ok {
+			session.setCloseReason("by peer, " + disconnect.Error())
+			return
+		}
 
-			err = netClient.messageHandler.HandleReceivedPublicKey(buffer)
-			if err != nil {
-				fmt.Println(err)
-				c.Close()
-				return
+		if err != nil {
+			sessionError, ok := err.(*SessionError)
+			if !ok {
+				sessionError = sessionErrorf(ERRORINTERNAL, "%v", err)
+			}
+			if sessionError.fromPeer {
+				app.ShowStatus(fmt.Sprintf("Session %s closed by peer: %v", session, sessionError))
+			} else {
+				fmt.Println(sessionError)
+				if session.handshake.State() != STATEESTABLISHED {
+					netClient.handshakeFailed(session)
+				}
+				session.closeWithError(sessionError)
 			}
+			return
+		}
+	}
+}
 
-			fmt.Println("Received hello response")
+//endSession closes session and notifies user if connection was established
+func (netClient *NetClient) endSession(session *Session, app *GUIApp) {
+	session.handshake.Fire(EVENTCLOSE)
+	session.Close()
 
-			closeConnection(c)
+	if !netClient.sessions.Remove(session) {
+		return
+	}
 
-			err = netClient.SendConnectionProperties()
+	if session.handshake.WasEstablished() {
+		if reason := session.CloseReason(); reason != "" {
+			app.ShowStatus(fmt.Sprintf("Disconnected %s: %s", session, reason))
+		} else {
+			app.ShowStatus(fmt.Sprintf("Disconnected %s", session))
+		}
+	}
+	app.RefreshSessions()
+}
 
-			if err != nil {
-				fmt.Println(err)
-				return
-			}
+//handleFrame checks if frame is allowed in current session state and handles it
+func (netClient *NetClient) handleFrame(session *Session, frame Frame, app *GUIApp) error {
+	event, isHandshake := eventForFrame(frame.ptype)
+	if !isHandshake {
+		if state := session.handshake.State(); state != STATEESTABLISHED {
+			return sessionErrorf(ERRORPROTOCOL, "Frame type %d not allowed in %s state", frame.ptype, state)
+		}
+		return netClient.handleSessionFrame(session, frame, app)
+	}
 
-			//TODO GUI: Change status to: exchanging session key
+	if err := session.handshake.Check(event); err != nil {
+		return sessionErrorf(ERRORPROTOCOL, "%v", err)
+	}
+
+	if frame.ptype == ERROR {
+		session.handshake.Fire(EVENTERROR)
+		return decodeError(frame.payload)
+	}
+
+	if frame.ptype == DISCONNECT {
+		disconnect, err := decodeDisconnect(frame.payload)
+		if err != nil {
+			return err
 		}
-	case CONNECTIONPROPERTIES:
-		if !netClient.connected {
-			reader.Read(buffer)
-			err = netClient.messageHandler.HandleConnectionProperties(buffer, app)
-			if err != nil {
-				fmt.Println(err)
-				c.Close()
-				return
-			}
+		session.handshake.Fire(EVENTCLOSE)
+		return disconnect
+	}
 
-			closeConnection(c)
+	if err := netClient.handleHandshakeFrame(session, frame, app); err != nil {
+		return err
+	}
 
-			err = netClient.SendConnectionPropertiesResponse()
+	//State changes after frame is handled so established session always has session key ready
+	state, err := session.handshake.Fire(event)
+	if err != nil {
+		return sessionErrorf(ERRORPROTOCOL, "%v", err)
+	}
 
-			if err != nil {
-				fmt.Println(err)
-				//c.Close()
-				return
-			}
+	switch state {
+	case STATEAWAITINGACCEPT:
+		//Asking user may take long. Read loop keeps running so peer disconnecting or timeout is noticed
+		go netClient.answerHello(session, app)
+	case STATEESTABLISHED:
+		netClient.setConnected(session, app)
+	}
+
+	return nil
+}
 
-			app.ChangeAddress(netClient.remoteIP)
-			app.SetConnected(true)
+//handleHandshakeFrame handles HELLO, HELLORESPONSE, CONNECTIONPROPERTIES, CONNECTIONPROPERTIESRESPONSE, Noise, pairing and hybrid key exchange frames
+func (netClient *NetClient) handleHandshakeFrame(session *Session, frame Frame, app *GUIApp) error {
+	var err error
+	payload := frame.payload
 
-			fmt.Println("Received connection properties")
+	switch frame.ptype {
+	case HELLO:
+		hello, err := decodeHello(payload)
+		if err != nil {
+			return sessionErrorf(ERRORPROTOCOL, "%v", err)
 		}
 
-	case CONNECTIONPROPERTIESRESPONSE:
-		if !netClient.connected {
-			reader.Read(buffer)
-			err = netClient.messageHandler.HandleConnectionPropertiesResponse(buffer, app)
-			if err != nil {
-				fmt.Println(err)
-				c.Close()
-				return
-			}
+		version, err := chooseVersion(hello.versions)
+		if err != nil {
+			return sessionErrorf(ERRORVERSION, "%v", err)
+		}
+
+		err = session.messageHandler.HandleReceivedPublicKey(hello.key)
+		if err != nil {
+			return sessionErrorf(ERRORPROTOCOL, "%v", err)
+		}
 
-			app.SetConnected(true)
+		peerFingerprint := fingerprint(session.messageHandler.publicKeyClient)
 
-			fmt.Println("Received connection properties response")
+		fmt.Printf("Received hello from: %s PubKey Hash: %s\n", session, peerFingerprint)
+
+		if netClient.refuseRevoked(session, peerFingerprint, app) {
+			return sessionErrorf(ERRORREVOKED, "Public key %s is revoked", peerFingerprint)
 		}
 
-	case CIPHERMODE:
-		if netClient.connected {
-			reader.Read(buffer)
-			err = netClient.messageHandler.HandleCipherMode(buffer, app)
-			if err != nil {
-				fmt.Println(err)
-				c.Close()
-				return
-			}
+		if err := checkCertificatePin(session, peerFingerprint); err != nil {
+			return err
 		}
 
-	case TEXTMESSAGE:
-		if netClient.connected {
-			//	reader.Read(buffer)
-			err = netClient.messageHandler.HandleTextMessage(reader, app)
-			if err != nil {
-				fmt.Println(err)
-				c.Close()
-				return
-			}
+		session.version = version
+		session.features = hello.features & supportedFeatures
+		session.peerFingerprint = peerFingerprint
+		session.helloTranscript = append([]byte{}, payload...)
+
+	case HELLORESPONSE:
+		hello, err := decodeHello(payload)
+		if err != nil {
+			return sessionErrorf(ERRORPROTOCOL, "%v", err)
 		}
-	case FILE:
-		if netClient.connected {
-			err = netClient.ReceiveFile(reader, app)
-			if err != nil {
-				fmt.Println(err)
-				c.Close()
-				return
-			}
+
+		if len(hello.versions) != 1 || !bytes.Contains(supportedVersions, hello.versions) {
+			return sessionErrorf(ERRORVERSION, "Peer chose unsupported protocol version %v", hello.versions)
 		}
-	case PING:
-		if netClient.connected {
-			c.Write([]byte("OK"))
-		} else {
-			c.Write([]byte("NK"))
+
+		err = session.messageHandler.HandleReceivedPublicKey(hello.key)
+		if err != nil {
+			return sessionErrorf(ERRORPROTOCOL, "%v", err)
 		}
-		c.Close()
-		return
-	}
 
-	closeConnection(c)
+		session.version = hello.versions[0]
+		session.features = hello.features & supportedFeatures
+		session.helloTranscript = append(session.helloTranscript, payload...)
 
-}
+		fmt.Printf("Received hello response. Protocol version %d\n", session.version)
 
-func (netClient *NetClient) send(message []byte, ptype packettype, servAddr string) (response []byte, err error) {
-	tcpAddr, err := net.ResolveTCPAddr("tcp", servAddr)
+		peerFingerprint := fingerprint(session.messageHandler.publicKeyClient)
+		session.peerFingerprint = peerFingerprint
 
-	if err != nil {
-		return nil, err
-	}
+		if netClient.refuseRevoked(session, peerFingerprint, app) {
+			return sessionErrorf(ERRORREVOKED, "Public key %s is revoked", peerFingerprint)
+		}
 
-	conn, err := net.DialTCP("tcp", nil, tcpAddr)
-	if err != nil {
-		return nil, err
-	}
+		if err := checkCertificatePin(session, peerFingerprint); err != nil {
+			return err
+		}
 
-	buf := new(bytes.Buffer)
+		if err := netClient.acceptPolicy.knownPeers.Add(peerFingerprint, session.remoteAddr); err != nil {
+			fmt.Println(err)
+		}
 
-	binary.Write(buf, endianness, magicnumber)
-	binary.Write(buf, endianness, ptype)
-	if message != nil {
-		binary.Write(buf, endianness, message)
-	}
+		if err := netClient.sendHybridKEM(session); err != nil {
+			return err
+		}
+		if session.version == noiseVersion {
+			return netClient.startNoise(session)
+		}
+		return netClient.SendConnectionProperties(session)
 
-	_, err = conn.Write(buf.Bytes())
-	if err != nil {
-		return nil, err
-	}
+	case HYBRIDKEM:
+		return netClient.handleHybridKEM(session, payload)
+
+	case HYBRIDKEMRESPONSE:
+		return netClient.handleHybridKEMResponse(session, payload)
+
+	case NOISE, NOISEFINAL:
+		return netClient.handleNoise(session, frame, app)
+
+	case PAIR:
+		return netClient.handlePair(session, payload, app)
+
+	case PAIRRESPONSE:
+		return netClient.handlePairResponse(session, payload, app)
+
+	case PAIRCONFIRM:
+		return netClient.handlePairConfirm(session, payload, app)
+
+	case CONNECTIONPROPERTIES:
+		if session.version == noiseVersion {
+			return sessionErrorf(ERRORPROTOCOL, "Connection properties in session using Noise handshake")
+		}
+		err = session.messageHandler.HandleConnectionProperties(payload, app)
+		if policyError, ok := err.(*PolicyError); ok {
+			app.ShowStatus(fmt.Sprintf("Refused %s: %v", session, policyError))
+			return sessionErrorf(ERRORPOLICY, "%v", policyError)
+		}
+		if err != nil {
+			return sessionErrorf(ERRORPROTOCOL, "%v", err)
+		}
 
-	bufferbyte := make([]byte, 2)
-	conn.Read(bufferbyte)
+		fmt.Println("Received connection properties")
 
-	if string(bufferbyte) != "OK" {
-		return nil, errors.New("NetClient.send: Connection error")
+		if err = netClient.SendConnectionPropertiesResponse(session); err != nil {
+			return err
+		}
+
+		if err = bindHelloTranscript(session); err != nil {
+			return err
+		}
+		if err = mixHybridSecret(session); err != nil {
+			return err
+		}
+		session.enableAuthentication()
+
+	case CONNECTIONPROPERTIESRESPONSE:
+		if session.version == noiseVersion {
+			return sessionErrorf(ERRORPROTOCOL, "Connection properties in session using Noise handshake")
+		}
+		err = session.messageHandler.HandleConnectionPropertiesResponse(payload, app)
+		if err != nil {
+			return sessionErrorf(ERRORPROTOCOL, "%v", err)
+		}
+
+		fmt.Println("Received connection properties response")
+
+		if err = bindHelloTranscript(session); err != nil {
+			return err
+		}
+		if err = mixHybridSecret(session); err != nil {
+			return err
+		}
+		session.enableAuthentication()
 	}
 
-	conn.Close()
+	return nil
+}
+
+//handleSessionFrame handles frames allowed in established session
+func (netClient *NetClient) handleSessionFrame(session *Session, frame Frame, app *GUIApp) error {
+	payload := frame.payload
+
+	switch frame.ptype {
+	case CIPHERMODE:
+		ack, err := session.handleCipherModeRequest(frame)
+		if err != nil {
+			return err
+		}
+		if ack.accepted {
+			app.ShowStatus(fmt.Sprintf("Session %s: peer changed cipher mode to %s", session, ack.mode))
+		} else {
+			app.ShowStatus(fmt.Sprintf("Session %s: refused cipher mode %s requested by peer: %s", session, ack.mode, ack.reason))
+		}
+		app.RefreshSessions()
+
+	case CIPHERMODEACK:
+		return session.handleCipherModeAck(frame)
+
+	case TEXTMESSAGE:
+		if err := checkTextMessageSize(payload, session.auth.recv.cipherMode); err != nil {
+			return err
+		}
+		message, err := session.messageHandler.HandleTextMessage(payload, session.auth.recv, app)
+		if err != nil {
+			return err
+		}
+		app.ShowMessage(session, message)
+
+	case FILE:
+		return netClient.ReceiveFile(session, payload, app)
+
+	case FILEDATA:
+		return netClient.receiveFileData(session, payload, frame.flags&FLAGLAST != 0, app)
+
+	case FILEOFFER:
+		return netClient.receiveFileOffer(session, payload, app)
+
+	case FILEOFFSET:
+		return session.handleFileOffset(payload)
+
+	case FILEDONE:
+		return netClient.receiveFileDone(session, payload, app)
+
+	case FILERESULT:
+		return session.handleFileResult(payload)
+
+	case PING, PONG:
+		return netClient.handleHeartbeat(session, frame, app)
+
+	case KEYUPDATE:
+		return session.updateReceiveKeys(payload)
 
-	return bufferbyte, nil
+	default:
+		return sessionErrorf(ERRORPROTOCOL, "Unknown frame type %d", frame.ptype)
+	}
+
+	return nil
 }
 
-//SendHello sends connection request along with public key
-// Schema of frame
-// |uint32 listenport|keySize int32|key [bits]byte|
-func (netClient *NetClient) SendHello(servAddr string) error {
+//answerHello asks accept policy if peer is accepted and sends HELLORESPONSE or ERROR frame
+func (netClient *NetClient) answerHello(session *Session, app *GUIApp) {
+	if refusal := netClient.decideHello(session); refusal != nil {
+		if _, err := session.handshake.Fire(EVENTREJECT); err == nil {
+			app.ShowStatus(fmt.Sprintf("Rejected %s: %s", session, refusal.message))
+			session.closeWithError(refusal)
+		}
+		return
+	}
 
-	toSend, err := netClient.messageHandler.GenerateHelloMessage(netClient.listenport)
-	if err != nil {
-		return err
+	//Session may be closed or timed out while user was deciding
+	if _, err := session.handshake.Fire(EVENTACCEPT); err != nil {
+		fmt.Println(err)
+		return
 	}
 
-	_, err = netClient.send(toSend, HELLO, servAddr)
+	if err := netClient.SendHelloResponse(session); err != nil {
+		fmt.Println(err)
+		session.Close()
+	}
+}
 
-	if err != nil {
-		return err
+//decideHello asks accept policy about peer. HELLO isn't shown to user when maxPendingPrompts already wait for answer.
+//Peers rejected by policy count as failed handshakes of their address
+func (netClient *NetClient) decideHello(session *Session) *SessionError {
+	if netClient.acceptPolicy.mode == ACCEPTPROMPT {
+		if !netClient.throttle.StartPrompt() {
+			return sessionErrorf(ERRORBUSY, "Too many connection requests wait for user")
+		}
+		defer netClient.throttle.EndPrompt()
 	}
 
+	if !netClient.acceptPolicy.Accept(session.peerFingerprint, session.String()) {
+		netClient.handshakeFailed(session)
+		return sessionErrorf(ERRORREJECTED, "Client rejected")
+	}
 	return nil
+}
 
+//handshakeFailed counts failed handshake of session accepted by us. Sessions through relay aren't counted, their address is relay's
+func (netClient *NetClient) handshakeFailed(session *Session) {
+	if session.initiator || isRelayAddress(session.remoteAddr) {
+		return
+	}
+	netClient.throttle.Failure(addressIP(session.conn.RemoteAddr()), time.Now())
+}
+
+//ThrottleStats returns counters of connections refused by rate limits, bans and pending prompts limit
+func (netClient *NetClient) ThrottleStats() ThrottleStats {
+	return netClient.throttle.Stats()
 }
 
-//SendHelloResponse sends connection request accept and public key
+//SendHello connects to other client and sends connection request along with supported protocol versions and public key.
+//Address can be host, IPv4 or IPv6 literal, with or without port, or Unix domain socket path, e.g. unix:///run/sstt.sock.
+//Relay address (relay://host:port/code) waits until peer joins relay with the same code, see joinRelay
 // Schema of frame
-// |uint32 listenport|keySize int32|key [bits]byte|
-func (netClient *NetClient) SendHelloResponse() error {
+// |versionsCount byte|versions [versionsCount]byte|features uint32|keySize int32|key [bits]byte|
+//Returns ID of new session
+func (netClient *NetClient) SendHello(servAddr string, app *GUIApp) (uint32, error) {
+	if isRelayAddress(servAddr) {
+		return netClient.joinRelay(servAddr, "", app)
+	}
 
-	toSend, err := netClient.messageHandler.GenerateHelloMessage(netClient.listenport)
+	session, err := netClient.dial(servAddr)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	_, err = netClient.send(toSend, HELLORESPONSE, netClient.remoteIP)
+	return netClient.sendHello(session, app)
+}
 
+//dial opens session with client on given address through proxy and TLS transport if they are set
+func (netClient *NetClient) dial(address string) (*Session, error) {
+	network, address, err := parseDialAddress(address, defaultPort)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	return nil
-
+	return dialSession(netClient.proxy, netClient.tlsTransport, network, address)
 }
 
-//SendCipherMode generates and sends client cipher mode change notification frame
-func (netClient *NetClient) SendCipherMode() error {
-	toSend, err := netClient.messageHandler.GenerateCipherMode()
-
+//sendHello starts session opened by us and sends HELLO through it
+func (netClient *NetClient) sendHello(session *Session, app *GUIApp) (uint32, error) {
+	key, err := netClient.messageHandler.GenerateHelloMessage()
 	if err != nil {
-		return err
+		session.Close()
+		return 0, err
 	}
 
-	_, err = netClient.send(toSend, CIPHERMODE, netClient.remoteIP)
+	hello := Hello{versions: supportedVersions, features: supportedFeatures, key: key}
+	toSend := hello.encode()
+	session.helloTranscript = toSend
 
-	if err != nil {
-		return err
+	netClient.startSession(session, true, app)
+
+	session.handshake.Fire(EVENTSENDHELLO)
+
+	if err = session.writePacket(HELLO, toSend); err != nil {
+		netClient.endSession(session, app)
+		return 0, err
 	}
 
-	return nil
+	go netClient.serveSession(session, app)
+
+	return session.id, nil
+
 }
 
-//SendConnectionPropertiesResponse generates and sends client properties response frame
-func (netClient *NetClient) SendConnectionPropertiesResponse() error {
-	toSend, err := netClient.messageHandler.GenerateConnectionPropertiesResponse()
+//SendHelloResponse sends connection request accept with chosen protocol version and public key
+// Schema of frame
+// |versionsCount byte = 1|version byte|features uint32|keySize int32|key [bits]byte|
+func (netClient *NetClient) SendHelloResponse(session *Session) error {
 
+	key, err := session.messageHandler.GenerateHelloMessage()
 	if err != nil {
 		return err
 	}
 
-	_, err = netClient.send(toSend, CONNECTIONPROPERTIESRESPONSE, netClient.remoteIP)
+	hello := Hello{versions: []byte{session.version}, features: supportedFeatures, key: key}
+	toSend := hello.encode()
+	session.helloTranscript = append(session.helloTranscript, toSend...)
 
-	if err != nil {
-		return err
-	}
+	return session.writePacket(HELLORESPONSE, toSend)
 
-	return nil
 }
 
-//SendConnectionProperties generates and sends client properties frame
-func (netClient *NetClient) SendConnectionProperties() error {
-	toSend, err := netClient.messageHandler.GenerateConnectionProperties()
-
+//SendCipherMode asks client in given session to change cipher mode and waits until it accepts or refuses it
+func (netClient *NetClient) SendCipherMode(sessionID uint32, mode cipherblockmode, app *GUIApp) error {
+	session, err := netClient.establishedSession(sessionID)
 	if err != nil {
 		return err
 	}
 
-	_, err = netClient.send(toSend, CONNECTIONPROPERTIES, netClient.remoteIP)
+	err = session.RequestCipherMode(mode)
+	app.RefreshSessions()
+
+	return err
+}
+
+//SendConnectionPropertiesResponse generates and sends client properties response frame
+func (netClient *NetClient) SendConnectionPropertiesResponse(session *Session) error {
+	toSend, err := session.messageHandler.GenerateConnectionPropertiesResponse()
 
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return session.writePacket(CONNECTIONPROPERTIESRESPONSE, toSend)
 }
 
-//SendTextMessage send encrypted text message to other client
-func (netClient *NetClient) SendTextMessage(origText string, app *GUIApp) error {
-	toSend, err := netClient.messageHandler.GenerateTextMessage(origText, app)
+//SendConnectionProperties generates and sends client properties frame
+func (netClient *NetClient) SendConnectionProperties(session *Session) error {
+	toSend, err := session.messageHandler.GenerateConnectionProperties()
 
 	if err != nil {
 		return err
 	}
 
-	_, err = netClient.send(toSend, TEXTMESSAGE, netClient.remoteIP)
+	return session.writePacket(CONNECTIONPROPERTIES, toSend)
+}
 
+//SendTextMessage send encrypted text message to client in given session
+func (netClient *NetClient) SendTextMessage(sessionID uint32, origText string, app *GUIApp) error {
+	session, err := netClient.establishedSession(sessionID)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return session.writeEncrypted(TEXTMESSAGE, func(keys *directionKeys) ([]byte, error) {
+		return session.messageHandler.GenerateTextMessage(origText, keys, app)
+	})
 
 }
 
-//ReceiveFile decrypts received file using AES
-func (netClient *NetClient) ReceiveFile(reader *bufio.Reader, app *GUIApp) error {
-	os.MkdirAll(netClient.receiveDir, os.ModePerm)
+//fileReceive is state of file being received through session
+type fileReceive struct {
+	name      string
+	size      int64
+	received  int64
+	timeStart time.Time
+	//Encrypted data is written to pipe and decrypted to file by separate goroutine as it comes. Its result is sent to decrypted
+	pipe      *io.PipeWriter
+	decrypted chan error
+	//Offer of resumable file and its decrypted part. Parts are decrypted with current keys as they come and kept if transfer is interrupted
+	offer *fileOffer
+	file  *os.File
+	//Content hash of received part. It's passed through hashed when part received before is hashed. complete is set after the last part
+	hash     hash.Hash
+	hashed   chan hash.Hash
+	complete bool
+}
 
-	bufferFileSize := make([]byte, 10)
-	bufferFileNameSize := make([]byte, 10)
+func (incomingFile *fileReceive) abort() {
+	if incomingFile.offer != nil {
+		incomingFile.file.Close()
+		return
+	}
+	incomingFile.pipe.CloseWithError(errors.New("fileReceive.abort: Receiving file cancelled"))
+	<-incomingFile.decrypted
+}
 
-	reader.Read(bufferFileNameSize)
-	fileNameSize, _ := strconv.ParseInt(strings.Trim(string(bufferFileNameSize), ":"), 10, 64)
+//ReceiveFile starts receiving file announced by FILE frame. File content comes in FILEDATA frames, the last one flagged with FLAGLAST
+// Schema of frame
+// |fileSize uint64|fileName (encrypted) [rest]byte|
+func (netClient *NetClient) ReceiveFile(session *Session, header []byte, app *GUIApp) error {
+	os.MkdirAll(netClient.receiveDir, os.ModePerm)
 
-	bufferFileName := make([]byte, fileNameSize)
+	if session.incomingFile != nil {
+		return errors.New("NetClient.ReceiveFile: Other file is being received")
+	}
 
-	reader.Read(bufferFileSize)
-	fileSize, _ := strconv.ParseInt(strings.Trim(string(bufferFileSize), ":"), 10, 64)
+	if len(header) < 8 {
+		return errors.New("NetClient.ReceiveFile: Header too short")
+	}
 
-	io.ReadFull(reader, bufferFileName)
+	fileSize := int64(endianness.Uint64(header[:8]))
+	if fileSize < 0 {
+		return errors.New("NetClient.ReceiveFile: Wrong file size")
+	}
+	if maxFileSize > 0 && fileSize > maxFileSize {
+		return sessionErrorf(ERRORLIMIT, "File of %d bytes exceeds limit of %d bytes", fileSize, maxFileSize)
+	}
 
-	fileName, err := DecryptTextMessage(netClient.messageHandler.aesKey, netClient.messageHandler.iv, bufferFileName, netClient.messageHandler.cipherMode, app)
+	//Peer may update keys while file is being sent, file is decrypted with ones in use when it was announced
+	keys := session.auth.recv.snapshot()
+	fileName, err := DecryptTextMessage(keys.aesKey, keys.iv, header[8:], keys.cipherMode, app)
 
 	if err != nil || !utf8.ValidString(fileName) {
 		fmt.Println(err)
 		fileName = randString(10)
 	}
-
-	//fileName = strings.Trim(string(fileName), ":")
+	fileName = path.Base(fileName)
 
 	if app.messageTextBuffer != nil {
 		glib.IdleAdd(func() {
 			app.ShowDownloadFilePopup(fileName)
 		})
 	}
-	newFile, err := os.Create(fileName + ".encrypted")
+	//File is decrypted next to parts of resumable files and replaces file of the same name only when it's received whole.
+	//Part has fixed name for peer and file name, so part left by crash is overwritten when the file is sent again
+	partPath := netClient.partialFile(session.peerFingerprint, []byte(fileName))
+	os.MkdirAll(path.Dir(partPath), os.ModePerm)
+	partFile, err := os.OpenFile(partPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
+		keys.wipe()
 		return err
 	}
 
-	defer os.Remove(fileName + ".encrypted")
+	session.incomingFile = netClient.startFileDecryption(fileName, fileSize, partFile, keys, app)
 
-	var receivedBytes int64
-	timeStart := time.Now()
-	duration := time.Now().Sub(timeStart)
-	for {
-		if (fileSize - receivedBytes) < bufsize {
-			io.CopyN(newFile, reader, fileSize-receivedBytes)
-			reader.Read(make([]byte, (receivedBytes+bufsize)-fileSize))
-			break
-		}
-		io.CopyN(newFile, reader, bufsize)
-		receivedBytes += bufsize
+	return nil
+}
 
-		//	fmt.Printf("Downloading file: %f\n", float64(receivedBytes)/float64(fileSize)*100)
-		if app.downloadProgressBar != nil {
-			value := float64(receivedBytes) / float64(fileSize)
-			duration = time.Now().Sub(timeStart)
-			glib.IdleAdd(func() {
-				app.UpdateDownloadProgress(value, duration.String())
-			})
-		}
+//startFileDecryption returns file being received whose encrypted data written to its pipe is decrypted to output as it comes.
+//Output is moved to receive directory when whole file is decrypted
+func (netClient *NetClient) startFileDecryption(name string, size int64, output *os.File, keys *directionKeys, app *GUIApp) *fileReceive {
+	reader, writer := io.Pipe()
+	incomingFile := &fileReceive{name: name, size: size, timeStart: time.Now(), pipe: writer, decrypted: make(chan error, 1)}
+	go func() {
+		incomingFile.decrypted <- netClient.decryptReceivedFile(incomingFile, reader, output, keys, app)
+	}()
+	return incomingFile
+}
+
+//receiveFileData writes part of encrypted file. When last part is received file is decrypted in separate thread
+func (netClient *NetClient) receiveFileData(session *Session, data []byte, last bool, app *GUIApp) error {
+	incomingFile := session.incomingFile
+	if incomingFile == nil {
+		return errors.New("NetClient.receiveFileData: No file is being received")
 	}
-	if app.downloadProgressBar != nil {
-		glib.IdleAdd(func() {
-			app.UpdateDownloadProgress(1.0, duration.String())
-		})
+	if incomingFile.offer != nil {
+		return netClient.receiveFileChunk(session, data, last, app)
 	}
-	newFileDecrypted, err := os.Create(path.Join(netClient.receiveDir, fileName))
 
-	if err != nil {
-		return err
+	if incomingFile.received+int64(len(data)) > incomingFile.size {
+		return errors.New("NetClient.receiveFileData: Received more data than announced")
 	}
 
-	defer newFileDecrypted.Close()
-
-	newFile.Close()
-
-	newFile, err = os.Open(fileName + ".encrypted")
-
-	if err != nil {
-		return err
+	if _, err := incomingFile.pipe.Write(data); err != nil {
+		return fmt.Errorf("NetClient.receiveFileData: Decrypting %s failed: %v", incomingFile.name, err)
 	}
+	incomingFile.received += int64(len(data))
 
-	defer newFile.Close()
+	duration := time.Now().Sub(incomingFile.timeStart)
+	if app.downloadProgressBar != nil {
+		value := float64(incomingFile.received) / float64(incomingFile.size)
+		glib.IdleAdd(func() {
+			app.UpdateDownloadProgress(value, duration.String())
+		})
+	}
 
-	fmt.Println("Decrypting file...")
+	if !last {
+		return nil
+	}
 
-	if err := DecryptFile(netClient.messageHandler.aesKey, netClient.messageHandler.iv, newFile,
-		newFileDecrypted, netClient.messageHandler.cipherMode, app); err != nil {
-		return err
+	if incomingFile.received != incomingFile.size {
+		return errors.New("NetClient.receiveFileData: Received less data than announced")
 	}
 
-	fmt.Println("Decrypted successfully")
+	session.incomingFile = nil
+	incomingFile.pipe.Close()
+
+	go func() {
+		if err := <-incomingFile.decrypted; err != nil {
+			fmt.Println(err)
+			return
+		}
+		app.ShowStatus(fmt.Sprintf("Received file %s", incomingFile.name))
+	}()
 
 	return nil
 }
 
-//SendFile sends encrypted file using AES
-func (netClient *NetClient) SendFile(file *os.File, app *GUIApp) error {
-	randFileName := randString(10)
-	var fileEncrypted *os.File
-	var err error
+//decryptReceivedFile decrypts data written to pipe by read loop into file until pipe is closed and moves it to receive directory.
+//Reading from pipe stops on error, so read loop is not blocked. Partly decrypted file is removed then
+func (netClient *NetClient) decryptReceivedFile(incomingFile *fileReceive, reader *io.PipeReader, output *os.File, keys *directionKeys, app *GUIApp) error {
+	defer keys.wipe()
 
-	if fileEncrypted, err = os.Create(randFileName); err != nil {
-		return err
+	err := DecryptFileStream(keys.aesKey, keys.iv, reader, incomingFile.size, output, keys.cipherMode, app)
+	reader.CloseWithError(err)
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
 	}
-
-	defer os.Remove(randFileName)
-
-	if err := EncryptFile(netClient.messageHandler.aesKey, netClient.messageHandler.iv, file,
-		fileEncrypted, netClient.messageHandler.cipherMode, app); err != nil {
-		return err
+	if err == nil {
+		err = os.Rename(output.Name(), path.Join(netClient.receiveDir, incomingFile.name))
 	}
 
-	fileEncrypted.Close()
-
-	tcpAddr, err := net.ResolveTCPAddr("tcp", netClient.remoteIP)
-
 	if err != nil {
-		return err
+		os.Remove(output.Name())
+		return fmt.Errorf("NetClient.decryptReceivedFile: Receiving %s failed: %v", incomingFile.name, err)
 	}
+	return nil
+}
 
-	conn, err := net.DialTCP("tcp", nil, tcpAddr)
+//SendFile sends encrypted file using AES. File content is encrypted as it's read and split into FILEDATA frames so other frames can be sent meanwhile
+func (netClient *NetClient) SendFile(sessionID uint32, file *os.File, app *GUIApp) error {
+	session, err := netClient.establishedSession(sessionID)
 	if err != nil {
 		return err
 	}
 
-	defer conn.Close()
+	if session.features&FEATUREFILES == 0 {
+		return errors.New("NetClient.SendFile: Peer does not accept files")
+	}
+	if session.features&FEATURERESUME != 0 {
+		return netClient.sendResumableFile(session, file, app)
+	}
 
 	stat, err := file.Stat()
 	if err != nil {
 		return err
 	}
 
-	fileEncrypted, err = os.Open(randFileName)
-	if err != nil {
-		return err
-	}
+	//File is encrypted by separate goroutine while encrypted data is sent, so only buffers of it are in memory
+	reader, writer := io.Pipe()
+	defer reader.Close()
+	var encryptedSize int64
 
-	defer fileEncrypted.Close()
+	//File is announced with the same keys it's encrypted with, key update waits until header is sent
+	err = session.writeEncrypted(FILE, func(keys *directionKeys) ([]byte, error) {
+		var nullGuiApp GUIApp
+		fileName, err := EncryptTextMessage(keys.aesKey, keys.iv, stat.Name(), keys.cipherMode, &nullGuiApp)
 
-	stat2, err := fileEncrypted.Stat()
-	if err != nil {
-		return err
-	}
-
-	fileSize := fillString(strconv.FormatInt(stat2.Size(), 10), 10)
-	var nullGuiApp GUIApp
-	fileName, err := EncryptTextMessage(netClient.messageHandler.aesKey, netClient.messageHandler.iv, stat.Name(), netClient.messageHandler.cipherMode, &nullGuiApp)
+		if err != nil {
+			fmt.Println(err)
+			fileName = []byte(randString(68))
+		}
 
-	if err != nil {
-		fmt.Println(err)
-		fileName = []byte(randString(68))
-	}
+		fileKeys := keys.snapshot()
+		go func() {
+			defer fileKeys.wipe()
+			writer.CloseWithError(EncryptFileStream(fileKeys.aesKey, fileKeys.iv, file, stat.Size(), writer, fileKeys.cipherMode, app))
+		}()
 
-	buf := new(bytes.Buffer)
+		encryptedSize = EncryptedSize(stat.Size(), keys.cipherMode)
+		header := new(bytes.Buffer)
+		binary.Write(header, endianness, uint64(encryptedSize))
+		header.Write(fileName)
 
-	binary.Write(buf, endianness, magicnumber)
-	binary.Write(buf, endianness, packettype(FILE))
+		return header.Bytes(), nil
+	})
 
-	conn.Write(buf.Bytes())
-	conn.Write([]byte(fillString(strconv.FormatInt(int64(binary.Size(fileName)), 10), 10)))
-	conn.Write([]byte(fileSize))
-	conn.Write([]byte(fileName))
+	if err != nil {
+		return err
+	}
 
 	sendBuffer := make([]byte, bufsize)
-	sendBytes := 0
+	var sendBytes int64
 	startTime := time.Now()
 	duration := time.Now().Sub(startTime)
 	for {
-		read, err := fileEncrypted.Read(sendBuffer)
-		sendBytes += read
-		if err == io.EOF {
-			break
+		read, err := io.ReadFull(reader, sendBuffer)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		sendBytes += int64(read)
+		if err != nil && sendBytes < encryptedSize {
+			return fmt.Errorf("NetClient.SendFile: Encrypted %s is shorter than announced", file.Name())
+		}
+
+		var flags byte
+		if sendBytes >= encryptedSize {
+			flags = FLAGLAST
+		}
+
+		if err = session.writeFrame(FILEDATA, flags, sendBuffer[:read]); err != nil {
+			if session.Closed() {
+				return fmt.Errorf("NetClient.SendFile: Session %s closed, sending %s cancelled", session, file.Name())
+			}
+			return err
 		}
 
-		//	fmt.Printf("Uploading file: %f\n", float64(sendBytes)/float64(stat2.Size())*100)
 		if app.uploadProgressBar != nil {
 			duration = time.Now().Sub(startTime)
+			value := float64(sendBytes) / float64(encryptedSize)
 			glib.IdleAdd(func() {
-				app.UpdateUploadProgress(float64(sendBytes)/float64(stat2.Size()), duration.String())
+				app.UpdateUploadProgress(value, duration.String())
 			})
 		}
-		conn.Write(sendBuffer)
+
+		if flags == FLAGLAST {
+			break
+		}
 	}
 	if app.uploadProgressBar != nil {
 		glib.IdleAdd(func() {
 			app.UpdateUploadProgress(1.0, duration.String())
 		})
 	}
-	bufferbyte := make([]byte, 2)
-	conn.Read(bufferbyte)
-
-	if string(bufferbyte) != "OK" {
-		return errors.New("Wrong response")
-	}
 
 	return nil
 
 }
 
-//StartPinging sends Ping message every 2 seconds to check if client is still connected
-func (netClient *NetClient) StartPinging(app *GUIApp) {
-	for {
-		time.Sleep(2 * time.Second)
-		connected := netClient.Ping()
-		if !connected {
-			app.SetConnected(false)
-			break
-		}
-
-		if netClient.connected == false {
-			break
-		}
+//setConnected starts heartbeats and updates GUI when session is established
+func (netClient *NetClient) setConnected(session *Session, app *GUIApp) {
+	go netClient.runHeartbeat(session)
+	go netClient.resumeTransfers(session, app)
+	app.ShowStatus(fmt.Sprintf("Connected %s", session))
+	app.RefreshSessions()
+}
 
+//SetCipherPolicy sets algorithms, cipher modes and minimal key size accepted from peers.
+//Default cipher mode is replaced by allowed one if policy doesn't allow it
+func (netClient *NetClient) SetCipherPolicy(cipherPolicy *CipherPolicy) {
+	netClient.messageHandler.cipherPolicy = cipherPolicy
+	if cipherPolicy.CheckMode(netClient.messageHandler.cipherMode) != nil {
+		netClient.messageHandler.cipherMode = cipherPolicy.allowedMode()
 	}
 }
 
-//Ping check if client is available. Return true if yes available
-//TODO GUI notify if client disconnects
-func (netClient *NetClient) Ping() bool {
-	response, err := netClient.send(nil, PING, netClient.remoteIP)
-	if err != nil {
-		return false
-	}
-	if string(response) == "OK" {
-		return true
-	}
-	return false
+//SetProxy sets SOCKS5 or HTTP CONNECT proxy used for connecting to other clients. nil means direct connections
+func (netClient *NetClient) SetProxy(proxy *Proxy) {
+	netClient.proxy = proxy
+}
+
+//SetTLSTransport sets transport wrapping sessions in TLS
+func (netClient *NetClient) SetTLSTransport(transport *TLSTransport) {
+	netClient.tlsTransport = transport
 }
 
-//SetClientState sets if client is connected ot not
-//TODO In gui. Set text and buttons based on this state
-func (netClient *NetClient) SetClientState(connected bool) {
-	netClient.connected = connected
+//SetRevocationList sets list of revoked keys checked during handshake
+func (netClient *NetClient) SetRevocationList(revocationList *RevocationList) {
+	netClient.revocationList = revocationList
 }
 
-func closeConnection(c net.Conn) {
-	if c != nil {
-		c.Write([]byte("OK"))
-		c.Close()
-		c = nil
+//refuseRevoked returns true and notifies user if peer key is revoked
+func (netClient *NetClient) refuseRevoked(session *Session, peerFingerprint string, app *GUIApp) bool {
+	revocation, revoked := netClient.revocationList.IsRevoked(peerFingerprint)
+	if revoked {
+		app.ShowStatus(fmt.Sprintf("Refused %s: public key %s revoked on %s (%s)", session, peerFingerprint,
+			revocation.Date.Format("2006-01-02"), revocation.Reason))
 	}
+	return revoked
 }
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestNormalizeAddress(t *testing.T) {
+	cases := map[string]string{
+		"localhost":        "localhost:27002",
+		"192.168.1.2:1234": "192.168.1.2:1234",
+		"::1":              "[::1]:27002",
+		"[::1]":            "[::1]:27002",
+		"[::1]:1234":       "[::1]:1234",
+		"fe80::1%eth0":     "[fe80::1%eth0]:27002",
+	}
+	for address, expected := range cases {
+		if normalized, err := normalizeAddress(address, defaultPort); err != nil || normalized != expected {
+			t.Errorf("%s: expected %s, got %s %v", address, expected, normalized, err)
+		}
+	}
+
+	for _, address := range []string{"", ":1234", "host:port", "[::1]:70000", "1::2::3"} {
+		if normalized, err := normalizeAddress(address, defaultPort); err == nil {
+			t.Errorf("%q should not be accepted, got %s", address, normalized)
+		}
+	}
+}
+
+//testNetClient returns client with new keypair accepting everyone and receiving files to temporary directory
+func testNetClient(t *testing.T) *NetClient {
+	encMess := EncryptedMessageHandler(32, CBC)
+	var err error
+	if encMess.myPrivateKey, encMess.myPublicKey, err = GenerateKeyPair(2048); err != nil {
+		t.Fatal(err)
+	}
+
+	acceptPolicy, _ := AcceptPolicyInit("prompt", "", nil)
+	acceptPolicy.SetPrompt(func(question string) bool { return true })
+
+	netClient := NetClientInit(0, encMess, acceptPolicy)
+	if netClient.receiveDir, err = ioutil.TempDir("", "sstt"); err != nil {
+		t.Fatal(err)
+	}
+	return &netClient
+}
+
+//waitFor checks condition until it's true or timeout passes
+func waitFor(condition func() bool) bool {
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if condition() {
+			return true
+		}
+	}
+	return false
+}
+
+//testTransfer establishes session with client listening on listener using given address and sends file through it.
+//Clients are set up by configure if it's not nil
+func testTransfer(t *testing.T, listener net.Listener, address string, configure func(initiator *NetClient, responder *NetClient)) {
+	var nullGuiApp GUIApp
+	initiator, responder := testNetClient(t), testNetClient(t)
+	if configure != nil {
+		configure(initiator, responder)
+	}
+	defer os.RemoveAll(initiator.receiveDir)
+	defer os.RemoveAll(responder.receiveDir)
+	go responder.serveListener(listener, &nullGuiApp)
+	defer listener.Close()
+
+	sessionID, err := initiator.SendHello(address, &nullGuiApp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer initiator.Disconnect(sessionID, &nullGuiApp)
+
+	established := func() bool {
+		return initiator.IsConnected(sessionID) && responder.IsConnected(responder.ActiveSession())
+	}
+	if !waitFor(established) {
+		t.Fatalf("Session with %s was not established", address)
+	}
+
+	content := bytes.Repeat([]byte("file sent through session "), 20000)
+	sentFile, err := ioutil.TempFile("", "sstt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(sentFile.Name())
+	sentFile.Write(content)
+	sentFile.Seek(0, 0)
+
+	if err = initiator.SendFile(sessionID, sentFile, &nullGuiApp); err != nil {
+		t.Fatal(err)
+	}
+	sentFile.Close()
+
+	received := path.Join(responder.receiveDir, path.Base(sentFile.Name()))
+	if !waitFor(func() bool {
+		data, err := ioutil.ReadFile(received)
+		return err == nil && bytes.Equal(data, content)
+	}) {
+		t.Error("Received file differs from sent one")
+	}
+}
+
+func TestHandshakeAndFileOverIPv6(t *testing.T) {
+	listener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 loopback not available:", err)
+	}
+	testTransfer(t, listener, listener.Addr().String(), nil)
+}
+
+func TestHandshakeAndFileOverUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sstt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	listener, err := net.Listen("unix", path.Join(dir, "sstt.sock"))
+	if err != nil {
+		t.Skip("Unix domain sockets not available:", err)
+	}
+	testTransfer(t, listener, "unix://"+path.Join(dir, "sstt.sock"), nil)
+}
+
+func TestParseDialAddress(t *testing.T) {
+	cases := map[string][2]string{
+		"unix:///run/sstt.sock": {"unix", "/run/sstt.sock"},
+		"unix:sstt.sock":        {"unix", "sstt.sock"},
+		"./sstt.sock":           {"unix", "./sstt.sock"},
+		"tcp://[::1]":           {"tcp", "[::1]:27002"},
+		"localhost:1234":        {"tcp", "localhost:1234"},
+	}
+	for address, expected := range cases {
+		network, dialAddress, err := parseDialAddress(address, defaultPort)
+		if err != nil || network != expected[0] || dialAddress != expected[1] {
+			t.Errorf("%s: expected %v, got %s %s %v", address, expected, network, dialAddress, err)
+		}
+	}
+
+	for _, address := range []string{"unix://", "tcp://", "tcp://:1234"} {
+		if _, _, err := parseDialAddress(address, defaultPort); err == nil {
+			t.Errorf("%q should not be accepted", address)
+		}
+	}
+}
+
+func TestParseListenAddress(t *testing.T) {
+	cases := map[string][2]string{
+		"127.0.0.1":             {"tcp", "127.0.0.1:27002"},
+		":27003":                {"tcp", ":27003"},
+		"[::1]:0":               {"tcp", "[::1]:0"},
+		"unix:sstt.sock":        {"unix", "sstt.sock"},
+		"/tmp/sstt.sock":        {"unix", "/tmp/sstt.sock"},
+		"localhost:27004":       {"tcp", "localhost:27004"},
+		"fe80::1%eth0":          {"tcp", "[fe80::1%eth0]:27002"},
+		"unix:///run/sstt.sock": {"unix", "/run/sstt.sock"},
+	}
+	for address, expected := range cases {
+		network, bindAddress, err := parseListenAddress(address, defaultPort)
+		if err != nil || network != expected[0] || bindAddress != expected[1] {
+			t.Errorf("%s: expected %v, got %s %s %v", address, expected, network, bindAddress, err)
+		}
+	}
+
+	for _, address := range []string{"", "unix:", ":port", "[::1]:70000"} {
+		if _, _, err := parseListenAddress(address, defaultPort); err == nil {
+			t.Errorf("%q should not be accepted", address)
+		}
+	}
+}
+
+func TestListenAddresses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sstt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := path.Join(dir, "sstt.sock")
+
+	var nullGuiApp GUIApp
+	netClient := NetClientInit(defaultPort, EncMess{}, AcceptPolicy{})
+	netClient.SetListenAddresses([]string{"127.0.0.1:0", "unix://" + socketPath})
+	if err = netClient.NetClientListen(&nullGuiApp); err != nil {
+		t.Fatal(err)
+	}
+	defer netClient.StopListening()
+
+	addrs := netClient.ListenAddrs()
+	if len(addrs) != 2 {
+		t.Fatalf("Expected 2 listeners, got %v", addrs)
+	}
+	if tcpAddr, ok := addrs[0].(*net.TCPAddr); !ok || tcpAddr.Port == 0 {
+		t.Errorf("Chosen ephemeral port should be reported, got %v", addrs[0])
+	}
+
+	for _, addr := range addrs {
+		conn, err := net.Dial(addr.Network(), addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte{0x13, 0x37, 0xAB, 0xCD})
+	}
+
+	if !waitFor(func() bool { return len(netClient.Sessions()) == 2 }) {
+		t.Fatalf("Both listeners should accept sessions, got %v", netClient.Sessions())
+	}
+	if first, second := netClient.Sessions()[0].remoteAddr, netClient.Sessions()[1].remoteAddr; first != "unix://"+socketPath &&
+		second != "unix://"+socketPath {
+		t.Errorf("Unix domain socket session should be named after socket, got %s and %s", first, second)
+	}
+
+	if stat, err := os.Stat(socketPath); err != nil || stat.Mode().Perm() != 0600 {
+		t.Errorf("Socket should be accessible only by owner, got %v %v", stat, err)
+	}
+
+	//Socket of running instance is not taken over, stale one is replaced
+	other := NetClientInit(defaultPort, EncMess{}, AcceptPolicy{})
+	other.SetListenAddresses([]string{"unix://" + socketPath})
+	if err = other.NetClientListen(&nullGuiApp); err == nil {
+		other.StopListening()
+		t.Error("Socket of running instance should not be removed")
+	}
+	if conn, err := net.Dial("unix", socketPath); err != nil {
+		t.Errorf("Running instance should still listen: %v", err)
+	} else {
+		conn.Close()
+	}
+
+	stalePath := path.Join(dir, "stale.sock")
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: stalePath, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+	other.SetListenAddresses([]string{"unix://" + stalePath})
+	if err = other.NetClientListen(&nullGuiApp); err != nil {
+		t.Errorf("Stale socket should be replaced: %v", err)
+	}
+	other.StopListening()
+}
+
+func TestReceiveFileKeepsExistingFile(t *testing.T) {
+	var nullGuiApp GUIApp
+	netClient := testNetClient(t)
+	defer os.RemoveAll(netClient.receiveDir)
+	initiator, responder := authenticatedSessionPair()
+	defer initiator.Close()
+	defer responder.Close()
+
+	existing := path.Join(netClient.receiveDir, "report.txt")
+	os.MkdirAll(netClient.receiveDir, os.ModePerm)
+	if err := ioutil.WriteFile(existing, []byte("existing"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte("new content of report")
+	keys := initiator.auth.send
+	encryptedName, err := EncryptTextMessage(keys.aesKey, keys.iv, "report.txt", keys.cipherMode, &nullGuiApp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := new(bytes.Buffer)
+	if err = EncryptFileStream(keys.aesKey, keys.iv, bytes.NewReader(content), int64(len(content)), encrypted, keys.cipherMode, &nullGuiApp); err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, 8)
+	endianness.PutUint64(header, uint64(encrypted.Len()))
+	header = append(header, encryptedName...)
+
+	//Interrupted transfer doesn't touch file of the same name
+	if err = netClient.ReceiveFile(responder, header, &nullGuiApp); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(existing); string(data) != "existing" {
+		t.Errorf("Existing file should not be truncated when transfer starts, got %q", data)
+	}
+	responder.incomingFile.abort()
+	responder.incomingFile = nil
+	if data, _ := ioutil.ReadFile(existing); string(data) != "existing" {
+		t.Errorf("Existing file should be kept when transfer fails, got %q", data)
+	}
+
+	//Whole file replaces it
+	if err = netClient.ReceiveFile(responder, header, &nullGuiApp); err != nil {
+		t.Fatal(err)
+	}
+	if err = netClient.receiveFileData(responder, encrypted.Bytes(), true, &nullGuiApp); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(func() bool { data, _ := ioutil.ReadFile(existing); return bytes.Equal(data, content) }) {
+		t.Error("Received file should replace existing one")
+	}
+	if parts, _ := ioutil.ReadDir(path.Join(netClient.receiveDir, partialDir)); len(parts) != 0 {
+		t.Errorf("No partial file should be left, got %d", len(parts))
+	}
+}
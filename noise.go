@@ -0,0 +1,553 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+//Protocol version using Noise handshake (NOISE frames) instead of CONNECTIONPROPERTIES
+const noiseVersion = 2
+
+//Length of X25519 keys, SHA-256 hash and AES-GCM tag
+const (
+	noiseKeyLen  = 32
+	noiseHashLen = 32
+	noiseTagLen  = 16
+)
+
+//handshakeVersions returns protocol versions offered with given handshake: any, noise or rsa (legacy CONNECTIONPROPERTIES)
+func handshakeVersions(name string) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "any":
+		if !x25519Supported {
+			return []byte{1}, nil
+		}
+		return []byte{1, noiseVersion}, nil
+	case "noise":
+		if !x25519Supported {
+			return nil, errors.New("handshakeVersions: Noise handshake needs Go 1.24 or newer")
+		}
+		return []byte{noiseVersion}, nil
+	case "rsa":
+		return []byte{1}, nil
+	}
+	return nil, fmt.Errorf("handshakeVersions: Unknown handshake %q. Use any, noise or rsa", name)
+}
+
+//noisepattern is Noise handshake pattern chosen by initiator
+type noisepattern byte
+
+// Structure representing Noise handshake patterns
+const (
+	//Both static keys are sent during handshake
+	NOISEXX = iota + 1
+	//Initiator knows static key of responder from earlier session. One round trip shorter
+	NOISEIK
+)
+
+var noisePatternNames = [...]string{"", "XX", "IK"}
+
+func (pattern noisepattern) String() string {
+	if int(pattern) < len(noisePatternNames) && pattern != 0 {
+		return noisePatternNames[pattern]
+	}
+	return fmt.Sprintf("pattern %d", byte(pattern))
+}
+
+//noisetoken is single step of Noise handshake message
+type noisetoken byte
+
+// Structure representing Noise message tokens
+const (
+	TOKENE = iota
+	TOKENS
+	TOKENEE
+	TOKENES
+	TOKENSE
+	TOKENSS
+)
+
+//Messages of handshake patterns. Initiator sends the first one
+var noiseMessages = map[noisepattern][][]noisetoken{
+	NOISEXX: {{TOKENE}, {TOKENE, TOKENEE, TOKENS, TOKENES}, {TOKENS, TOKENSE}},
+	NOISEIK: {{TOKENE, TOKENES, TOKENS, TOKENSS}, {TOKENE, TOKENEE, TOKENSE}},
+}
+
+//noiseKeyPair is X25519 keypair
+type noiseKeyPair struct {
+	private []byte
+	public  []byte
+}
+
+//noiseKeyPairInit computes public key for private one
+func noiseKeyPairInit(private []byte) (noiseKeyPair, error) {
+	public, err := x25519Public(private)
+	return noiseKeyPair{private: private, public: public}, err
+}
+
+//noiseStaticKey derives static keypair from identity private key, so it stays the same as long as identity does
+func noiseStaticKey(privKey []byte) (noiseKeyPair, error) {
+	mac := hmac.New(sha256.New, []byte("sstt noise static key"))
+	mac.Write(privKey)
+	return noiseKeyPairInit(mac.Sum(nil))
+}
+
+//noiseHandshake is handshake state of Noise_XX_25519_AESGCM_SHA256 or Noise_IK_25519_AESGCM_SHA256
+//(https://noiseprotocol.org/noise.html). Payload of each message is authenticated by handshake hash
+type noiseHandshake struct {
+	pattern   noisepattern
+	initiator bool
+	//Messages already sent or received
+	index int
+	//Symmetric state: chaining key, handshake hash, cipher key (nil before first DH) and its nonce
+	ck []byte
+	h  []byte
+	k  []byte
+	n  uint64
+	//Our static and ephemeral keypairs, static and ephemeral public keys of peer
+	s  noiseKeyPair
+	e  noiseKeyPair
+	rs []byte
+	re []byte
+}
+
+//noiseHandshakeInit starts handshake. Remote static key must be given to initiator of IK. Prologue is data both sides must agree on
+func noiseHandshakeInit(pattern noisepattern, initiator bool, static noiseKeyPair, remoteStatic []byte, prologue []byte) (*noiseHandshake, error) {
+	if _, ok := noiseMessages[pattern]; !ok {
+		return nil, fmt.Errorf("noiseHandshakeInit: Unsupported %s", pattern)
+	}
+
+	handshake := &noiseHandshake{pattern: pattern, initiator: initiator, s: static, rs: remoteStatic}
+	name := []byte("Noise_" + pattern.String() + "_25519_AESGCM_SHA256")
+	handshake.h = make([]byte, noiseHashLen)
+	copy(handshake.h, name)
+	handshake.ck = append([]byte{}, handshake.h...)
+	handshake.mixHash(prologue)
+
+	//Pre-message of IK: responder static key is known to initiator
+	if pattern == NOISEIK {
+		if initiator {
+			if len(remoteStatic) != noiseKeyLen {
+				return nil, errors.New("noiseHandshakeInit: IK needs static key of responder")
+			}
+			handshake.mixHash(remoteStatic)
+		} else {
+			handshake.mixHash(static.public)
+		}
+	}
+
+	return handshake, nil
+}
+
+func (handshake *noiseHandshake) mixHash(data []byte) {
+	hash := sha256.New()
+	hash.Write(handshake.h)
+	hash.Write(data)
+	handshake.h = hash.Sum(nil)
+}
+
+//noiseHKDF derives two keys from chaining key and input key material
+func noiseHKDF(ck []byte, ikm []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write(ikm)
+	tempKey := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, tempKey)
+	mac.Write([]byte{1})
+	first := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, tempKey)
+	mac.Write(first)
+	mac.Write([]byte{2})
+	return first, mac.Sum(nil)
+}
+
+func (handshake *noiseHandshake) mixKey(ikm []byte) {
+	handshake.ck, handshake.k = noiseHKDF(handshake.ck, ikm)
+	handshake.n = 0
+}
+
+//aead returns AES-256-GCM with nonce of current message: 32 zero bits followed by big endian counter
+func (handshake *noiseHandshake) aead() (cipher.AEAD, []byte, error) {
+	block, err := aes.NewCipher(handshake.k)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[4:], handshake.n)
+	handshake.n++
+	return aead, nonce, nil
+}
+
+func (handshake *noiseHandshake) encryptAndHash(plaintext []byte) ([]byte, error) {
+	ciphertext := plaintext
+	if handshake.k != nil {
+		aead, nonce, err := handshake.aead()
+		if err != nil {
+			return nil, err
+		}
+		ciphertext = aead.Seal(nil, nonce, plaintext, handshake.h)
+	}
+	handshake.mixHash(ciphertext)
+	return ciphertext, nil
+}
+
+func (handshake *noiseHandshake) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext := ciphertext
+	if handshake.k != nil {
+		aead, nonce, err := handshake.aead()
+		if err != nil {
+			return nil, err
+		}
+		if plaintext, err = aead.Open(nil, nonce, ciphertext, handshake.h); err != nil {
+			return nil, errors.New("noiseHandshake: Message authentication failed")
+		}
+	}
+	handshake.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+//dh mixes result of Diffie-Hellman required by token into cipher key
+func (handshake *noiseHandshake) dh(token noisetoken) error {
+	//es means initiator ephemeral and responder static, so responder uses its static with remote ephemeral
+	private, public := handshake.e.private, handshake.re
+	switch token {
+	case TOKENES:
+		if !handshake.initiator {
+			private = handshake.s.private
+		} else {
+			public = handshake.rs
+		}
+	case TOKENSE:
+		if handshake.initiator {
+			private = handshake.s.private
+		} else {
+			public = handshake.rs
+		}
+	case TOKENSS:
+		private, public = handshake.s.private, handshake.rs
+	}
+
+	shared, err := x25519(private, public)
+	if err != nil {
+		return err
+	}
+	handshake.mixKey(shared)
+	return nil
+}
+
+//ourTurn returns true if next message is sent by us
+func (handshake *noiseHandshake) ourTurn() bool {
+	return (handshake.index%2 == 0) == handshake.initiator
+}
+
+//complete returns true if all messages of pattern were sent and received
+func (handshake *noiseHandshake) complete() bool {
+	return handshake.index == len(noiseMessages[handshake.pattern])
+}
+
+//lastForPeer returns true if message just written is the last one peer receives. Peer may only answer it
+func (handshake *noiseHandshake) lastForPeer() bool {
+	return len(noiseMessages[handshake.pattern])-handshake.index <= 1
+}
+
+//writeMessage creates next handshake message. Payload is built from handshake hash it will be authenticated with
+func (handshake *noiseHandshake) writeMessage(buildPayload func(h []byte) ([]byte, error)) ([]byte, error) {
+	if handshake.complete() || !handshake.ourTurn() {
+		return nil, errors.New("noiseHandshake.writeMessage: Not our turn")
+	}
+
+	message := new(bytes.Buffer)
+	for _, token := range noiseMessages[handshake.pattern][handshake.index] {
+		switch token {
+		case TOKENE:
+			private := make([]byte, noiseKeyLen)
+			if _, err := rand.Read(private); err != nil {
+				return nil, err
+			}
+			var err error
+			if handshake.e, err = noiseKeyPairInit(private); err != nil {
+				return nil, err
+			}
+			message.Write(handshake.e.public)
+			handshake.mixHash(handshake.e.public)
+		case TOKENS:
+			encrypted, err := handshake.encryptAndHash(handshake.s.public)
+			if err != nil {
+				return nil, err
+			}
+			message.Write(encrypted)
+		default:
+			if err := handshake.dh(token); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	payload, err := buildPayload(handshake.h)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := handshake.encryptAndHash(payload)
+	if err != nil {
+		return nil, err
+	}
+	message.Write(encrypted)
+
+	handshake.index++
+	return message.Bytes(), nil
+}
+
+//readMessage handles next handshake message from peer. Returns its payload and handshake hash payload was authenticated with
+func (handshake *noiseHandshake) readMessage(message []byte) (payload []byte, h []byte, err error) {
+	if handshake.complete() || handshake.ourTurn() {
+		return nil, nil, errors.New("noiseHandshake.readMessage: Not peer turn")
+	}
+
+	reader := bytes.NewReader(message)
+	for _, token := range noiseMessages[handshake.pattern][handshake.index] {
+		switch token {
+		case TOKENE:
+			handshake.re = make([]byte, noiseKeyLen)
+			if _, err = io.ReadFull(reader, handshake.re); err != nil {
+				return nil, nil, errors.New("noiseHandshake.readMessage: Message too short")
+			}
+			handshake.mixHash(handshake.re)
+		case TOKENS:
+			length := noiseKeyLen
+			if handshake.k != nil {
+				length += noiseTagLen
+			}
+			if reader.Len() < length {
+				return nil, nil, errors.New("noiseHandshake.readMessage: Message too short")
+			}
+			encrypted := make([]byte, length)
+			reader.Read(encrypted)
+			if handshake.rs, err = handshake.decryptAndHash(encrypted); err != nil {
+				return nil, nil, err
+			}
+		default:
+			if err = handshake.dh(token); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	h = handshake.h
+	if payload, err = handshake.decryptAndHash(message[len(message)-reader.Len():]); err != nil {
+		return nil, nil, err
+	}
+
+	handshake.index++
+	return payload, h, nil
+}
+
+//split returns keys and IVs used by session after handshake, one pair for frames sent by initiator and one for frames sent by responder.
+//Both sides get the same ones
+func (handshake *noiseHandshake) split() (initiatorKey, initiatorIV, responderKey, responderIV []byte) {
+	initiatorKey, responderKey = noiseHKDF(handshake.ck, nil)
+	initiatorIV, responderIV = noiseHKDF(handshake.ck, []byte("sstt iv"))
+	return initiatorKey, initiatorIV[:aes.BlockSize], responderKey, responderIV[:aes.BlockSize]
+}
+
+//wipe zeroes secret keys of handshake
+func (handshake *noiseHandshake) wipe() {
+	for _, secret := range [][]byte{handshake.ck, handshake.k, handshake.e.private} {
+		for i := range secret {
+			secret[i] = 0
+		}
+	}
+}
+
+//encodeNoiseIdentity returns our public key with signature of handshake hash. It binds Noise handshake to identity known from HELLO.
+//Initiator adds proposed cipher mode
+// Schema of Noise payload
+// |cipherMode byte (initiator only)|keyLength uint32|key [keyLength]byte|signature [rest]byte|
+func encodeNoiseIdentity(session *Session, h []byte) ([]byte, error) {
+	signature, err := SignRSA(h, session.messageHandler.myPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	if session.initiator {
+		buf.WriteByte(byte(session.messageHandler.cipherMode))
+	}
+	binary.Write(buf, endianness, uint32(len(session.messageHandler.myPublicKey)))
+	buf.Write(session.messageHandler.myPublicKey)
+	buf.Write(signature)
+	return buf.Bytes(), nil
+}
+
+//verifyNoiseIdentity checks that peer signed handshake hash with key it sent in HELLO. Returns cipher mode proposed by initiator
+func verifyNoiseIdentity(session *Session, payload []byte, h []byte) (cipherblockmode, error) {
+	reader := bytes.NewReader(payload)
+	mode := session.messageHandler.cipherMode
+	if !session.initiator {
+		var proposed byte
+		if err := binary.Read(reader, endianness, &proposed); err != nil {
+			return 0, sessionErrorf(ERRORPROTOCOL, "Noise payload too short")
+		}
+		mode = cipherblockmode(proposed)
+	}
+
+	var keyLength uint32
+	if err := binary.Read(reader, endianness, &keyLength); err != nil || keyLength > uint32(reader.Len()) {
+		return 0, sessionErrorf(ERRORPROTOCOL, "Wrong key length in Noise payload")
+	}
+	key := make([]byte, keyLength)
+	reader.Read(key)
+	signature := payload[len(payload)-reader.Len():]
+
+	if !bytes.Equal(key, session.messageHandler.publicKeyClient) {
+		return 0, sessionErrorf(ERRORAUTHENTICATION, "Key in Noise handshake differs from key sent in HELLO")
+	}
+	if err := VerifyRSA(h, signature, key); err != nil {
+		return 0, sessionErrorf(ERRORAUTHENTICATION, "Wrong signature of Noise handshake: %v", err)
+	}
+
+	return mode, nil
+}
+
+//startNoise sends first Noise message after HELLORESPONSE chose noiseVersion. IK is used if static key of peer is known, XX otherwise
+// Schema of first NOISE or NOISEFINAL frame
+// |pattern byte|message [rest]byte|
+func (netClient *NetClient) startNoise(session *Session) error {
+	static, err := noiseStaticKey(session.messageHandler.myPrivateKey)
+	if err != nil {
+		return err
+	}
+
+	pattern := noisepattern(NOISEXX)
+	remoteStatic := netClient.acceptPolicy.knownPeers.StaticKey(session.peerFingerprint)
+	if remoteStatic != nil {
+		pattern = NOISEIK
+	}
+
+	if session.noise, err = noiseHandshakeInit(pattern, true, static, remoteStatic, session.helloTranscript); err != nil {
+		return err
+	}
+
+	//XX sends identity in the last message, IK right away
+	payload := func(h []byte) ([]byte, error) { return nil, nil }
+	if pattern == NOISEIK {
+		payload = func(h []byte) ([]byte, error) { return encodeNoiseIdentity(session, h) }
+	}
+
+	message, err := session.noise.writeMessage(payload)
+	if err != nil {
+		return err
+	}
+	ptype := packettype(NOISE)
+	if session.noise.lastForPeer() {
+		ptype = NOISEFINAL
+	}
+	return session.writePacket(ptype, append([]byte{byte(pattern)}, message...))
+}
+
+//handleNoise handles NOISE and NOISEFINAL frames. NOISEFINAL is the last message peer receives, so session keys are ready after it
+// Schema of frame
+// |message [length]byte|
+func (netClient *NetClient) handleNoise(session *Session, frame Frame, app *GUIApp) error {
+	if session.version != noiseVersion {
+		return sessionErrorf(ERRORPROTOCOL, "Noise frame in session using protocol version %d", session.version)
+	}
+
+	payload := frame.payload
+	if session.noise == nil {
+		if session.initiator || len(payload) == 0 {
+			return sessionErrorf(ERRORPROTOCOL, "Unexpected Noise frame")
+		}
+		static, err := noiseStaticKey(session.messageHandler.myPrivateKey)
+		if err != nil {
+			return err
+		}
+		if session.noise, err = noiseHandshakeInit(noisepattern(payload[0]), false, static, nil, session.helloTranscript); err != nil {
+			return sessionErrorf(ERRORPROTOCOL, "%v", err)
+		}
+		payload = payload[1:]
+	}
+
+	received, h, err := session.noise.readMessage(payload)
+	if err != nil {
+		return sessionErrorf(ERRORAUTHENTICATION, "%v", err)
+	}
+
+	//Identity comes with the last message of initiator and every message of responder except the first one of XX
+	if session.initiator || frame.ptype == NOISEFINAL {
+		mode, err := verifyNoiseIdentity(session, received, h)
+		if err != nil {
+			return err
+		}
+		if err = session.messageHandler.cipherPolicy.CheckProperties(0, noiseKeyLen, mode); err != nil {
+			app.ShowStatus(fmt.Sprintf("Refused %s: %v", session, err))
+			return sessionErrorf(ERRORPOLICY, "%v", err)
+		}
+		session.messageHandler.cipherMode = mode
+	} else if len(received) != 0 {
+		return sessionErrorf(ERRORPROTOCOL, "Unexpected payload in first Noise message")
+	}
+
+	if !session.noise.complete() {
+		message, err := session.noise.writeMessage(func(h []byte) ([]byte, error) { return encodeNoiseIdentity(session, h) })
+		if err != nil {
+			return err
+		}
+		ptype := packettype(NOISE)
+		if session.noise.lastForPeer() {
+			ptype = NOISEFINAL
+		}
+		if err = session.writePacket(ptype, message); err != nil {
+			return err
+		}
+	}
+
+	if session.noise.complete() != (frame.ptype == NOISEFINAL) {
+		return sessionErrorf(ERRORPROTOCOL, "Noise %s handshake ended by wrong frame", session.noise.pattern)
+	}
+	if frame.ptype == NOISEFINAL {
+		return netClient.finishNoise(session)
+	}
+	return nil
+}
+
+//finishNoise sets session keys derived by Noise handshake. Static key learned by XX is remembered for known peers,
+//so IK is used when we connect to them next time
+func (netClient *NetClient) finishNoise(session *Session) error {
+	noise := session.noise
+	session.noise = nil
+
+	knownPeers := netClient.acceptPolicy.knownPeers
+	if noise.pattern == NOISEXX && knownPeers.IsKnown(session.peerFingerprint) {
+		if err := knownPeers.SetStaticKey(session.peerFingerprint, noise.rs); err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	encMess := &session.messageHandler
+	encMess.alghorytm = 0
+	encMess.keySize = noiseKeyLen
+	encMess.blockSize = aes.BlockSize
+	encMess.aesKey, encMess.iv, session.responderKey, session.responderIV = noise.split()
+	noise.wipe()
+
+	fmt.Printf("Noise %s handshake with %s finished\n", noise.pattern, session)
+	if err := mixHybridSecret(session); err != nil {
+		return err
+	}
+	session.enableAuthentication()
+	return nil
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestHandshakeVersions(t *testing.T) {
+	if !x25519Supported {
+		t.Skip("X25519 is not available")
+	}
+	cases := map[string][]byte{"any": {1, noiseVersion}, " Noise": {noiseVersion}, "rsa": {1}}
+	for name, expected := range cases {
+		if versions, err := handshakeVersions(name); err != nil || !bytes.Equal(versions, expected) {
+			t.Errorf("%q: expected %v, got %v %v", name, expected, versions, err)
+		}
+	}
+	if _, err := handshakeVersions("tls"); err == nil {
+		t.Error("Unknown handshake should not be accepted")
+	}
+}
+
+//testNoiseStatic returns static keypair derived from new identity key
+func testNoiseStatic(t *testing.T) noiseKeyPair {
+	privKey, _, err := GenerateKeyPair(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	static, err := noiseStaticKey(privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return static
+}
+
+//runNoise passes messages between handshakes until they are complete. Each message carries its index as payload
+func runNoise(initiator *noiseHandshake, responder *noiseHandshake) error {
+	sender, receiver := initiator, responder
+	for i := 0; !initiator.complete(); i++ {
+		message, err := sender.writeMessage(func(h []byte) ([]byte, error) { return []byte{byte(i)}, nil })
+		if err != nil {
+			return err
+		}
+		payload, _, err := receiver.readMessage(message)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(payload, []byte{byte(i)}) {
+			return errors.New("Payload differs")
+		}
+		sender, receiver = receiver, sender
+	}
+	return nil
+}
+
+func TestX25519(t *testing.T) {
+	if !x25519Supported {
+		t.Skip("X25519 is not available")
+	}
+	//Test vector of RFC 7748 section 6.1
+	decode := func(s string) []byte {
+		b, _ := hex.DecodeString(s)
+		return b
+	}
+	private := decode("77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a")
+	public, err := x25519Public(private)
+	if err != nil || !bytes.Equal(public, decode("8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a")) {
+		t.Fatalf("Unexpected public key %x %v", public, err)
+	}
+	shared, err := x25519(private, decode("de9edb7d7b7dc1b4d35b61c2ece435373f8343c85b78674dadfc7e146f882b4f"))
+	if err != nil || !bytes.Equal(shared, decode("4a5d9d5ba4ce2de1728e3bf480350f25e07e21c947d19e3376f09b3c1e161742")) {
+		t.Fatalf("Unexpected shared secret %x %v", shared, err)
+	}
+	if _, err := x25519(private, make([]byte, 32)); err == nil {
+		t.Error("Low order public key should be refused")
+	}
+}
+
+func TestNoisePatterns(t *testing.T) {
+	if !x25519Supported {
+		t.Skip("X25519 is not available")
+	}
+	initiatorStatic, responderStatic := testNoiseStatic(t), testNoiseStatic(t)
+	prologue := []byte("hello transcript")
+
+	for _, pattern := range []noisepattern{NOISEXX, NOISEIK} {
+		var known []byte
+		if pattern == NOISEIK {
+			known = responderStatic.public
+		}
+		initiator, err := noiseHandshakeInit(pattern, true, initiatorStatic, known, prologue)
+		if err != nil {
+			t.Fatal(err)
+		}
+		responder, err := noiseHandshakeInit(pattern, false, responderStatic, nil, prologue)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = runNoise(initiator, responder); err != nil {
+			t.Fatalf("%s: %v", pattern, err)
+		}
+		if !responder.complete() {
+			t.Errorf("%s: Responder should be complete", pattern)
+		}
+		if !bytes.Equal(initiator.rs, responderStatic.public) || !bytes.Equal(responder.rs, initiatorStatic.public) {
+			t.Errorf("%s: Static keys were not exchanged", pattern)
+		}
+
+		initiatorKey, initiatorIV, responderKey, responderIV := initiator.split()
+		peerInitiatorKey, peerInitiatorIV, peerResponderKey, peerResponderIV := responder.split()
+		if !bytes.Equal(initiatorKey, peerInitiatorKey) || !bytes.Equal(initiatorIV, peerInitiatorIV) ||
+			!bytes.Equal(responderKey, peerResponderKey) || !bytes.Equal(responderIV, peerResponderIV) || len(initiatorIV) != 16 {
+			t.Errorf("%s: Both sides should derive the same session keys", pattern)
+		}
+		if bytes.Equal(initiatorKey, responderKey) || bytes.Equal(initiatorIV, responderIV) {
+			t.Errorf("%s: Directions should have different keys", pattern)
+		}
+	}
+}
+
+func TestNoiseFailures(t *testing.T) {
+	if !x25519Supported {
+		t.Skip("X25519 is not available")
+	}
+	initiatorStatic, responderStatic, otherStatic := testNoiseStatic(t), testNoiseStatic(t), testNoiseStatic(t)
+
+	//Sides which saw different HELLO frames can't finish handshake
+	initiator, _ := noiseHandshakeInit(NOISEXX, true, initiatorStatic, nil, []byte("hello"))
+	responder, _ := noiseHandshakeInit(NOISEXX, false, responderStatic, nil, []byte("forged hello"))
+	if err := runNoise(initiator, responder); err == nil {
+		t.Error("Handshake with different prologue should fail")
+	}
+
+	//IK initiator which remembers other static key can't talk to responder
+	initiator, _ = noiseHandshakeInit(NOISEIK, true, initiatorStatic, otherStatic.public, nil)
+	responder, _ = noiseHandshakeInit(NOISEIK, false, responderStatic, nil, nil)
+	if err := runNoise(initiator, responder); err == nil {
+		t.Error("IK with wrong responder static key should fail")
+	}
+
+	//Tampered message is refused
+	initiator, _ = noiseHandshakeInit(NOISEXX, true, initiatorStatic, nil, nil)
+	responder, _ = noiseHandshakeInit(NOISEXX, false, responderStatic, nil, nil)
+	message, _ := initiator.writeMessage(func(h []byte) ([]byte, error) { return nil, nil })
+	responder.readMessage(message)
+	message, _ = responder.writeMessage(func(h []byte) ([]byte, error) { return []byte("identity"), nil })
+	message[len(message)-1] ^= 1
+	if _, _, err := initiator.readMessage(message); err == nil {
+		t.Error("Tampered message should be refused")
+	}
+
+	if _, err := noiseHandshakeInit(NOISEIK, true, initiatorStatic, nil, nil); err == nil {
+		t.Error("IK initiator without responder static key should fail")
+	}
+}
+
+func TestNoiseIKWithKnownPeer(t *testing.T) {
+	if !x25519Supported {
+		t.Skip("X25519 is not available")
+	}
+	var nullGuiApp GUIApp
+	initiator, responder := testNetClient(t), testNetClient(t)
+	defer os.RemoveAll(initiator.receiveDir)
+	defer os.RemoveAll(responder.receiveDir)
+
+	//Initiator knows responder already, so static key learned by XX is remembered
+	knownPeers, err := KnownPeersLoad(initiator.receiveDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responderFingerprint := fingerprint(responder.messageHandler.myPublicKey)
+	knownPeers.Add(responderFingerprint, "responder")
+	initiator.acceptPolicy.knownPeers = knownPeers
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go responder.serveListener(listener, &nullGuiApp)
+
+	connect := func() bool {
+		sessionID, err := initiator.SendHello(listener.Addr().String(), &nullGuiApp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer initiator.Disconnect(sessionID, &nullGuiApp)
+
+		//Session is either established or closed because handshake failed
+		finished := func() bool {
+			for _, session := range initiator.Sessions() {
+				if session.id == sessionID {
+					return initiator.IsConnected(sessionID)
+				}
+			}
+			return true
+		}
+		return waitFor(finished) && initiator.IsConnected(sessionID)
+	}
+
+	if !connect() {
+		t.Fatal("XX session was not established")
+	}
+	expected, _ := noiseStaticKey(responder.messageHandler.myPrivateKey)
+	if !waitFor(func() bool { return bytes.Equal(knownPeers.StaticKey(responderFingerprint), expected.public) }) {
+		t.Fatal("Static key of known peer should be remembered")
+	}
+
+	//Remembered key is saved with known peer
+	data, err := ioutil.ReadFile(knownPeers.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded, err := KnownPeersLoad(initiator.receiveDir); err != nil || !bytes.Equal(reloaded.StaticKey(responderFingerprint), expected.public) {
+		t.Errorf("Static key should be loaded from %q, got %v", data, err)
+	}
+
+	//IK is used from now on. It fails if remembered key is wrong
+	if !connect() {
+		t.Error("IK session was not established")
+	}
+	knownPeers.SetStaticKey(responderFingerprint, testNoiseStatic(t).public)
+	if connect() {
+		t.Error("IK session with wrong static key should fail")
+	}
+}
+
+func TestLegacyHandshake(t *testing.T) {
+	defer func(versions []byte) { supportedVersions = versions }(supportedVersions)
+	supportedVersions = []byte{1}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testTransfer(t, listener, listener.Addr().String(), nil)
+}
+
+func TestNoiseSessionDirections(t *testing.T) {
+	if !x25519Supported {
+		t.Skip("X25519 is not available")
+	}
+	var nullGuiApp GUIApp
+	initiator, responder := testNetClient(t), testNetClient(t)
+	defer os.RemoveAll(initiator.receiveDir)
+	defer os.RemoveAll(responder.receiveDir)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go responder.serveListener(listener, &nullGuiApp)
+
+	sessionID, err := initiator.SendHello(listener.Addr().String(), &nullGuiApp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer initiator.Disconnect(sessionID, &nullGuiApp)
+	established := func() bool {
+		return initiator.IsConnected(sessionID) && responder.IsConnected(responder.ActiveSession())
+	}
+	if !waitFor(established) {
+		t.Fatal("Noise session was not established")
+	}
+	sent, _ := initiator.establishedSession(sessionID)
+	received, _ := responder.establishedSession(responder.ActiveSession())
+	if sent.version != noiseVersion {
+		t.Fatalf("Expected Noise session, got version %d", sent.version)
+	}
+
+	//Each direction uses its own key and IV from split
+	sent.keyMutex.RLock()
+	defer sent.keyMutex.RUnlock()
+	received.keyMutex.RLock()
+	defer received.keyMutex.RUnlock()
+	if !bytes.Equal(sent.auth.send.aesKey, received.auth.recv.aesKey) || !bytes.Equal(sent.auth.recv.aesKey, received.auth.send.aesKey) {
+		t.Error("Both sides should agree on keys of each direction")
+	}
+	if bytes.Equal(sent.auth.send.aesKey, sent.auth.recv.aesKey) || bytes.Equal(sent.auth.send.iv, sent.auth.recv.iv) {
+		t.Error("Directions should have different keys and IVs")
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//How long code generated by us waits for peer
+var pairingCodeTimeout = 10 * time.Minute
+
+//Nameplates (numbers at the start of pairing codes) are 1 to maxNameplate
+const maxNameplate = 99
+
+//Length of uncompressed P-256 point sent in PAIR and PAIRRESPONSE
+const spake2ElementLen = 65
+
+//Words of pairing codes, each carries 8 bits
+var pairingWords = [...]string{
+	"acorn", "actor", "adult", "agent", "album", "alpine", "amber", "anchor", "angle", "ankle", "apple", "apron", "arena", "armor",
+	"arrow", "atlas", "attic", "autumn", "badge", "bagel", "bakery", "bamboo", "banana", "banjo", "barrel", "basket", "beacon",
+	"beaver", "bedrock", "beetle", "bench", "berry", "bicycle", "biscuit", "blanket", "blossom", "bonus", "border", "bottle",
+	"boulder", "bracket", "branch", "breeze", "bridge", "bronze", "bubble", "bucket", "buffalo", "bugle", "butter", "button",
+	"cabin", "cactus", "camera", "canal", "candle", "canyon", "captain", "carbon", "carpet", "castle", "cattle", "cedar", "cellar",
+	"cement", "cherry", "chimney", "cider", "circus", "citrus", "clover", "cobalt", "coconut", "comet", "compass", "copper",
+	"coral", "cotton", "cousin", "coyote", "crater", "crayon", "cricket", "crossword", "crystal", "curtain", "cushion", "dagger",
+	"dancer", "denim", "desert", "diamond", "dinner", "dolphin", "domino", "donkey", "dragon", "drawer", "dream", "eagle", "easel",
+	"echo", "eclipse", "elbow", "ember", "engine", "falcon", "feather", "fennel", "ferry", "fiddle", "figure", "flannel", "forest",
+	"fossil", "fountain", "fox", "galaxy", "garden", "garlic", "ginger", "glacier", "goblet", "gopher", "granite", "grape",
+	"gravel", "guitar", "hammer", "harbor", "harvest", "hazel", "helmet", "heron", "honey", "horizon", "husky", "iceberg", "igloo",
+	"island", "ivory", "jacket", "jaguar", "jasmine", "jelly", "jungle", "kayak", "kernel", "kettle", "kiwi", "koala", "ladder",
+	"lagoon", "lantern", "laser", "lemon", "lettuce", "library", "lilac", "lizard", "locket", "lotus", "lumber", "magnet", "mango",
+	"maple", "marble", "meadow", "melon", "mirror", "mitten", "monkey", "mosaic", "motor", "muffin", "mustard", "napkin", "nectar",
+	"needle", "noodle", "nutmeg", "oasis", "ocean", "olive", "onion", "orbit", "orchid", "otter", "oyster", "paddle", "panda",
+	"panther", "parrot", "pebble", "pepper", "piano", "pickle", "pigeon", "pillow", "pilot", "pine", "planet", "plum", "pocket",
+	"pony", "potato", "pumpkin", "puzzle", "quartz", "quiver", "rabbit", "radar", "raisin", "raven", "ribbon", "river", "robot",
+	"rocket", "saddle", "salmon", "sandal", "satin", "scarf", "shadow", "silver", "sketch", "sparrow", "spider", "spruce", "squash",
+	"statue", "summit", "sunset", "tango", "teapot", "thunder", "tiger", "timber", "tomato", "topaz", "tractor", "trumpet", "tulip",
+	"tunnel", "turtle", "valley", "velvet", "violin", "volcano", "waffle", "walnut", "willow", "window", "wizard", "zebra",
+	"zipper",
+}
+
+//parsePairingCode checks code like 7-crossword-orbit and returns its nameplate and normalized code.
+//Case and separators don't matter, so "7 Crossword orbit" is the same code
+func parsePairingCode(code string) (nameplate string, normalized string, err error) {
+	parts := strings.FieldsFunc(strings.ToLower(code), func(r rune) bool { return r == '-' || r == ' ' })
+	if len(parts) < 2 {
+		return "", "", fmt.Errorf("parsePairingCode: Code %q should look like 7-crossword-orbit", code)
+	}
+	if number, err := strconv.Atoi(parts[0]); err != nil || number < 1 || number > maxNameplate {
+		return "", "", fmt.Errorf("parsePairingCode: Code %q should start with number 1 to %d", code, maxNameplate)
+	}
+	return parts[0], strings.Join(parts, "-"), nil
+}
+
+//Pairings holds pairing codes generated by us until peers use them
+type Pairings struct {
+	mutex sync.Mutex
+	codes map[string]pendingPairing
+}
+
+//pendingPairing is code waiting for peer
+type pendingPairing struct {
+	code    string
+	expires time.Time
+}
+
+//PairingsInit returns empty pairing code list
+func PairingsInit() *Pairings {
+	return &Pairings{codes: make(map[string]pendingPairing)}
+}
+
+//Generate returns new code with nameplate not used by other waiting codes, e.g. 7-crossword-orbit. It waits for peer pairingCodeTimeout
+func (pairings *Pairings) Generate() (string, error) {
+	pairings.mutex.Lock()
+	defer pairings.mutex.Unlock()
+
+	for nameplate, pending := range pairings.codes {
+		if time.Now().After(pending.expires) {
+			delete(pairings.codes, nameplate)
+		}
+	}
+	if len(pairings.codes) >= maxNameplate {
+		return "", errors.New("Pairings.Generate: Too many pairing codes waiting for peers")
+	}
+
+	var nameplate string
+	for nameplate == "" || pairings.codes[nameplate].code != "" {
+		number, err := rand.Int(rand.Reader, big.NewInt(maxNameplate))
+		if err != nil {
+			return "", err
+		}
+		nameplate = strconv.FormatInt(number.Int64()+1, 10)
+	}
+
+	words := make([]byte, 2)
+	if _, err := rand.Read(words); err != nil {
+		return "", err
+	}
+	code := fmt.Sprintf("%s-%s-%s", nameplate, pairingWords[words[0]], pairingWords[words[1]])
+	pairings.codes[nameplate] = pendingPairing{code: code, expires: time.Now().Add(pairingCodeTimeout)}
+	return code, nil
+}
+
+//Take removes and returns code with given nameplate. Every code can be tried once, so peer guessing it has single chance
+func (pairings *Pairings) Take(nameplate string) (string, bool) {
+	pairings.mutex.Lock()
+	defer pairings.mutex.Unlock()
+
+	pending, ok := pairings.codes[nameplate]
+	delete(pairings.codes, nameplate)
+	if !ok || time.Now().After(pending.expires) {
+		return "", false
+	}
+	return pending.code, true
+}
+
+//NewPairingCode generates code peer can pair with us using Pair. Code is shown to user who tells it to peer
+func (netClient *NetClient) NewPairingCode() (string, error) {
+	if !pairingSupported {
+		return "", errPairingUnsupported
+	}
+	return netClient.pairings.Generate()
+}
+
+//Pair connects to peer which generated pairing code and agrees session key using SPAKE2 with code as password.
+//Peers are authenticated by code, so neither accept policy nor fingerprint comparison is needed. Paired peers become known peers.
+//Relay address (relay://host:port, without session code) pairs with peer which joined relay using the same code
+func (netClient *NetClient) Pair(address string, code string, app *GUIApp) (uint32, error) {
+	if !pairingSupported {
+		return 0, errPairingUnsupported
+	}
+	nameplate, code, err := parsePairingCode(code)
+	if err != nil {
+		return 0, err
+	}
+
+	if isRelayAddress(address) {
+		//Code used through relay doesn't wait for direct connection
+		netClient.pairings.Take(nameplate)
+		return netClient.joinRelay(strings.TrimRight(strings.TrimSpace(address), "/")+"/pair-"+nameplate, code, app)
+	}
+
+	session, err := netClient.dial(address)
+	if err != nil {
+		return 0, err
+	}
+	return netClient.sendPair(session, code, app)
+}
+
+//sendPair starts session opened by us and sends PAIR through it
+// Schema of frame
+// |element [spake2ElementLen]byte|nameplateLength byte|nameplate [nameplateLength]byte|cipherMode byte|hello [rest]byte (see SendHello)|
+func (netClient *NetClient) sendPair(session *Session, code string, app *GUIApp) (uint32, error) {
+	nameplate, code, err := parsePairingCode(code)
+	if err != nil {
+		session.Close()
+		return 0, err
+	}
+	exchange, err := spake2Init(true, code)
+	if err != nil {
+		session.Close()
+		return 0, err
+	}
+	key, err := netClient.messageHandler.GenerateHelloMessage()
+	if err != nil {
+		session.Close()
+		return 0, err
+	}
+
+	hello := Hello{versions: supportedVersions, features: supportedFeatures, key: key}
+	data := new(bytes.Buffer)
+	data.WriteByte(byte(len(nameplate)))
+	data.WriteString(nameplate)
+	data.WriteByte(byte(netClient.messageHandler.cipherMode))
+	data.Write(hello.encode())
+	session.helloTranscript = data.Bytes()
+	session.pake = exchange
+
+	netClient.startSession(session, true, app)
+
+	session.handshake.Fire(EVENTSENDPAIR)
+
+	if err = session.writePacket(PAIR, append(append([]byte{}, exchange.element...), data.Bytes()...)); err != nil {
+		netClient.endSession(session, app)
+		return 0, err
+	}
+
+	go netClient.serveSession(session, app)
+
+	return session.id, nil
+}
+
+//handlePair answers PAIR if we have code with its nameplate. Code is used up whether peer knows it or not
+// Schema of PAIRRESPONSE frame
+// |element [spake2ElementLen]byte|confirmation [spake2ConfirmationLen]byte|hello response [rest]byte (see SendHelloResponse)|
+func (netClient *NetClient) handlePair(session *Session, payload []byte, app *GUIApp) error {
+	if len(payload) < spake2ElementLen+1 || len(payload) < spake2ElementLen+2+int(payload[spake2ElementLen]) {
+		return sessionErrorf(ERRORPROTOCOL, "PAIR frame too short")
+	}
+	element, data := payload[:spake2ElementLen], payload[spake2ElementLen:]
+	nameplate := string(data[1 : 1+data[0]])
+	mode := cipherblockmode(data[1+data[0]])
+
+	hello, err := decodeHello(data[2+data[0]:])
+	if err != nil {
+		return sessionErrorf(ERRORPROTOCOL, "%v", err)
+	}
+	version, err := chooseVersion(hello.versions)
+	if err != nil {
+		return sessionErrorf(ERRORVERSION, "%v", err)
+	}
+	if err = session.messageHandler.HandleReceivedPublicKey(hello.key); err != nil {
+		return sessionErrorf(ERRORPROTOCOL, "%v", err)
+	}
+
+	peerFingerprint := fingerprint(session.messageHandler.publicKeyClient)
+	fmt.Printf("Received pairing request from: %s PubKey Hash: %s\n", session, peerFingerprint)
+
+	if netClient.refuseRevoked(session, peerFingerprint, app) {
+		return sessionErrorf(ERRORREVOKED, "Public key %s is revoked", peerFingerprint)
+	}
+	if err := checkCertificatePin(session, peerFingerprint); err != nil {
+		return err
+	}
+	if err = session.messageHandler.cipherPolicy.CheckProperties(0, 32, mode); err != nil {
+		app.ShowStatus(fmt.Sprintf("Refused %s: %v", session, err))
+		return sessionErrorf(ERRORPOLICY, "%v", err)
+	}
+
+	//Peer paired through relay brings its code, others use code generated by us
+	code := session.pairingCode
+	if code == "" {
+		code, _ = netClient.pairings.Take(nameplate)
+	}
+	if codeNameplate, _, err := parsePairingCode(code); err != nil || codeNameplate != nameplate {
+		return sessionErrorf(ERRORREJECTED, "No pairing code with number %s", nameplate)
+	}
+
+	session.version = version
+	session.features = pairingFeatures(session, hello.features, app)
+	session.peerFingerprint = peerFingerprint
+	session.messageHandler.cipherMode = mode
+
+	if session.pake, err = spake2Init(false, code); err != nil {
+		return err
+	}
+	key, err := session.messageHandler.GenerateHelloMessage()
+	if err != nil {
+		return err
+	}
+	response := Hello{versions: []byte{version}, features: supportedFeatures, key: key}
+	toSend := response.encode()
+	if err = session.pake.finish(element, data, toSend); err != nil {
+		return sessionErrorf(ERRORAUTHENTICATION, "%v", err)
+	}
+
+	toSend = append(append(append([]byte{}, session.pake.element...), session.pake.confirmation...), toSend...)
+	return session.writePacket(PAIRRESPONSE, toSend)
+}
+
+//handlePairResponse checks that peer knows pairing code and sends our key confirmation. Session is established then
+// Schema of PAIRCONFIRM frame
+// |confirmation [spake2ConfirmationLen]byte|
+func (netClient *NetClient) handlePairResponse(session *Session, payload []byte, app *GUIApp) error {
+	if session.pake == nil || len(payload) < spake2ElementLen+spake2ConfirmationLen {
+		return sessionErrorf(ERRORPROTOCOL, "Unexpected pairing response")
+	}
+	element, confirmation := payload[:spake2ElementLen], payload[spake2ElementLen:spake2ElementLen+spake2ConfirmationLen]
+	data := payload[spake2ElementLen+spake2ConfirmationLen:]
+
+	hello, err := decodeHello(data)
+	if err != nil {
+		return sessionErrorf(ERRORPROTOCOL, "%v", err)
+	}
+	if len(hello.versions) != 1 || !bytes.Contains(supportedVersions, hello.versions) {
+		return sessionErrorf(ERRORVERSION, "Peer chose unsupported protocol version %v", hello.versions)
+	}
+	if err = session.messageHandler.HandleReceivedPublicKey(hello.key); err != nil {
+		return sessionErrorf(ERRORPROTOCOL, "%v", err)
+	}
+
+	session.version = hello.versions[0]
+	session.features = pairingFeatures(session, hello.features, app)
+	session.peerFingerprint = fingerprint(session.messageHandler.publicKeyClient)
+
+	if netClient.refuseRevoked(session, session.peerFingerprint, app) {
+		return sessionErrorf(ERRORREVOKED, "Public key %s is revoked", session.peerFingerprint)
+	}
+	if err := checkCertificatePin(session, session.peerFingerprint); err != nil {
+		return err
+	}
+
+	if err = session.pake.finish(element, session.helloTranscript, data); err != nil {
+		return sessionErrorf(ERRORAUTHENTICATION, "%v", err)
+	}
+	if err = session.pake.verify(confirmation); err != nil {
+		app.ShowStatus(fmt.Sprintf("Pairing with %s failed: wrong code", session))
+		return sessionErrorf(ERRORAUTHENTICATION, "Wrong pairing code")
+	}
+
+	if err = session.writePacket(PAIRCONFIRM, session.pake.confirmation); err != nil {
+		return err
+	}
+	netClient.finishPairing(session, app)
+	return nil
+}
+
+//handlePairConfirm checks that peer knows pairing code. Session is established then
+func (netClient *NetClient) handlePairConfirm(session *Session, payload []byte, app *GUIApp) error {
+	if session.pake == nil {
+		return sessionErrorf(ERRORPROTOCOL, "Unexpected pairing confirmation")
+	}
+	if err := session.pake.verify(payload); err != nil {
+		app.ShowStatus(fmt.Sprintf("Pairing with %s failed: wrong code", session))
+		return sessionErrorf(ERRORAUTHENTICATION, "Wrong pairing code")
+	}
+	netClient.finishPairing(session, app)
+	return nil
+}
+
+//pairingFeatures returns features of paired session. Session key is agreed by SPAKE2 alone, hybrid key exchange isn't done when pairing
+func pairingFeatures(session *Session, advertised featureflags, app *GUIApp) featureflags {
+	features := advertised & supportedFeatures
+	if features&FEATUREHYBRIDKEM != 0 {
+		app.ShowStatus(fmt.Sprintf("Pairing with %s doesn't use hybrid X25519 + ML-KEM-768 key exchange, session key is agreed by SPAKE2 only", session))
+	}
+	return features &^ FEATUREHYBRIDKEM
+}
+
+//finishPairing sets session keys agreed by SPAKE2 and remembers peer as known
+func (netClient *NetClient) finishPairing(session *Session, app *GUIApp) {
+	exchange := session.pake
+	session.pake = nil
+
+	encMess := &session.messageHandler
+	encMess.alghorytm = 0
+	encMess.keySize = uint32(len(exchange.aesKey))
+	encMess.blockSize = uint32(len(exchange.iv))
+	encMess.aesKey, encMess.iv = exchange.aesKey, exchange.iv
+	exchange.wipe()
+
+	if err := netClient.acceptPolicy.knownPeers.Add(session.peerFingerprint, session.remoteAddr); err != nil {
+		fmt.Println(err)
+	}
+	app.ShowStatus(fmt.Sprintf("Paired with %s, public key SHA-256 hash: %s", session, session.peerFingerprint))
+	session.enableAuthentication()
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSPAKE2(t *testing.T) {
+	if !pairingSupported {
+		t.Skip("Pairing with code is not available")
+	}
+	initiatorID, responderID := []byte("pair"), []byte("pair response")
+	for _, password := range []string{"7-crossword-orbit", "8-crossword-orbit"} {
+		initiator, err := spake2Init(true, "7-crossword-orbit")
+		if err != nil {
+			t.Fatal(err)
+		}
+		responder, err := spake2Init(false, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = responder.finish(initiator.element, initiatorID, responderID); err != nil {
+			t.Fatal(err)
+		}
+		if err = initiator.finish(responder.element, initiatorID, responderID); err != nil {
+			t.Fatal(err)
+		}
+
+		same := password == "7-crossword-orbit"
+		if (initiator.verify(responder.confirmation) == nil) != same || (responder.verify(initiator.confirmation) == nil) != same {
+			t.Errorf("%s: Confirmation should be accepted only with the same password", password)
+		}
+		if bytes.Equal(initiator.aesKey, responder.aesKey) != same || len(initiator.iv) != 16 {
+			t.Errorf("%s: Keys should be the same only with the same password", password)
+		}
+	}
+
+	//Identities are part of transcript
+	initiator, _ := spake2Init(true, "1-a-b")
+	responder, _ := spake2Init(false, "1-a-b")
+	responder.finish(initiator.element, initiatorID, responderID)
+	initiator.finish(responder.element, []byte("forged"), responderID)
+	if initiator.verify(responder.confirmation) == nil {
+		t.Error("Confirmation should be refused if identities differ")
+	}
+
+	if err := initiator.finish([]byte("not a point"), initiatorID, responderID); err == nil {
+		t.Error("Element which is not point should be refused")
+	}
+}
+
+func TestParsePairingCode(t *testing.T) {
+	cases := map[string][2]string{
+		"7-crossword-orbit":    {"7", "7-crossword-orbit"},
+		" 42 Crossword  ORBIT": {"42", "42-crossword-orbit"},
+		"3-x":                  {"3", "3-x"},
+	}
+	for code, expected := range cases {
+		nameplate, normalized, err := parsePairingCode(code)
+		if err != nil || nameplate != expected[0] || normalized != expected[1] {
+			t.Errorf("%q: expected %v, got %s %s %v", code, expected, nameplate, normalized, err)
+		}
+	}
+	for _, code := range []string{"", "7", "crossword-orbit", "0-a-b", "100-a-b"} {
+		if _, _, err := parsePairingCode(code); err == nil {
+			t.Errorf("%q should not be accepted", code)
+		}
+	}
+}
+
+func TestPairings(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, word := range pairingWords {
+		if seen[word] || word == "" || strings.ContainsAny(word, "- ") {
+			t.Errorf("Word %q is not unique or contains separator", word)
+		}
+		seen[word] = true
+	}
+	if len(pairingWords) != 256 {
+		t.Errorf("Expected 256 words, got %d", len(pairingWords))
+	}
+
+	pairings := PairingsInit()
+	nameplates := make(map[string]bool)
+	for i := 0; i < maxNameplate; i++ {
+		code, err := pairings.Generate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		nameplate, normalized, err := parsePairingCode(code)
+		if err != nil || normalized != code || nameplates[nameplate] {
+			t.Fatalf("Code %s is malformed or its nameplate is used: %v", code, err)
+		}
+		nameplates[nameplate] = true
+	}
+	if _, err := pairings.Generate(); err == nil {
+		t.Error("All nameplates are used, code should not be generated")
+	}
+
+	//Code can be taken once
+	if code, ok := pairings.Take("7"); !ok || !strings.HasPrefix(code, "7-") {
+		t.Errorf("Code with nameplate 7 should be taken, got %s", code)
+	}
+	if _, ok := pairings.Take("7"); ok {
+		t.Error("Code should be taken only once")
+	}
+
+	defer func(timeout time.Duration) { pairingCodeTimeout = timeout }(pairingCodeTimeout)
+	pairingCodeTimeout = -time.Second
+	pairings = PairingsInit()
+	code, _ := pairings.Generate()
+	if nameplate, _, _ := parsePairingCode(code); func() bool { _, ok := pairings.Take(nameplate); return ok }() {
+		t.Error("Expired code should not be taken")
+	}
+}
+
+//testPair pairs clients using code generated by responder and returns if both sessions were established.
+//Responder must be listening on address
+func testPair(t *testing.T, initiator *NetClient, responder *NetClient, address string, code string) bool {
+	var nullGuiApp GUIApp
+	sessionID, err := initiator.Pair(address, code, &nullGuiApp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer initiator.Disconnect(sessionID, &nullGuiApp)
+
+	//Session is either established or closed because pairing failed
+	finished := func() bool {
+		for _, session := range initiator.Sessions() {
+			if session.id == sessionID {
+				return initiator.IsConnected(sessionID) && responder.IsConnected(responder.ActiveSession())
+			}
+		}
+		return true
+	}
+	return waitFor(finished) && initiator.IsConnected(sessionID)
+}
+
+func TestPairAndSendMessage(t *testing.T) {
+	if !pairingSupported {
+		t.Skip("Pairing with code is not available")
+	}
+	var nullGuiApp GUIApp
+	initiator, responder := testNetClient(t), testNetClient(t)
+	defer os.RemoveAll(initiator.receiveDir)
+	defer os.RemoveAll(responder.receiveDir)
+
+	//Peers are accepted because they know the code, even if accept policy rejects everyone
+	responder.acceptPolicy, _ = AcceptPolicyInit("reject", "", nil)
+	knownPeers, err := KnownPeersLoad(responder.receiveDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder.acceptPolicy.knownPeers = knownPeers
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go responder.serveListener(listener, &nullGuiApp)
+
+	code, err := responder.NewPairingCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Wrong guess uses the code up
+	nameplate, _, _ := parsePairingCode(code)
+	if testPair(t, initiator, responder, listener.Addr().String(), nameplate+"-wrong-guess") {
+		t.Fatal("Pairing with wrong code should fail")
+	}
+	if testPair(t, initiator, responder, listener.Addr().String(), code) {
+		t.Fatal("Code should be used up by wrong guess")
+	}
+
+	code, _ = responder.NewPairingCode()
+	sessionID, err := initiator.Pair(listener.Addr().String(), strings.ToUpper(code), &nullGuiApp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer initiator.Disconnect(sessionID, &nullGuiApp)
+	established := func() bool {
+		return initiator.IsConnected(sessionID) && responder.IsConnected(responder.ActiveSession())
+	}
+	if !waitFor(established) {
+		t.Fatal("Paired session was not established")
+	}
+
+	initiatorSession, _ := initiator.establishedSession(sessionID)
+	responderSession, _ := responder.establishedSession(responder.ActiveSession())
+	if !bytes.Equal(initiatorSession.messageHandler.aesKey, responderSession.messageHandler.aesKey) {
+		t.Error("Paired peers should have the same session key")
+	}
+	if (initiatorSession.features|responderSession.features)&FEATUREHYBRIDKEM != 0 {
+		t.Error("Paired session should not report hybrid key exchange it didn't do")
+	}
+	if err = initiator.SendTextMessage(sessionID, "paired", &nullGuiApp); err != nil {
+		t.Error(err)
+	}
+	if !knownPeers.IsKnown(fingerprint(initiator.messageHandler.myPublicKey)) {
+		t.Error("Paired peer should become known peer")
+	}
+}
+
+func TestPairThroughRelay(t *testing.T) {
+	if !pairingSupported {
+		t.Skip("Pairing with code is not available")
+	}
+	relay, relayAddress := testRelay(t)
+	defer relay.Close()
+
+	var nullGuiApp GUIApp
+	first, second := testNetClient(t), testNetClient(t)
+	defer os.RemoveAll(first.receiveDir)
+	defer os.RemoveAll(second.receiveDir)
+
+	code, err := first.NewPairingCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionIDs := make(chan uint32, 2)
+	for _, netClient := range []*NetClient{first, second} {
+		go func(netClient *NetClient) {
+			sessionID, err := netClient.Pair(relayAddress, code, &nullGuiApp)
+			if err != nil {
+				t.Error(err)
+			}
+			sessionIDs <- sessionID
+		}(netClient)
+	}
+	if <-sessionIDs == 0 || <-sessionIDs == 0 {
+		t.FailNow()
+	}
+	defer first.DisconnectAll(&nullGuiApp)
+
+	established := func() bool {
+		return first.IsConnected(first.ActiveSession()) && second.IsConnected(second.ActiveSession())
+	}
+	if !waitFor(established) {
+		t.Fatal("Paired session through relay was not established")
+	}
+
+	//Code used through relay doesn't wait for direct connection
+	nameplate, _, _ := parsePairingCode(code)
+	if _, ok := first.pairings.Take(nameplate); ok {
+		t.Error("Code should be used up by relay pairing")
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+//Length of confirmation MAC sent after SPAKE2 exchange
+const spake2ConfirmationLen = sha256.Size
+
+var errPairingUnsupported = errors.New("spake2: Pairing with code needs Go 1.24 or newer")
+
+//spake2 is one side of SPAKE2 exchange (RFC 9382) over P-256. Both sides get the same keys only if they used the same password.
+//Peer which doesn't know password learns nothing about it except that its single guess was wrong. Group operations are in pake_p256.go
+type spake2 struct {
+	initiator bool
+	//Password scalar, our secret scalar and our element
+	w       []byte
+	secret  []byte
+	element []byte
+	//Keys derived after peer element is received
+	aesKey []byte
+	iv     []byte
+	//Confirmation sent to peer and one expected from peer
+	confirmation     []byte
+	peerConfirmation []byte
+}
+
+//deriveKeys derives session key, IV and confirmations from transcript of exchange with shared point.
+//Transcript contains identities (PAIR and PAIRRESPONSE data) of both sides, so they can't be changed unnoticed
+func (exchange *spake2) deriveKeys(peerElement []byte, shared []byte, initiatorID []byte, responderID []byte) {
+	initiatorElement, responderElement := exchange.element, peerElement
+	if !exchange.initiator {
+		initiatorElement, responderElement = peerElement, exchange.element
+	}
+	transcript := new(bytes.Buffer)
+	for _, part := range [][]byte{initiatorID, responderID, initiatorElement, responderElement, shared, exchange.w} {
+		binary.Write(transcript, endianness, uint64(len(part)))
+		transcript.Write(part)
+	}
+	secret := sha256.Sum256(transcript.Bytes())
+
+	exchange.aesKey = pakeKey(secret[:], "session key")
+	exchange.iv = pakeKey(secret[:], "session iv")[:16]
+	ourKey, peerKey := pakeKey(secret[:], "initiator confirmation"), pakeKey(secret[:], "responder confirmation")
+	if !exchange.initiator {
+		ourKey, peerKey = peerKey, ourKey
+	}
+	exchange.confirmation = pakeKey(ourKey, string(transcript.Bytes()))
+	exchange.peerConfirmation = pakeKey(peerKey, string(transcript.Bytes()))
+}
+
+//verify checks confirmation sent by peer. It's right only if peer used the same password
+func (exchange *spake2) verify(confirmation []byte) error {
+	if exchange.peerConfirmation == nil || !hmac.Equal(confirmation, exchange.peerConfirmation) {
+		return errors.New("spake2: Wrong key confirmation")
+	}
+	return nil
+}
+
+//wipe zeroes secrets of exchange. Session keys are left to session
+func (exchange *spake2) wipe() {
+	for _, secret := range [][]byte{exchange.confirmation, exchange.peerConfirmation, exchange.secret, exchange.w} {
+		for i := range secret {
+			secret[i] = 0
+		}
+	}
+}
+
+//pakeKey derives key for given purpose from secret
+func pakeKey(secret []byte, label string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
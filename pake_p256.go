@@ -0,0 +1,97 @@
+//go:build go1.24
+// +build go1.24
+
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+
+	"filippo.io/nistec"
+)
+
+//P-256 group of SPAKE2 comes from filippo.io/nistec, whose operations are constant time. It needs Go 1.24, so does pairing with code
+const pairingSupported = true
+
+//Points M and N blinding elements of initiator and responder. They are hashed to curve, so nobody knows their discrete logarithms
+var spake2M, spake2N = hashToPoint("sstt SPAKE2 M"), hashToPoint("sstt SPAKE2 N")
+
+//hashToPoint returns first point of curve with even y whose x coordinate is hash of seed and counter
+func hashToPoint(seed string) *nistec.P256Point {
+	for counter := byte(0); ; counter++ {
+		hash := sha256.Sum256(append([]byte(seed), counter))
+		if point, err := nistec.NewP256Point().SetBytes(append([]byte{2}, hash[:]...)); err == nil {
+			return point
+		}
+	}
+}
+
+//passwordScalar returns scalar of password. Hashes which are not valid scalar are skipped, so it's uniform and needs no reduction
+func passwordScalar(password string) []byte {
+	for counter := byte(0); ; counter++ {
+		hash := sha256.Sum256(append([]byte{counter}, "sstt pairing password "+password...))
+		if _, err := ecdh.P256().NewPrivateKey(hash[:]); err == nil {
+			return hash[:]
+		}
+	}
+}
+
+//spake2Init computes our element from password
+func spake2Init(initiator bool, password string) (*spake2, error) {
+	secret, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	w := passwordScalar(password)
+
+	//X = x*G + w*M for initiator, Y = y*G + w*N for responder
+	blind := spake2M
+	if !initiator {
+		blind = spake2N
+	}
+	element, err := nistec.NewP256Point().SetBytes(secret.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	blinded, err := nistec.NewP256Point().ScalarMult(blind, w)
+	if err != nil {
+		return nil, err
+	}
+	element.Add(element, blinded)
+
+	return &spake2{initiator: initiator, w: w, secret: secret.Bytes(), element: element.Bytes()}, nil
+}
+
+//finish computes shared point from peer element and derives keys from transcript
+func (exchange *spake2) finish(peerElement []byte, initiatorID []byte, responderID []byte) error {
+	//Only uncompressed points are taken, SetBytes accepts encoded identity too
+	if len(peerElement) != spake2ElementLen {
+		return errors.New("spake2: Peer element is not point of curve")
+	}
+	peer, err := nistec.NewP256Point().SetBytes(peerElement)
+	if err != nil {
+		return errors.New("spake2: Peer element is not point of curve")
+	}
+
+	//K = x*(Y - w*N) for initiator, K = y*(X - w*M) for responder
+	blind := spake2N
+	if !exchange.initiator {
+		blind = spake2M
+	}
+	blinded, err := nistec.NewP256Point().ScalarMult(blind, exchange.w)
+	if err != nil {
+		return err
+	}
+	shared, err := nistec.NewP256Point().ScalarMult(peer.Add(peer, blinded.Negate(blinded)), exchange.secret)
+	if err != nil {
+		return err
+	}
+	if shared.IsInfinity() == 1 {
+		return errors.New("spake2: Shared point is identity")
+	}
+
+	exchange.deriveKeys(peerElement, shared.Bytes(), initiatorID, responderID)
+	return nil
+}
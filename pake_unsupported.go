@@ -0,0 +1,15 @@
+//go:build !go1.24
+// +build !go1.24
+
+package main
+
+//Constant time P-256 group of SPAKE2 (filippo.io/nistec) needs Go 1.24, so pairing with code is not available
+const pairingSupported = false
+
+func spake2Init(initiator bool, password string) (*spake2, error) {
+	return nil, errPairingUnsupported
+}
+
+func (exchange *spake2) finish(peerElement []byte, initiatorID []byte, responderID []byte) error {
+	return errPairingUnsupported
+}
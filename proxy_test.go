@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestProxyInit(t *testing.T) {
+	cases := map[string]string{
+		"socks5://127.0.0.1":            "socks5://127.0.0.1:1080",
+		"socks5://user:pass@[::1]:9050": "socks5://[::1]:9050",
+		"http://proxy.example.com":      "http://proxy.example.com:8080",
+		"http://proxy:3128":             "http://proxy:3128",
+	}
+	for proxyURL, expected := range cases {
+		if proxy, err := ProxyInit(proxyURL); err != nil || proxy.String() != expected {
+			t.Errorf("%s: expected %s, got %v %v", proxyURL, expected, proxy, err)
+		}
+	}
+
+	for _, proxyURL := range []string{"", "https://proxy:3128", "socks4://proxy", "socks5://", "http://proxy:port"} {
+		if _, err := ProxyInit(proxyURL); err == nil {
+			t.Errorf("%q should not be accepted", proxyURL)
+		}
+	}
+}
+
+//pipeConnections copies data between connections until one of them is closed
+func pipeConnections(client io.ReadWriter, clientConn net.Conn, target net.Conn) {
+	defer clientConn.Close()
+	defer target.Close()
+	go io.Copy(target, client)
+	io.Copy(client, target)
+}
+
+//serveSOCKS5 is minimal SOCKS5 proxy for tests. It requires username and password if they are not empty
+func serveSOCKS5(listener net.Listener, username string, password string) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			if target := socksHandshake(conn, username, password); target != nil {
+				pipeConnections(conn, conn, target)
+			} else {
+				conn.Close()
+			}
+		}(conn)
+	}
+}
+
+//socksHandshake answers SOCKS5 client and returns connection to requested address, nil on failure
+func socksHandshake(conn net.Conn, username string, password string) net.Conn {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return nil
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil
+	}
+
+	if username == "" {
+		conn.Write([]byte{socksVersion, socksNoAuth})
+	} else {
+		conn.Write([]byte{socksVersion, socksPasswordAuth})
+		//Version and username length come first, password length alone
+		credentials := make([][]byte, 2)
+		for i := range credentials {
+			length := make([]byte, 2)
+			if _, err := io.ReadFull(conn, length[i:]); err != nil {
+				return nil
+			}
+			credentials[i] = make([]byte, length[1])
+			if _, err := io.ReadFull(conn, credentials[i]); err != nil {
+				return nil
+			}
+		}
+		if string(credentials[0]) != username || string(credentials[1]) != password {
+			conn.Write([]byte{socksPasswordVer, 1})
+			return nil
+		}
+		conn.Write([]byte{socksPasswordVer, socksSucceeded})
+	}
+
+	request := make([]byte, socksReplyHeadSize)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return nil
+	}
+	var host string
+	switch request[3] {
+	case socksIPv4, socksIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if request[3] == socksIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return nil
+		}
+		host = ip.String()
+	case socksDomain:
+		length := make([]byte, 1)
+		io.ReadFull(conn, length)
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return nil
+		}
+		host = string(domain)
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return nil
+	}
+
+	target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+	if err != nil {
+		//General failure
+		conn.Write([]byte{socksVersion, 1, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+		return nil
+	}
+	conn.Write([]byte{socksVersion, socksSucceeded, 0, socksIPv4, 127, 0, 0, 1, 0, 0})
+	return target
+}
+
+//serveHTTPConnect is minimal HTTP CONNECT proxy for tests requiring given Proxy-Authorization header if it's not empty
+func serveHTTPConnect(listener net.Listener, authorization string) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			reader := bufio.NewReader(conn)
+			request, err := http.ReadRequest(reader)
+			if err != nil || request.Method != "CONNECT" {
+				conn.Close()
+				return
+			}
+			if authorization != "" && request.Header.Get("Proxy-Authorization") != authorization {
+				conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+				conn.Close()
+				return
+			}
+			target, err := net.Dial("tcp", request.Host)
+			if err != nil {
+				conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+				conn.Close()
+				return
+			}
+			conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+			pipeConnections(&bufferedConn{Conn: conn, reader: reader}, conn, target)
+		}(conn)
+	}
+}
+
+//testProxy starts proxy stand-in served by serve on loopback and returns its listener
+func testProxy(t *testing.T, serve func(net.Listener)) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serve(listener)
+	return listener
+}
+
+func TestHandshakeAndFileThroughSOCKS5Proxy(t *testing.T) {
+	proxyListener := testProxy(t, func(listener net.Listener) { serveSOCKS5(listener, "user", "secret") })
+	defer proxyListener.Close()
+
+	proxy, err := ProxyInit("socks5://user:secret@" + proxyListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Host name is resolved by proxy
+	testTransfer(t, listener, "localhost:"+strconv.Itoa(listener.Addr().(*net.TCPAddr).Port), func(initiator *NetClient, responder *NetClient) {
+		initiator.SetProxy(proxy)
+	})
+}
+
+func TestHandshakeAndFileThroughHTTPProxy(t *testing.T) {
+	//Basic authorization of user:secret
+	proxyListener := testProxy(t, func(listener net.Listener) { serveHTTPConnect(listener, "Basic dXNlcjpzZWNyZXQ=") })
+	defer proxyListener.Close()
+
+	proxy, err := ProxyInit("http://user:secret@" + proxyListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testTransfer(t, listener, listener.Addr().String(), func(initiator *NetClient, responder *NetClient) {
+		initiator.SetProxy(proxy)
+	})
+}
+
+func TestProxyRefusesWrongCredentials(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	socksListener := testProxy(t, func(listener net.Listener) { serveSOCKS5(listener, "user", "secret") })
+	defer socksListener.Close()
+	httpListener := testProxy(t, func(listener net.Listener) { serveHTTPConnect(listener, "Basic dXNlcjpzZWNyZXQ=") })
+	defer httpListener.Close()
+
+	for _, proxyURL := range []string{"socks5://user:wrong@" + socksListener.Addr().String(), "socks5://" + socksListener.Addr().String(),
+		"http://user:wrong@" + httpListener.Addr().String(), "http://" + httpListener.Addr().String()} {
+		proxy, err := ProxyInit(proxyURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn, err := proxy.Dial("tcp", target.Addr().String()); err == nil {
+			conn.Close()
+			t.Errorf("%s should refuse connection", proxyURL)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"time"
+)
+
+//Session keys of a direction are updated after this many bytes are sent or this much time passes. Set from command line
+var rekeyAfterBytes int64 = 1 << 30
+var rekeyAfterTime = time.Hour
+
+//directionKeys are keys used for data sent in one direction of session
+type directionKeys struct {
+	aesKey     []byte
+	iv         []byte
+	macKey     []byte
+	cipherMode cipherblockmode
+	//Direction name mixed into its keys
+	label string
+	//Number of key updates done
+	generation uint32
+}
+
+//directionKeysInit derives key, IV and MAC key of direction named by label from session key and IV, so no two directions share any of them
+func directionKeysInit(aesKey []byte, iv []byte, cipherMode cipherblockmode, label string) *directionKeys {
+	secret := append(append([]byte{}, aesKey...), iv...)
+	keys := &directionKeys{cipherMode: cipherMode, label: label}
+	keys.aesKey = deriveKey(secret, "sstt "+label+" key", len(aesKey))
+	keys.iv = deriveKey(secret, "sstt "+label+" iv", len(iv))
+	keys.macKey = deriveKey(secret, "sstt "+label+" mac", sha256.Size)
+	zeroize(secret)
+	return keys
+}
+
+func (keys *directionKeys) secret() []byte {
+	return append(append([]byte{}, keys.aesKey...), keys.iv...)
+}
+
+//ratchet replaces keys with ones derived from them. Old keys are overwritten so they can't be recovered from new ones
+func (keys *directionKeys) ratchet() {
+	secret := keys.secret()
+	aesKey := deriveKey(secret, "sstt key update", len(keys.aesKey))
+	iv := deriveKey(secret, "sstt iv update", len(keys.iv))
+
+	zeroize(secret)
+	zeroize(keys.aesKey)
+	zeroize(keys.iv)
+	zeroize(keys.macKey)
+
+	keys.aesKey, keys.iv = aesKey, iv
+	keys.macKey = deriveKey(keys.secret(), "sstt "+keys.label+" mac", sha256.Size)
+	keys.generation++
+}
+
+//wipe overwrites keys when session is over
+func (keys *directionKeys) wipe() {
+	zeroize(keys.aesKey)
+	zeroize(keys.iv)
+	zeroize(keys.macKey)
+}
+
+//snapshot returns copy of keys which stays valid after ratchet
+func (keys *directionKeys) snapshot() *directionKeys {
+	return &directionKeys{aesKey: append([]byte{}, keys.aesKey...), iv: append([]byte{}, keys.iv...), cipherMode: keys.cipherMode,
+		label: keys.label, generation: keys.generation}
+}
+
+//deriveKey returns length bytes of HMAC-SHA256 of label and counter keyed with secret
+func deriveKey(secret []byte, label string, length int) []byte {
+	out := make([]byte, 0, length+sha256.Size)
+	for counter := byte(1); len(out) < length; counter++ {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(label))
+		mac.Write([]byte{counter})
+		out = mac.Sum(out)
+	}
+	return out[:length]
+}
+
+func zeroize(data []byte) {
+	for i := range data {
+		data[i] = 0
+	}
+}
+
+//rekeyDue returns true if send keys should be updated. writeMutex must be locked
+func (session *Session) rekeyDue() bool {
+	return !session.rekeying && (session.sentBytes >= rekeyAfterBytes || time.Since(session.lastRekey) >= rekeyAfterTime)
+}
+
+//UpdateSendKeys sends KEYUPDATE frame and ratchets keys of frames we send. Data encrypted meanwhile is sent before the update
+// Schema of frame
+// |generation uint32|
+func (session *Session) UpdateSendKeys() error {
+	session.keyMutex.Lock()
+	defer session.keyMutex.Unlock()
+
+	session.writeMutex.Lock()
+	defer session.writeMutex.Unlock()
+
+	session.rekeying = false
+	if session.auth == nil {
+		return errors.New("Session.UpdateSendKeys: Session key is not agreed yet")
+	}
+
+	payload := make([]byte, 4)
+	endianness.PutUint32(payload, session.auth.send.generation+1)
+	frame := Frame{version: session.version, ptype: KEYUPDATE, payload: payload}
+	session.auth.seal(&frame)
+
+	if err := session.send(frame); err != nil {
+		return err
+	}
+
+	session.auth.send.ratchet()
+	session.sentBytes = 0
+	session.lastRekey = time.Now()
+
+	return nil
+}
+
+//updateReceiveKeys ratchets keys of frames we receive after peer sent KEYUPDATE
+func (session *Session) updateReceiveKeys(payload []byte) error {
+	if len(payload) != 4 {
+		return sessionErrorf(ERRORPROTOCOL, "Wrong key update frame length %d", len(payload))
+	}
+
+	generation := endianness.Uint32(payload)
+
+	if generation != session.auth.recv.generation+1 {
+		return sessionErrorf(ERRORPROTOCOL, "Key update to generation %d, expected %d", generation, session.auth.recv.generation+1)
+	}
+
+	session.auth.recv.ratchet()
+	fmt.Printf("Session %s: peer updated keys to generation %d\n", session, generation)
+
+	return nil
+}
+
+//writeEncrypted encrypts payload with current send keys and sends it. Keys are not updated until frame is written
+func (session *Session) writeEncrypted(ptype packettype, encrypt func(keys *directionKeys) ([]byte, error)) error {
+	return session.writeEncryptedFrame(ptype, 0, encrypt)
+}
+
+//writeEncryptedFrame is writeEncrypted of frame with flags. It waits until our cipher mode request is answered
+func (session *Session) writeEncryptedFrame(ptype packettype, flags byte, encrypt func(keys *directionKeys) ([]byte, error)) error {
+	session.keyMutex.RLock()
+	for session.modeSwitch != nil {
+		switched := session.modeSwitch
+		session.keyMutex.RUnlock()
+		select {
+		case <-switched:
+		case <-session.done:
+			return errors.New("Session.writeEncrypted: Session closed")
+		}
+		session.keyMutex.RLock()
+	}
+	defer session.keyMutex.RUnlock()
+
+	if session.auth == nil {
+		return errors.New("Session.writeEncrypted: Session key is not agreed yet")
+	}
+
+	payload, err := encrypt(session.auth.send)
+	if err != nil {
+		return err
+	}
+
+	return session.writeFrame(ptype, flags, payload)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+)
+
+//authenticatedSessionPair returns two sessions connected by pipe with agreed session key
+func authenticatedSessionPair() (*Session, *Session) {
+	initiatorConn, responderConn := net.Pipe()
+	initiator := sessionInit(initiatorConn, "responder")
+	responder := sessionInit(responderConn, "initiator")
+
+	key, iv := make([]byte, 32), make([]byte, 16)
+	GenerateKey(key)
+	GenerateIV(iv)
+
+	for _, session := range []*Session{initiator, responder} {
+		session.version = supportedVersions[0]
+		session.messageHandler = EncryptedMessageHandler(32, CBC)
+		session.messageHandler.aesKey = key
+		session.messageHandler.iv = iv
+	}
+	initiator.initiator = true
+	initiator.enableAuthentication()
+	responder.enableAuthentication()
+
+	return initiator, responder
+}
+
+func TestDirectionKeys(t *testing.T) {
+	key, iv := []byte("0123456789abcdef0123456789abcdef"), []byte("0123456789abcdef")
+	initiator := directionKeysInit(key, iv, CBC, "initiator")
+	responder := directionKeysInit(key, iv, CBC, "responder")
+
+	//Directions share no key even if handshake agreed one for both
+	if bytes.Equal(initiator.aesKey, responder.aesKey) || bytes.Equal(initiator.iv, responder.iv) || bytes.Equal(initiator.macKey, responder.macKey) {
+		t.Error("Directions should have different keys")
+	}
+	if bytes.Equal(initiator.aesKey, key) || bytes.Equal(initiator.iv, iv) || len(initiator.aesKey) != len(key) || len(initiator.iv) != len(iv) {
+		t.Error("Direction keys should be derived from session key with the same length")
+	}
+	if again := directionKeysInit(key, iv, CBC, "initiator"); !bytes.Equal(again.aesKey, initiator.aesKey) || !bytes.Equal(again.iv, initiator.iv) {
+		t.Error("Both sides should derive the same keys of direction")
+	}
+}
+
+func TestRatchet(t *testing.T) {
+	key, iv := []byte("0123456789abcdef0123456789abcdef"), []byte("0123456789abcdef")
+	sent := directionKeysInit(key, iv, CBC, "initiator")
+	received := directionKeysInit(key, iv, CBC, "initiator")
+	old := sent.snapshot()
+
+	sent.ratchet()
+	received.ratchet()
+
+	if !bytes.Equal(sent.aesKey, received.aesKey) || !bytes.Equal(sent.iv, received.iv) || !bytes.Equal(sent.macKey, received.macKey) {
+		t.Error("Both sides should derive the same keys")
+	}
+
+	if bytes.Equal(sent.aesKey, old.aesKey) || bytes.Equal(sent.iv, old.iv) || sent.generation != 1 {
+		t.Error("Ratchet should change keys and generation")
+	}
+}
+
+func TestRekeyDuringMessages(t *testing.T) {
+	savedBytes := rekeyAfterBytes
+	rekeyAfterBytes = 200
+	defer func() {
+		rekeyAfterBytes = savedBytes
+	}()
+
+	initiator, responder := authenticatedSessionPair()
+	defer initiator.Close()
+	defer responder.Close()
+
+	var nullGuiApp GUIApp
+	received := make(chan string)
+	//Reader sends generation of receive keys when session is closed, so it's not read while reader ratchets it
+	generation := make(chan uint32, 1)
+	go func() {
+		for {
+			frame, err := responder.readFrame()
+			if err != nil {
+				generation <- responder.auth.recv.generation
+				close(received)
+				return
+			}
+
+			switch frame.ptype {
+			case KEYUPDATE:
+				err = responder.updateReceiveKeys(frame.payload)
+			case TEXTMESSAGE:
+				var message string
+				message, err = responder.messageHandler.HandleTextMessage(frame.payload, responder.auth.recv, &nullGuiApp)
+				received <- message
+			}
+
+			if err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		message := fmt.Sprintf("message %d", i)
+		go initiator.writeEncrypted(TEXTMESSAGE, func(keys *directionKeys) ([]byte, error) {
+			return initiator.messageHandler.GenerateTextMessage(message, keys, &nullGuiApp)
+		})
+
+		if got := <-received; got != message {
+			t.Fatalf("Expected %q, got %q", message, got)
+		}
+	}
+
+	responder.Close()
+	if <-generation == 0 {
+		t.Error("Keys should be updated after byte limit")
+	}
+}
+
+func TestKeyUpdateGeneration(t *testing.T) {
+	initiator, responder := authenticatedSessionPair()
+	defer initiator.Close()
+	defer responder.Close()
+
+	if err := responder.updateReceiveKeys([]byte{0, 0, 0, 2}); err == nil {
+		t.Error("Skipped key generation should be refused")
+	}
+
+	if err := responder.updateReceiveKeys([]byte{0, 0, 0, 1}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Preface of connection to relay. It differs from magicnumber so relay and peer can't be confused
+const relaymagic uint32 = 0x1337AB4E
+
+//How long peer waits on relay for other peer with the same session code
+var relayWaitTimeout = 5 * time.Minute
+
+//Most peers waiting on relay for other peer at once. Set from command line. Peers joining them need room in maxIncomingConnections
+var maxRelayWaiting = 32
+
+const maxRelayCodeLength = 64
+
+//relayrole tells peer paired by relay which side of handshake it is
+type relayrole byte
+
+// Structure representing roles assigned by relay
+const (
+	//Peer waited for other one. It answers HELLO
+	RELAYRESPONDER = iota
+	//Peer joined waiting one. It sends HELLO
+	RELAYINITIATOR
+)
+
+//Relay pairs peers which connect to it with the same session code and forwards bytes between them. Peers don't have to be reachable
+//from each other. Frames are end-to-end encrypted, relay never sees session keys
+// Schema of relay request sent by peer
+// |relaymagic uint32|codeLength byte|code [codeLength]byte|
+// Schema of relay answer sent when other peer joins
+// |role byte|
+type Relay struct {
+	mutex sync.Mutex
+	//Peers waiting for other one by session code
+	waiting   map[string]*relayWaiter
+	listeners []net.Listener
+	//Incoming connections being served, waiting and paired ones
+	incoming int32
+	//Limits connection rate per IP address and bans addresses which send malformed requests
+	throttle *Throttle
+}
+
+//relayWaiter is peer waiting on relay. Peer which joins it is sent through channel
+type relayWaiter struct {
+	conn net.Conn
+	peer chan net.Conn
+}
+
+//RelayInit returns relay without listeners
+func RelayInit() *Relay {
+	return &Relay{waiting: make(map[string]*relayWaiter), throttle: ThrottleInit()}
+}
+
+//Listen opens listeners on bind addresses (see parseListenAddress) and pairs peers connecting to them in separate threads
+func (relay *Relay) Listen(addresses []string, defaultPort int) error {
+	listeners, err := listenAll(addresses, defaultPort)
+	if err != nil {
+		return err
+	}
+	relay.listeners = listeners
+
+	for _, listener := range listeners {
+		go relay.serve(listener)
+	}
+	return nil
+}
+
+//Addrs returns addresses of open listeners
+func (relay *Relay) Addrs() []net.Addr {
+	addrs := make([]net.Addr, 0, len(relay.listeners))
+	for _, listener := range relay.listeners {
+		addrs = append(addrs, listener.Addr())
+	}
+	return addrs
+}
+
+//Close closes listeners and connections of waiting peers. Peers already paired stay connected
+func (relay *Relay) Close() {
+	for _, listener := range relay.listeners {
+		listener.Close()
+	}
+	relay.listeners = nil
+
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+	for _, waiter := range relay.waiting {
+		waiter.conn.Close()
+	}
+}
+
+//serve accepts connections until listener is closed. Connections over rate and count limits are closed like in serveListener
+func (relay *Relay) serve(listener net.Listener) {
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if netError, ok := err.(net.Error); ok && netError.Temporary() {
+				fmt.Println(err)
+				continue
+			}
+			return
+		}
+
+		if err = relay.throttle.Allow(addressIP(conn.RemoteAddr()), time.Now()); err != nil {
+			fmt.Printf("Relay: %v\n", err)
+			conn.Close()
+			continue
+		}
+		if atomic.AddInt32(&relay.incoming, 1) > int32(maxIncomingConnections) {
+			atomic.AddInt32(&relay.incoming, -1)
+			fmt.Printf("Relay: Refused connection from %s: %d incoming connections already served\n", conn.RemoteAddr(), maxIncomingConnections)
+			conn.Close()
+			continue
+		}
+
+		go func() {
+			joined, err := relay.join(conn)
+			if err != nil {
+				fmt.Printf("Relay: %s: %v\n", conn.RemoteAddr(), err)
+				conn.Close()
+			}
+			//Connection of peer which joined waiting one is released by goroutine of waiting peer when they are unpaired
+			if !joined {
+				atomic.AddInt32(&relay.incoming, -1)
+			}
+		}()
+	}
+}
+
+//join reads relay request and pairs peer with one waiting for the same session code. Without such peer it waits for one.
+//Returns true if connection was handed over to waiting peer
+func (relay *Relay) join(conn net.Conn) (bool, error) {
+	conn.SetReadDeadline(time.Now().Add(prefaceTimeout))
+	code, err := readRelayRequest(conn)
+	if err != nil {
+		relay.throttle.Failure(addressIP(conn.RemoteAddr()), time.Now())
+		return false, err
+	}
+
+	//Deadline is set before peer can be found by joining one, so it can't overwrite deadline which wakes it up
+	conn.SetReadDeadline(time.Now().Add(relayWaitTimeout))
+
+	relay.mutex.Lock()
+	if waiter, ok := relay.waiting[code]; ok {
+		delete(relay.waiting, code)
+		waiter.peer <- conn
+		relay.mutex.Unlock()
+		//Wakes waiting peer up
+		waiter.conn.SetReadDeadline(time.Unix(1, 0))
+		return true, nil
+	}
+	if len(relay.waiting) >= maxRelayWaiting {
+		relay.mutex.Unlock()
+		return false, fmt.Errorf("%d peers already wait for other peer", maxRelayWaiting)
+	}
+	waiter := &relayWaiter{conn: conn, peer: make(chan net.Conn, 1)}
+	relay.waiting[code] = waiter
+	relay.mutex.Unlock()
+
+	//Peer sends nothing before it's paired, so read ends when it's paired, disconnects or waits too long
+	_, err = conn.Read(make([]byte, 1))
+
+	relay.mutex.Lock()
+	if relay.waiting[code] == waiter {
+		delete(relay.waiting, code)
+		relay.mutex.Unlock()
+		return false, errors.New("No peer joined with the same session code")
+	}
+	relay.mutex.Unlock()
+
+	peer := <-waiter.peer
+	defer atomic.AddInt32(&relay.incoming, -1)
+	if netError, ok := err.(net.Error); !ok || !netError.Timeout() {
+		peer.Close()
+		return false, errors.New("Peer left or sent data before other peer joined")
+	}
+
+	conn.SetReadDeadline(time.Time{})
+	peer.SetReadDeadline(time.Time{})
+	if _, err = conn.Write([]byte{RELAYRESPONDER}); err == nil {
+		_, err = peer.Write([]byte{RELAYINITIATOR})
+	}
+	if err != nil {
+		peer.Close()
+		return false, err
+	}
+
+	relayPipe(conn, peer)
+	return false, nil
+}
+
+//readRelayRequest reads relay preface and session code
+func readRelayRequest(conn net.Conn) (string, error) {
+	head := make([]byte, 5)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return "", err
+	}
+	if endianness.Uint32(head) != relaymagic {
+		return "", errors.New("Wrong relay magic number")
+	}
+	if head[4] == 0 || head[4] > maxRelayCodeLength {
+		return "", fmt.Errorf("Wrong session code length %d", head[4])
+	}
+
+	code := make([]byte, head[4])
+	if _, err := io.ReadFull(conn, code); err != nil {
+		return "", err
+	}
+	return string(code), nil
+}
+
+//relayPipe forwards bytes between paired peers until one of them disconnects
+func relayPipe(first net.Conn, second net.Conn) {
+	done := make(chan struct{}, 2)
+	forward := func(to net.Conn, from net.Conn) {
+		io.Copy(to, from)
+		done <- struct{}{}
+	}
+	go forward(first, second)
+	go forward(second, first)
+
+	<-done
+	first.Close()
+	second.Close()
+	<-done
+}
+
+//isRelayAddress returns true if address has relay:// scheme
+func isRelayAddress(address string) bool {
+	return strings.HasPrefix(strings.TrimSpace(address), "relay://")
+}
+
+//parseRelayAddress splits relay address into relay host:port and session code, e.g. relay://relay.example.com:27002/code
+func parseRelayAddress(address string) (relayAddress string, code string, err error) {
+	address = strings.TrimPrefix(strings.TrimSpace(address), "relay://")
+	i := strings.Index(address, "/")
+	if i < 0 {
+		return "", "", fmt.Errorf("parseRelayAddress: No session code in %s", address)
+	}
+
+	relayAddress, code = address[:i], address[i+1:]
+	if code == "" || len(code) > maxRelayCodeLength {
+		return "", "", fmt.Errorf("parseRelayAddress: Session code must have 1 to %d bytes", maxRelayCodeLength)
+	}
+
+	relayAddress, err = normalizeAddress(relayAddress, defaultPort)
+	return relayAddress, code, err
+}
+
+//joinRelay connects to relay (through proxy if set) and waits until other peer joins with the same session code.
+//Relay decides which of them sends HELLO (or PAIR if pairing code is given), the other one answers it like incoming connection
+func (netClient *NetClient) joinRelay(address string, pairingCode string, app *GUIApp) (uint32, error) {
+	relayAddress, code, err := parseRelayAddress(address)
+	if err != nil {
+		return 0, err
+	}
+
+	conn, err := netClient.proxy.Dial("tcp", relayAddress)
+	if err != nil {
+		return 0, err
+	}
+
+	request := make([]byte, 5, 5+len(code))
+	endianness.PutUint32(request, relaymagic)
+	request[4] = byte(len(code))
+	if _, err = conn.Write(append(request, code...)); err != nil {
+		conn.Close()
+		return 0, err
+	}
+
+	app.ShowStatus(fmt.Sprintf("Waiting for peer on relay %s", relayAddress))
+	conn.SetReadDeadline(time.Now().Add(relayWaitTimeout))
+	role := make([]byte, 1)
+	if _, err = io.ReadFull(conn, role); err != nil {
+		conn.Close()
+		return 0, fmt.Errorf("Relay %s: No peer joined: %v", relayAddress, err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	//Session code is secret, so it's not shown as address. TLS goes end-to-end through relay
+	remoteAddr := "relay://" + relayAddress
+	if relayrole(role[0]) == RELAYINITIATOR {
+		wrapped, err := netClient.tlsTransport.Client(conn)
+		if err != nil {
+			conn.Close()
+			return 0, err
+		}
+		session, err := initiateSession(wrapped, remoteAddr)
+		if err != nil {
+			return 0, err
+		}
+		if pairingCode != "" {
+			return netClient.sendPair(session, pairingCode, app)
+		}
+		return netClient.sendHello(session, app)
+	}
+
+	wrapped, err := netClient.tlsTransport.Server(conn)
+	if err != nil {
+		conn.Close()
+		return 0, err
+	}
+	session, err := respondSession(wrapped, remoteAddr)
+	if err != nil {
+		conn.Close()
+		return 0, err
+	}
+	session.pairingCode = pairingCode
+	netClient.startSession(session, false, app)
+	go netClient.serveSession(session, app)
+
+	return session.id, nil
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseRelayAddress(t *testing.T) {
+	cases := map[string][2]string{
+		"relay://relay.example.com/code": {"relay.example.com:27002", "code"},
+		"relay://[::1]:27010/a/b":        {"[::1]:27010", "a/b"},
+		"relay://127.0.0.1:1234/x":       {"127.0.0.1:1234", "x"},
+	}
+	for address, expected := range cases {
+		relayAddress, code, err := parseRelayAddress(address)
+		if err != nil || relayAddress != expected[0] || code != expected[1] {
+			t.Errorf("%s: expected %v, got %s %s %v", address, expected, relayAddress, code, err)
+		}
+	}
+
+	for _, address := range []string{"relay://host", "relay://host/", "relay:///code", "relay://host/" + string(make([]byte, 65))} {
+		if _, _, err := parseRelayAddress(address); err == nil {
+			t.Errorf("%q should not be accepted", address)
+		}
+	}
+}
+
+//testRelay starts relay on loopback and returns relay address without session code
+func testRelay(t *testing.T) (*Relay, string) {
+	relay := RelayInit()
+	if err := relay.Listen([]string{"127.0.0.1:0"}, defaultPort); err != nil {
+		t.Fatal(err)
+	}
+	return relay, "relay://" + relay.Addrs()[0].String()
+}
+
+func TestHandshakeAndFileThroughRelay(t *testing.T) {
+	relay, relayAddress := testRelay(t)
+	defer relay.Close()
+
+	var nullGuiApp GUIApp
+	first, second := testNetClient(t), testNetClient(t)
+	defer os.RemoveAll(first.receiveDir)
+	defer os.RemoveAll(second.receiveDir)
+
+	//Other peer waiting with different code is not paired with ours. It stops waiting when relay is closed
+	other := testNetClient(t)
+	defer os.RemoveAll(other.receiveDir)
+	otherDone := make(chan bool)
+	go func() {
+		other.SendHello(relayAddress+"/other-code", &nullGuiApp)
+		otherDone <- true
+	}()
+	defer func() {
+		relay.Close()
+		<-otherDone
+	}()
+
+	//Neither of peers is listening, both connect to relay
+	sessionIDs := make(chan uint32, 2)
+	for _, netClient := range []*NetClient{first, second} {
+		go func(netClient *NetClient) {
+			sessionID, err := netClient.SendHello(relayAddress+"/shared-code", &nullGuiApp)
+			if err != nil {
+				t.Error(err)
+			}
+			sessionIDs <- sessionID
+		}(netClient)
+	}
+	firstID, secondID := <-sessionIDs, <-sessionIDs
+	if firstID == 0 || secondID == 0 {
+		t.FailNow()
+	}
+	defer first.DisconnectAll(&nullGuiApp)
+
+	established := func() bool {
+		return first.IsConnected(first.ActiveSession()) && second.IsConnected(second.ActiveSession())
+	}
+	if !waitFor(established) {
+		t.Fatal("Session through relay was not established")
+	}
+	if len(other.Sessions()) != 0 {
+		t.Error("Peer with other session code should still wait")
+	}
+
+	//Files go both ways, whoever sent HELLO
+	content := bytes.Repeat([]byte("file sent through relay "), 20000)
+	sentFile, err := ioutil.TempFile("", "sstt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(sentFile.Name())
+	sentFile.Write(content)
+	sentFile.Close()
+
+	for _, pair := range [][2]*NetClient{{first, second}, {second, first}} {
+		file, err := os.Open(sentFile.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = pair[0].SendFile(pair[0].ActiveSession(), file, &nullGuiApp)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		received := path.Join(pair[1].receiveDir, path.Base(sentFile.Name()))
+		if !waitFor(func() bool {
+			data, err := ioutil.ReadFile(received)
+			return err == nil && bytes.Equal(data, content)
+		}) {
+			t.Error("Received file differs from sent one")
+		}
+	}
+
+	//Paired peers are released when they disconnect, only other peer keeps waiting
+	first.DisconnectAll(&nullGuiApp)
+	if !waitFor(func() bool { return atomic.LoadInt32(&relay.incoming) == 1 }) {
+		t.Errorf("Expected only waiting peer counted, got %d connections", atomic.LoadInt32(&relay.incoming))
+	}
+}
+
+func TestRelayWaitTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { relayWaitTimeout = timeout }(relayWaitTimeout)
+	relayWaitTimeout = 200 * time.Millisecond
+
+	relay, relayAddress := testRelay(t)
+	defer relay.Close()
+
+	var nullGuiApp GUIApp
+	netClient := testNetClient(t)
+	defer os.RemoveAll(netClient.receiveDir)
+	if _, err := netClient.SendHello(relayAddress+"/lonely", &nullGuiApp); err == nil {
+		t.Error("Peer should stop waiting when nobody joins")
+	}
+
+	forgotten := func() bool {
+		relay.mutex.Lock()
+		defer relay.mutex.Unlock()
+		return len(relay.waiting) == 0
+	}
+	if !waitFor(forgotten) {
+		t.Error("Relay should forget peer which stopped waiting")
+	}
+}
+
+func TestRelayLimits(t *testing.T) {
+	defer func(waiting int, failures int) { maxRelayWaiting, banAfterFailures = waiting, failures }(maxRelayWaiting, banAfterFailures)
+	maxRelayWaiting, banAfterFailures = 1, 1
+
+	relay, relayAddress := testRelay(t)
+	defer relay.Close()
+	address := strings.TrimPrefix(relayAddress, "relay://")
+
+	request := func(code string) net.Conn {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		head := make([]byte, 5)
+		endianness.PutUint32(head, relaymagic)
+		head[4] = byte(len(code))
+		conn.Write(append(head, code...))
+		return conn
+	}
+	closed := func(conn net.Conn) bool {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := conn.Read(make([]byte, 1))
+		netError, ok := err.(net.Error)
+		return err != nil && !(ok && netError.Timeout())
+	}
+
+	//Second peer waiting for other code is over limit
+	first := request("first")
+	defer first.Close()
+	if !waitFor(func() bool { relay.mutex.Lock(); defer relay.mutex.Unlock(); return len(relay.waiting) == 1 }) {
+		t.Fatal("First peer should wait")
+	}
+	second := request("second")
+	defer second.Close()
+	if !closed(second) {
+		t.Error("Peer over waiting limit should be closed")
+	}
+
+	//Malformed request bans address
+	malformed, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	malformed.Write([]byte("GET / HTTP/1.1\r\n"))
+	closed(malformed)
+	malformed.Close()
+	if !waitFor(func() bool { return relay.throttle.Stats().ActiveBans == 1 }) {
+		t.Fatal("Address sending malformed request should be banned")
+	}
+	banned := request("first")
+	defer banned.Close()
+	if !closed(banned) {
+		t.Error("Connection from banned address should be closed")
+	}
+	if !waitFor(func() bool { return atomic.LoadInt32(&relay.incoming) == 1 }) {
+		t.Errorf("Only waiting peer should be counted, got %d connections", atomic.LoadInt32(&relay.incoming))
+	}
+}
+
+//testProcess is app binary running in its own process. Its output is collected, so test can wait for it
+type testProcess struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	mutex sync.Mutex
+	out   bytes.Buffer
+}
+
+func (process *testProcess) Write(data []byte) (int, error) {
+	process.mutex.Lock()
+	defer process.mutex.Unlock()
+	return process.out.Write(data)
+}
+
+func (process *testProcess) Output() string {
+	process.mutex.Lock()
+	defer process.mutex.Unlock()
+	return process.out.String()
+}
+
+//startTestProcess runs binary with arguments in directory. Caller kills it with stop
+func startTestProcess(t *testing.T, binary string, dir string, args ...string) *testProcess {
+	process := &testProcess{cmd: exec.Command(binary, args...)}
+	process.cmd.Dir = dir
+	process.cmd.Stdout = process
+	process.cmd.Stderr = process
+	var err error
+	if process.stdin, err = process.cmd.StdinPipe(); err != nil {
+		t.Fatal(err)
+	}
+	if err = process.cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return process
+}
+
+//stop kills process. Its output is logged if test failed
+func (process *testProcess) stop(t *testing.T) {
+	process.cmd.Process.Kill()
+	process.cmd.Wait()
+	if t.Failed() {
+		t.Logf("Output of %v:\n%s", process.cmd.Args, process.Output())
+	}
+}
+
+//startTestPeer runs console peer in directory, creating its keypair there. It accepts every peer asking to connect
+func startTestPeer(t *testing.T, binary string, dir string, args ...string) *testProcess {
+	peer := startTestProcess(t, binary, dir, append([]string{"-console", "-listen", "127.0.0.1:0"}, args...)...)
+	fmt.Fprintln(peer.stdin, "password")
+	go func() {
+		for answered := 0; ; answered++ {
+			if !waitFor(func() bool { return strings.Count(peer.Output(), "[y/N]") > answered }) {
+				return
+			}
+			if _, err := fmt.Fprintln(peer.stdin, "y"); err != nil {
+				return
+			}
+		}
+	}()
+	return peer
+}
+
+//TestRelayProcesses builds app and runs relay and both peers as separate processes, like they run on different machines
+func TestRelayProcesses(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Building app takes long")
+	}
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("Go tool is not available:", err)
+	}
+	dir, err := ioutil.TempDir("", "sstt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	binary := filepath.Join(dir, "sstt")
+	if runtime.GOOS == "windows" {
+		binary += ".exe"
+	}
+	if output, err := exec.Command(goTool, "build", "-o", binary, ".").CombinedOutput(); err != nil {
+		t.Fatalf("Building app failed: %v\n%s", err, output)
+	}
+
+	relay := startTestProcess(t, binary, dir, "-relay", "-listen", "127.0.0.1:0")
+	defer relay.stop(t)
+	listening := regexp.MustCompile(`Relay listening on (\S+)`)
+	if !waitFor(func() bool { return listening.MatchString(relay.Output()) }) {
+		t.Fatal("Relay did not start")
+	}
+	relayAddress := "relay://" + listening.FindStringSubmatch(relay.Output())[1] + "/process-code"
+
+	//Each peer has its own directory with keypair, known peers and received files
+	firstDir, secondDir := filepath.Join(dir, "first"), filepath.Join(dir, "second")
+	for _, peerDir := range []string{firstDir, secondDir} {
+		if err = os.Mkdir(peerDir, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := startTestPeer(t, binary, firstDir, "-connect", relayAddress)
+	defer first.stop(t)
+	second := startTestPeer(t, binary, secondDir, "-connect", relayAddress)
+	defer second.stop(t)
+
+	established := func(peer *testProcess) bool {
+		return waitFor(func() bool { return strings.Contains(peer.Output(), "Connected ") })
+	}
+	if !established(first) || !established(second) {
+		t.Fatal("Session through relay process was not established")
+	}
+
+	//Files go both ways through relay process
+	content := bytes.Repeat([]byte("file sent through relay process "), 20000)
+	for _, pair := range []struct {
+		sender    *testProcess
+		senderDir string
+		receiver  string
+	}{{first, firstDir, secondDir}, {second, secondDir, firstDir}} {
+		sentFile := filepath.Join(pair.senderDir, "sent.txt")
+		if err = ioutil.WriteFile(sentFile, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintln(pair.sender.stdin, "/file "+sentFile)
+
+		received := filepath.Join(pair.receiver, "files", "sent.txt")
+		if !waitFor(func() bool {
+			data, err := ioutil.ReadFile(received)
+			return err == nil && bytes.Equal(data, content)
+		}) {
+			t.Fatal("Received file differs from sent one")
+		}
+	}
+}
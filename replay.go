@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+//How many sequence numbers below the highest received one are still accepted
+const replayWindowSize = 64
+
+//Length of sequence number and MAC added to authenticated frame
+const frameAuthOverhead = 8 + sha256.Size
+
+//ReplayError means frame was already received or is too old. Such frame is dropped but session goes on
+type ReplayError struct {
+	seq     uint64
+	highest uint64
+}
+
+func (err *ReplayError) Error() string {
+	if err.seq+replayWindowSize <= err.highest {
+		return fmt.Sprintf("frame %d is out of replay window (highest received %d)", err.seq, err.highest)
+	}
+	return fmt.Sprintf("frame %d was already received", err.seq)
+}
+
+//ReplayWindow remembers sequence numbers of recently received frames
+type ReplayWindow struct {
+	highest uint64
+	//Bit i is set if frame highest-i was received
+	seen uint64
+}
+
+//Accept marks sequence number as received. Error is returned if it's duplicate or older than window
+func (window *ReplayWindow) Accept(seq uint64) error {
+	if seq == 0 {
+		return &ReplayError{seq: seq, highest: window.highest}
+	}
+
+	if seq > window.highest {
+		shift := seq - window.highest
+		if shift >= replayWindowSize {
+			window.seen = 0
+		} else {
+			window.seen <<= shift
+		}
+		window.seen |= 1
+		window.highest = seq
+		return nil
+	}
+
+	offset := window.highest - seq
+	if offset >= replayWindowSize || window.seen&(1<<offset) != 0 {
+		return &ReplayError{seq: seq, highest: window.highest}
+	}
+
+	window.seen |= 1 << offset
+	return nil
+}
+
+//frameAuthenticator adds sequence number and MAC to frames of established session and checks them in received frames
+//Each direction has its own keys so our own frames reflected back are refused
+type frameAuthenticator struct {
+	send    *directionKeys
+	recv    *directionKeys
+	sendSeq uint64
+	window  ReplayWindow
+}
+
+//frameAuthenticatorInit derives keys of both directions from session keys and IVs agreed in handshake for frames sent by initiator and responder
+func frameAuthenticatorInit(initiatorKey, initiatorIV, responderKey, responderIV []byte, cipherMode cipherblockmode, initiator bool) *frameAuthenticator {
+	initiatorKeys := directionKeysInit(initiatorKey, initiatorIV, cipherMode, "initiator")
+	responderKeys := directionKeysInit(responderKey, responderIV, cipherMode, "responder")
+
+	if initiator {
+		return &frameAuthenticator{send: initiatorKeys, recv: responderKeys}
+	}
+	return &frameAuthenticator{send: responderKeys, recv: initiatorKeys}
+}
+
+//frameMAC authenticates frame header, sequence number and payload
+func frameMAC(key []byte, frame *Frame, seq uint64, payload []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	binary.Write(mac, endianness, frame.version)
+	binary.Write(mac, endianness, frame.ptype)
+	binary.Write(mac, endianness, frame.flags)
+	binary.Write(mac, endianness, seq)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+//seal adds next sequence number and MAC to frame payload. Caller must serialize calls
+// Schema of frame
+// |seq uint64|payload [length]byte|mac [32]byte|
+func (auth *frameAuthenticator) seal(frame *Frame) {
+	auth.sendSeq++
+	frame.seq = auth.sendSeq
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, endianness, auth.sendSeq)
+	buf.Write(frame.payload)
+	buf.Write(frameMAC(auth.send.macKey, frame, auth.sendSeq, frame.payload))
+	frame.payload = buf.Bytes()
+}
+
+//open checks MAC and sequence number of frame and strips them from payload
+func (auth *frameAuthenticator) open(frame *Frame) error {
+	if len(frame.payload) < frameAuthOverhead {
+		return sessionErrorf(ERRORAUTHENTICATION, "Frame too short to be authenticated")
+	}
+
+	seq := endianness.Uint64(frame.payload)
+	payload := frame.payload[8 : len(frame.payload)-sha256.Size]
+	mac := frame.payload[len(frame.payload)-sha256.Size:]
+
+	if !hmac.Equal(mac, frameMAC(auth.recv.macKey, frame, seq, payload)) {
+		return sessionErrorf(ERRORAUTHENTICATION, "Wrong MAC of frame %d", seq)
+	}
+
+	if err := auth.window.Accept(seq); err != nil {
+		return err
+	}
+
+	frame.seq = seq
+	frame.payload = payload
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReplayWindow(t *testing.T) {
+	var window ReplayWindow
+
+	for _, seq := range []uint64{1, 2, 5, 4, 100} {
+		if err := window.Accept(seq); err != nil {
+			t.Errorf("Frame %d should be accepted: %v", seq, err)
+		}
+	}
+
+	//Duplicates, frame 0 and frames older than window are refused
+	for _, seq := range []uint64{0, 5, 100, 36, 1} {
+		if err := window.Accept(seq); err == nil {
+			t.Errorf("Frame %d should be refused", seq)
+		}
+	}
+
+	//Frame inside window received late is accepted once
+	if err := window.Accept(37); err != nil {
+		t.Errorf("Frame 37 should be accepted: %v", err)
+	}
+	if err := window.Accept(37); err == nil {
+		t.Error("Frame 37 should be refused second time")
+	}
+}
+
+func TestFrameAuthentication(t *testing.T) {
+	key, iv := make([]byte, 32), make([]byte, 16)
+	GenerateKey(key)
+	GenerateIV(iv)
+	initiator := frameAuthenticatorInit(key, iv, key, iv, CBC, true)
+	responder := frameAuthenticatorInit(key, iv, key, iv, CBC, false)
+
+	frame := Frame{version: 1, ptype: TEXTMESSAGE, payload: []byte("encrypted message")}
+	initiator.seal(&frame)
+	sealed := frame
+
+	if err := responder.open(&frame); err != nil {
+		t.Fatal(err)
+	}
+	if frame.seq != 1 || !bytes.Equal(frame.payload, []byte("encrypted message")) {
+		t.Error("Opened frame differs from sealed one")
+	}
+
+	replayed := sealed
+	if _, ok := responder.open(&replayed).(*ReplayError); !ok {
+		t.Error("Replayed frame should be refused with ReplayError")
+	}
+
+	reflected := sealed
+	if _, ok := initiator.open(&reflected).(*SessionError); !ok {
+		t.Error("Our own frame reflected back should fail authentication")
+	}
+
+	tampered := sealed
+	tampered.ptype = FILE
+	if _, ok := responder.open(&tampered).(*SessionError); !ok {
+		t.Error("Frame with changed type should fail authentication")
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"./remotes/pem"
+)
+
+const revocationPemType = "SSTT REVOCATION"
+
+//Revocation represents revoked public key
+type Revocation struct {
+	Fingerprint string
+	Reason      string
+	Date        time.Time
+}
+
+//RevocationList is local list of revoked peer keys. Peers on this list are refused during handshake
+type RevocationList struct {
+	file    string
+	mutex   sync.Mutex
+	revoked map[string]Revocation
+	//Public key allowed to sign revocations of other keys (optional)
+	adminKey []byte
+}
+
+//RevocationListLoad loads revocations from revoked file in given directory. Admin key file is optional
+// Schema of line
+// |fingerprint hex|date RFC3339|reason|
+// separated by tabs
+func RevocationListLoad(dir string, adminKeyFile string) (*RevocationList, error) {
+	revocationList := &RevocationList{file: path.Join(dir, "revoked"), revoked: make(map[string]Revocation)}
+
+	if adminKeyFile != "" {
+		adminKey, err := ioutil.ReadFile(adminKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(adminKey)
+		if block == nil || block.Type != "RSA PUBLIC KEY" {
+			return nil, errors.New("RevocationListLoad: admin key is not PEM encoded RSA public key")
+		}
+		//Encoded the same way as signer key of statement, so line endings and other content of file don't change fingerprint
+		revocationList.adminKey = pem.EncodeToMemory(block)
+	}
+
+	file, err := os.Open(revocationList.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return revocationList, nil
+		}
+		return nil, err
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, "\t", 3)
+		revocation := Revocation{Fingerprint: strings.ToLower(fields[0])}
+		if len(fields) > 1 {
+			revocation.Date, _ = time.Parse(time.RFC3339, fields[1])
+		}
+		if len(fields) > 2 {
+			revocation.Reason = fields[2]
+		}
+		revocationList.revoked[revocation.Fingerprint] = revocation
+	}
+
+	return revocationList, scanner.Err()
+}
+
+//IsRevoked returns revocation entry if key with given fingerprint is revoked
+func (revocationList *RevocationList) IsRevoked(fingerprint string) (Revocation, bool) {
+	if revocationList == nil {
+		return Revocation{}, false
+	}
+	revocationList.mutex.Lock()
+	defer revocationList.mutex.Unlock()
+	revocation, ok := revocationList.revoked[strings.ToLower(fingerprint)]
+	return revocation, ok
+}
+
+//Add adds revocation to the list and saves whole list to file
+func (revocationList *RevocationList) Add(revocation Revocation) error {
+	revocationList.mutex.Lock()
+	defer revocationList.mutex.Unlock()
+
+	revocation.Fingerprint = strings.ToLower(revocation.Fingerprint)
+	revocationList.revoked[revocation.Fingerprint] = revocation
+
+	file, err := os.Create(revocationList.file)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	for _, entry := range revocationList.revoked {
+		if _, err = fmt.Fprintf(file, "%s\t%s\t%s\n", entry.Fingerprint, entry.Date.Format(time.RFC3339), entry.Reason); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//Import verifies signed revocation statement and adds it to the list. Statement must be signed by revoked key itself or by admin key
+func (revocationList *RevocationList) Import(statement []byte) (Revocation, error) {
+	var revocation Revocation
+
+	block, rest := pem.Decode(statement)
+	if block == nil || block.Type != revocationPemType {
+		return revocation, errors.New("RevocationList.Import: no revocation block")
+	}
+
+	signerBlock, _ := pem.Decode(rest)
+	if signerBlock == nil || signerBlock.Type != "RSA PUBLIC KEY" {
+		return revocation, errors.New("RevocationList.Import: no signer public key")
+	}
+	signerKey := pem.EncodeToMemory(signerBlock)
+
+	revocation.Fingerprint = strings.ToLower(block.Headers["Fingerprint"])
+	revocation.Reason = block.Headers["Reason"]
+	date, err := time.Parse(time.RFC3339, block.Headers["Date"])
+	if err != nil {
+		return revocation, err
+	}
+	revocation.Date = date
+
+	signerFingerprint := fingerprint(signerKey)
+	isAdmin := revocationList.adminKey != nil && signerFingerprint == fingerprint(revocationList.adminKey)
+	if signerFingerprint != revocation.Fingerprint && !isAdmin {
+		return revocation, errors.New("RevocationList.Import: statement is signed neither by revoked key nor by admin key")
+	}
+
+	if err = VerifyRSA(revocation.signedBytes(), block.Bytes, signerKey); err != nil {
+		return revocation, fmt.Errorf("RevocationList.Import: wrong signature: %v", err)
+	}
+
+	return revocation, revocationList.Add(revocation)
+}
+
+//GenerateRevocationStatement creates revocation statement signed by given keypair. Keypair must be revoked key itself or admin key
+// Schema of statement
+// |SSTT REVOCATION PEM block with Fingerprint, Reason and Date headers and signature as content|RSA PUBLIC KEY PEM block of signer|
+func GenerateRevocationStatement(revocation Revocation, privKey []byte, pubKey []byte) ([]byte, error) {
+	revocation.Fingerprint = strings.ToLower(revocation.Fingerprint)
+	revocation.Reason = strings.Join(strings.Fields(revocation.Reason), " ")
+
+	signature, err := SignRSA(revocation.signedBytes(), privKey)
+	if err != nil {
+		return nil, err
+	}
+
+	statement := pem.EncodeToMemory(&pem.Block{
+		Type: revocationPemType,
+		Headers: map[string]string{
+			"Fingerprint": revocation.Fingerprint,
+			"Reason":      revocation.Reason,
+			"Date":        revocation.Date.Format(time.RFC3339),
+		},
+		Bytes: signature,
+	})
+
+	return append(statement, pubKey...), nil
+}
+
+func (revocation *Revocation) signedBytes() []byte {
+	return []byte(fmt.Sprintf("%s\n%s\n%s", revocation.Fingerprint, revocation.Date.Format(time.RFC3339), revocation.Reason))
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestRevocationSelfSigned(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "revocation")
+	defer os.RemoveAll(dir)
+
+	privKey, pubKey, err := GenerateKeyPair(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	revocations, err := RevocationListLoad(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statement, err := GenerateRevocationStatement(Revocation{Fingerprint: fingerprint(pubKey), Reason: "laptop stolen", Date: time.Now()}, privKey, pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = revocations.Import(statement); err != nil {
+		t.Fatal(err)
+	}
+
+	revocations, err = RevocationListLoad(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	revocation, revoked := revocations.IsRevoked(fingerprint(pubKey))
+	if !revoked {
+		t.Error("Imported revocation should survive reload")
+	}
+
+	if revocation.Reason != "laptop stolen" {
+		t.Errorf("Wrong reason: %s", revocation.Reason)
+	}
+}
+
+func TestRevocationSignedByOtherKey(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "revocation")
+	defer os.RemoveAll(dir)
+
+	_, revokedPubKey, err := GenerateKeyPair(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adminPrivKey, adminPubKey, err := GenerateKeyPair(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statement, err := GenerateRevocationStatement(Revocation{Fingerprint: fingerprint(revokedPubKey), Reason: "left company", Date: time.Now()}, adminPrivKey, adminPubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	revocations, _ := RevocationListLoad(dir, "")
+	if _, err = revocations.Import(statement); err == nil {
+		t.Error("Statement signed by unknown key should be refused")
+	}
+
+	//Admin key file edited on other system has CRLF line endings and note after key
+	adminKeyFile := append(bytes.Replace(adminPubKey, []byte("\n"), []byte("\r\n"), -1), "\r\nKey of revocation admin\r\n"...)
+	ioutil.WriteFile(path.Join(dir, "admin.pem"), adminKeyFile, 0600)
+	revocations, err = RevocationListLoad(dir, path.Join(dir, "admin.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = revocations.Import(statement); err != nil {
+		t.Error(err)
+	}
+
+	if _, revoked := revocations.IsRevoked(fingerprint(revokedPubKey)); !revoked {
+		t.Error("Statement signed by admin key should be imported")
+	}
+}
+
+func TestRevocationTampered(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "revocation")
+	defer os.RemoveAll(dir)
+
+	privKey, pubKey, err := GenerateKeyPair(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statement, err := GenerateRevocationStatement(Revocation{Fingerprint: fingerprint(pubKey), Reason: "laptop stolen", Date: time.Now()}, privKey, pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	revocations, _ := RevocationListLoad(dir, "")
+	if _, err = revocations.Import(bytes.Replace(statement, []byte("laptop stolen"), []byte("key rotated"), 1)); err == nil {
+		t.Error("Statement with changed reason should be refused")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto"
 	"crypto/rand"
 	"crypto/sha512"
 	"fmt"
@@ -47,6 +48,26 @@ func DecryptRSA(data []byte, privKey []byte) (out []byte, err error) {
 	return
 }
 
+//SignRSA signs SHA-512 hash of data using private key (RSA-PSS)
+func SignRSA(data []byte, privKey []byte) (signature []byte, err error) {
+	privKeyImported, err := importPrivateKey(privKey)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha512.Sum512(data)
+	return rsa.SignPSS(rand.Reader, privKeyImported, crypto.SHA512, hash[:], nil)
+}
+
+//VerifyRSA verifies RSA-PSS signature of data using public key
+func VerifyRSA(data []byte, signature []byte, pubKey []byte) error {
+	pubKeyImported, err := importPublicKey(pubKey)
+	if err != nil {
+		return err
+	}
+	hash := sha512.Sum512(data)
+	return rsa.VerifyPSS(pubKeyImported, crypto.SHA512, hash[:], signature, nil)
+}
+
 //exportPublicKey is used to export public key in friendly format (PCKS1-encoded )
 func exportPublicKey(pubkey *rsa.PublicKey) []byte {
 	pubkeyPem := pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(pubkey)})
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+//Session is single long-lived connection to other client. Packets of all types go through it in both directions
+type Session struct {
+	//ID assigned by SessionManager
+	id         uint32
+	conn       net.Conn
+	reader     *bufio.Reader
+	writeMutex sync.Mutex
+	remoteAddr string
+	closeOnce  sync.Once
+	//Negotiated protocol version (0 until HELLORESPONSE) and features supported by both sides
+	version  byte
+	features featureflags
+	//Handshake state machine
+	handshake *Handshake
+	//SHA-256 of peer public key
+	peerFingerprint string
+	//File currently being received
+	incomingFile *fileReceive
+	//Keys and cipher mode of this session
+	messageHandler EncMess
+	//True if we sent HELLO
+	initiator bool
+	//Authenticates frames once session key is agreed. Guarded by writeMutex when sending
+	auth *frameAuthenticator
+	//Held for reading while data is encrypted and sent, for writing while send keys are updated
+	keyMutex sync.RWMutex
+	//Bytes sent and time of last send keys update. Guarded by writeMutex
+	sentBytes int64
+	lastRekey time.Time
+	rekeying  bool
+	//Cipher mode change state. modeAnswer is set while our request waits for answer, modeChanging while we answer peer request
+	modeMutex    sync.Mutex
+	modeAnswer   chan cipherModeAck
+	modeChanging bool
+	//Closed when our cipher mode request is answered. Encrypted data waits for it while it's set. Guarded by keyMutex
+	modeSwitch chan struct{}
+	//Closed when connection is closed
+	done chan struct{}
+	//Why session was closed, shown to user when it ends. The first reason set is kept
+	reasonMutex sync.Mutex
+	closeReason string
+	//Measures round trip time of PING frames
+	heartbeat Heartbeat
+	//Fingerprint of peer TLS certificate key. Empty if session is not wrapped in TLS
+	certificateFingerprint string
+	//HELLO and HELLORESPONSE payloads. They are authenticated by Noise handshake as its prologue. PAIR data after element when pairing
+	helloTranscript []byte
+	//Noise handshake in progress
+	noise *noiseHandshake
+	//Pairing code brought by peer paired through relay. Codes generated by us are used otherwise
+	pairingCode string
+	//SPAKE2 exchange of pairing in progress
+	pake *spake2
+	//Hybrid key exchange started by us and secret agreed by it until it's mixed into session key
+	hybrid       *hybridKEM
+	hybridSecret []byte
+	//Key and IV of frames sent by responder if handshake agreed separate ones for each direction (Noise).
+	//Otherwise messageHandler key and IV are used for both directions
+	responderKey []byte
+	responderIV  []byte
+	//Resumable files are sent one by one. transferAnswer and transferResult are set while our file offer waits for answers
+	transferMutex  sync.Mutex
+	answerMutex    sync.Mutex
+	transferAnswer chan fileOffset
+	transferResult chan fileResult
+	//Answers of read loop written by their own goroutine, started with the first answer
+	replies   chan func() error
+	replyOnce sync.Once
+}
+
+//Answers waiting to be written. Peer which doesn't read them fills queue and session is closed
+const maxQueuedReplies = 64
+
+func sessionInit(conn net.Conn, remoteAddr string) *Session {
+	return &Session{conn: conn, reader: bufio.NewReaderSize(conn, bufsize), remoteAddr: remoteAddr, done: make(chan struct{}),
+		replies: make(chan func() error, maxQueuedReplies), certificateFingerprint: certificateFingerprint(conn)}
+}
+
+//Transport returns TLS if session is wrapped in TLS, plain otherwise
+func (session *Session) Transport() string {
+	if session.certificateFingerprint != "" {
+		return "TLS"
+	}
+	return "plain"
+}
+
+//String returns session ID and address of other client
+func (session *Session) String() string {
+	return fmt.Sprintf("#%d %s", session.id, session.remoteAddr)
+}
+
+//dialSession connects to other client using TCP (through proxy if set) or Unix domain socket, wraps connection in TLS if transport
+//enables it and sends connection preface (magic number)
+func dialSession(proxy *Proxy, transport *TLSTransport, network string, servAddr string) (*Session, error) {
+	conn, err := proxy.Dial(network, servAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped, err := transport.Client(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return initiateSession(wrapped, addressName(network, servAddr))
+}
+
+//initiateSession sends connection preface (magic number) through connection opened by us
+func initiateSession(conn net.Conn, remoteAddr string) (*Session, error) {
+	if err := binary.Write(conn, endianness, magicnumber); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return sessionInit(conn, remoteAddr), nil
+}
+
+//acceptSession reads connection preface (magic number) from accepted connection
+func acceptSession(conn net.Conn) (*Session, error) {
+	remoteAddr := conn.RemoteAddr().String()
+	//Clients of Unix domain socket have no address
+	if conn.LocalAddr().Network() == "unix" && (remoteAddr == "" || remoteAddr == "@") {
+		remoteAddr = addressName("unix", conn.LocalAddr().String())
+	}
+	return respondSession(conn, remoteAddr)
+}
+
+//respondSession reads connection preface (magic number) from connection whose other side sends HELLO
+func respondSession(conn net.Conn, remoteAddr string) (*Session, error) {
+	session := sessionInit(conn, remoteAddr)
+
+	var magic uint32
+	conn.SetReadDeadline(time.Now().Add(prefaceTimeout))
+	if err := binary.Read(session.reader, endianness, &magic); err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	if magic != magicnumber {
+		return nil, errors.New("respondSession: wrong magic number")
+	}
+
+	return session, nil
+}
+
+//writePacket sends frame without flags. It's safe to call from many goroutines
+func (session *Session) writePacket(ptype packettype, payload []byte) error {
+	return session.writeFrame(ptype, 0, payload)
+}
+
+//writeFrame sends frame using negotiated protocol version. It's safe to call from many goroutines
+func (session *Session) writeFrame(ptype packettype, flags byte, payload []byte) error {
+	version := session.version
+	if version == 0 {
+		version = supportedVersions[0]
+	}
+
+	session.writeMutex.Lock()
+	defer session.writeMutex.Unlock()
+
+	frame := Frame{version: version, ptype: ptype, flags: flags, payload: payload}
+	if session.auth != nil {
+		session.auth.seal(&frame)
+		session.sentBytes += int64(len(frame.payload))
+
+		if ptype != ERROR && ptype != DISCONNECT && session.rekeyDue() {
+			session.rekeying = true
+			go session.UpdateSendKeys()
+		}
+	}
+
+	return session.send(frame)
+}
+
+//send writes frame to connection. Peer not reading it for writeTimeout closes session. Caller must hold writeMutex
+func (session *Session) send(frame Frame) error {
+	session.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	err := writeFrame(session.conn, frame)
+	if netError, ok := err.(net.Error); ok && netError.Timeout() {
+		session.Close()
+		return sessionErrorf(ERRORTIMEOUT, "Frame not sent in %s", writeTimeout)
+	}
+	return err
+}
+
+//writeWithSeq sends authenticated frame whose payload depends on its own sequence number
+func (session *Session) writeWithSeq(ptype packettype, build func(seq uint64) []byte) error {
+	session.writeMutex.Lock()
+	defer session.writeMutex.Unlock()
+
+	if session.auth == nil {
+		return errors.New("Session.writeWithSeq: Session key is not agreed yet")
+	}
+
+	frame := Frame{version: session.version, ptype: ptype, payload: build(session.auth.sendSeq + 1)}
+	session.auth.seal(&frame)
+
+	return session.send(frame)
+}
+
+//reply queues answer to peer frame. Read loop uses it so it keeps reading while writers wait for peer to read what we send,
+//otherwise both sides sending files could wait for each other forever
+func (session *Session) reply(write func() error) error {
+	session.replyOnce.Do(func() {
+		go session.writeReplies()
+	})
+
+	select {
+	case session.replies <- write:
+		return nil
+	default:
+		return sessionErrorf(ERRORLIMIT, "Peer doesn't read answers to its frames")
+	}
+}
+
+//writeReplies writes queued answers until session is closed. Session is closed when answer can't be written
+func (session *Session) writeReplies() {
+	for {
+		select {
+		case write := <-session.replies:
+			if err := write(); err != nil {
+				fmt.Println(err)
+				session.Close()
+				return
+			}
+		case <-session.done:
+			return
+		}
+	}
+}
+
+//enableAuthentication makes all following frames carry sequence number and MAC derived from agreed session key
+func (session *Session) enableAuthentication() {
+	session.keyMutex.Lock()
+	defer session.keyMutex.Unlock()
+
+	session.writeMutex.Lock()
+	defer session.writeMutex.Unlock()
+
+	encMess := &session.messageHandler
+	responderKey, responderIV := encMess.aesKey, encMess.iv
+	if session.responderKey != nil {
+		responderKey, responderIV = session.responderKey, session.responderIV
+	}
+	session.auth = frameAuthenticatorInit(encMess.aesKey, encMess.iv, responderKey, responderIV, encMess.cipherMode, session.initiator)
+	session.lastRekey = time.Now()
+}
+
+//readFrame reads next frame. Only session read loop should call it
+//Frames with wrong MAC, oversized ones and peer silent for readTimeout return SessionError, replayed ones ReplayError
+func (session *Session) readFrame() (Frame, error) {
+	session.conn.SetReadDeadline(time.Now().Add(readTimeout))
+	frame, err := readFrame(session.reader, session.frameLimit)
+	if netError, ok := err.(net.Error); ok && netError.Timeout() {
+		return frame, sessionErrorf(ERRORTIMEOUT, "No frame received in %s", readTimeout)
+	}
+	if err != nil {
+		return frame, err
+	}
+
+	if session.version != 0 && frame.version != session.version {
+		return frame, fmt.Errorf("Session.readFrame: Frame version %d differs from negotiated version %d", frame.version, session.version)
+	}
+
+	if session.auth != nil {
+		err = session.auth.open(&frame)
+	}
+
+	return frame, err
+}
+
+//closeWithError tells peer why session is closed and closes it. Session is closed within errorWriteTimeout
+//even if ERROR can't be sent because writer waits for peer which doesn't read
+func (session *Session) closeWithError(err *SessionError) {
+	sent := make(chan struct{})
+	go func() {
+		session.writePacket(ERROR, encodeError(err))
+		close(sent)
+	}()
+
+	select {
+	case <-sent:
+	case <-time.After(errorWriteTimeout):
+	}
+	session.Close()
+}
+
+//Close closes connection. It can be called many times
+func (session *Session) Close() {
+	session.closeOnce.Do(func() {
+		session.conn.Close()
+		close(session.done)
+	})
+}
+
+//setCloseReason remembers why session is closed unless other reason was set first
+func (session *Session) setCloseReason(reason string) {
+	session.reasonMutex.Lock()
+	defer session.reasonMutex.Unlock()
+	if session.closeReason == "" {
+		session.closeReason = reason
+	}
+}
+
+//CloseReason returns why session was closed, empty if reason is not known
+func (session *Session) CloseReason() string {
+	session.reasonMutex.Lock()
+	defer session.reasonMutex.Unlock()
+	return session.closeReason
+}
+
+//Closed returns true if connection is closed
+func (session *Session) Closed() bool {
+	select {
+	case <-session.done:
+		return true
+	default:
+		return false
+	}
+}
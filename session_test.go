@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSessionPackets(t *testing.T) {
+	local, remote := net.Pipe()
+	sender, receiver := sessionInit(local, "sender"), sessionInit(remote, "receiver")
+	defer sender.Close()
+	defer receiver.Close()
+
+	//Packets written from many goroutines are never interleaved
+	const writers, packets = 4, 20
+	var wg sync.WaitGroup
+	for writer := 0; writer < writers; writer++ {
+		wg.Add(1)
+		go func(writer int) {
+			defer wg.Done()
+			for i := 0; i < packets; i++ {
+				if err := sender.writePacket(TEXTMESSAGE, bytes.Repeat([]byte{byte(writer)}, 1000+i)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(writer)
+	}
+
+	received := make(map[byte]int)
+	for i := 0; i < writers*packets; i++ {
+		frame, err := receiver.readFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload := frame.payload
+		if frame.ptype != TEXTMESSAGE || len(payload) == 0 || !bytes.Equal(payload, bytes.Repeat(payload[:1], len(payload))) {
+			t.Fatalf("Packet %d corrupted", i)
+		}
+		received[payload[0]]++
+	}
+	wg.Wait()
+	for writer := 0; writer < writers; writer++ {
+		if received[byte(writer)] != packets {
+			t.Errorf("Expected %d packets of writer %d, got %d", packets, writer, received[byte(writer)])
+		}
+	}
+}
+
+func TestSessionPreface(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan *Session, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		session, err := acceptSession(conn)
+		if err != nil {
+			conn.Close()
+		}
+		accepted <- session
+	}()
+
+	dialed, err := dialSession(nil, nil, "tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dialed.Close()
+	session := <-accepted
+	if session == nil {
+		t.Fatal("Session with right preface should be accepted")
+	}
+	defer session.Close()
+
+	if err = dialed.writePacket(PING, nil); err != nil {
+		t.Fatal(err)
+	}
+	if frame, err := session.readFrame(); err != nil || frame.ptype != PING || len(frame.payload) != 0 {
+		t.Errorf("Expected empty PING, got %d %v %v", frame.ptype, frame.payload, err)
+	}
+
+	//Connection without magic number is refused
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		session, err := acceptSession(conn)
+		if err != nil {
+			conn.Close()
+		}
+		accepted <- session
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	binary.Write(conn, endianness, magicnumber+1)
+	if session := <-accepted; session != nil {
+		t.Error("Session with wrong magic number should be refused")
+	}
+}
+
+func TestSessionLifetime(t *testing.T) {
+	netClient := NetClientInit(0, EncMess{}, AcceptPolicy{})
+	var app GUIApp
+
+	//Several sessions run at the same time and are looked up by ID
+	const count = 3
+	sessions := make([]*Session, count)
+	peers := make([]net.Conn, count)
+	served := make([]chan struct{}, count)
+	for i := range sessions {
+		var conn net.Conn
+		conn, peers[i] = net.Pipe()
+		defer peers[i].Close()
+		sessions[i] = sessionInit(conn, "peer")
+		netClient.startSession(sessions[i], false, &app)
+		served[i] = make(chan struct{})
+		go func(i int) {
+			netClient.serveSession(sessions[i], &app)
+			close(served[i])
+		}(i)
+	}
+	for _, session := range sessions {
+		if found, err := netClient.sessions.Get(session.id); err != nil || found != session {
+			t.Errorf("Expected session %d, got %v %v", session.id, found, err)
+		}
+		if netClient.IsConnected(session.id) {
+			t.Errorf("Session %d without handshake should not be connected", session.id)
+		}
+		if _, err := netClient.establishedSession(session.id); err == nil {
+			t.Errorf("Session %d without handshake should not be used for sending", session.id)
+		}
+	}
+	if netClient.ActiveSession() != sessions[0].id {
+		t.Errorf("First session should be active, got %d", netClient.ActiveSession())
+	}
+
+	//Session ends when peer closes connection, other sessions keep running
+	peers[0].Close()
+	select {
+	case <-served[0]:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Session should end when peer closes connection")
+	}
+	if _, err := netClient.sessions.Get(sessions[0].id); err == nil {
+		t.Error("Ended session should be removed")
+	}
+	if err := sessions[0].writePacket(PING, nil); err == nil {
+		t.Error("Ended session should be closed")
+	}
+	if netClient.ActiveSession() != sessions[1].id {
+		t.Errorf("Next session should become active, got %d", netClient.ActiveSession())
+	}
+	if len(netClient.sessions.List()) != count-1 {
+		t.Errorf("Expected %d sessions left, got %d", count-1, len(netClient.sessions.List()))
+	}
+
+	//Ending session twice is harmless
+	netClient.endSession(sessions[0], &app)
+	for _, session := range sessions[1:] {
+		session.Close()
+	}
+	for i := 1; i < count; i++ {
+		select {
+		case <-served[i]:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Closed session should end")
+		}
+	}
+	if netClient.ActiveSession() != 0 || len(netClient.sessions.List()) != 0 {
+		t.Error("All sessions should be removed")
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+//SessionManager keeps all sessions with other clients keyed by session ID
+type SessionManager struct {
+	mutex    sync.Mutex
+	sessions map[uint32]*Session
+	nextID   uint32
+	//Session used by GUI and console when user doesn't choose other one. 0 if there are no sessions
+	active uint32
+}
+
+//SessionManagerInit creates empty session manager
+func SessionManagerInit() *SessionManager {
+	return &SessionManager{sessions: make(map[uint32]*Session), nextID: 1}
+}
+
+//Add assigns ID to session and stores it. First session becomes active one
+func (manager *SessionManager) Add(session *Session) uint32 {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	session.id = manager.nextID
+	manager.nextID++
+	manager.sessions[session.id] = session
+
+	if manager.active == 0 {
+		manager.active = session.id
+	}
+
+	return session.id
+}
+
+//Remove forgets session. If it was active one, session with the lowest ID becomes active
+func (manager *SessionManager) Remove(session *Session) bool {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	if manager.sessions[session.id] != session {
+		return false
+	}
+
+	delete(manager.sessions, session.id)
+
+	if manager.active == session.id {
+		manager.active = 0
+		for id := range manager.sessions {
+			if manager.active == 0 || id < manager.active {
+				manager.active = id
+			}
+		}
+	}
+
+	return true
+}
+
+//Get returns session with given ID
+func (manager *SessionManager) Get(id uint32) (*Session, error) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	session, ok := manager.sessions[id]
+	if !ok {
+		return nil, fmt.Errorf("SessionManager: No session with ID %d", id)
+	}
+
+	return session, nil
+}
+
+//List returns all sessions ordered by ID
+func (manager *SessionManager) List() []*Session {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	sessions := make([]*Session, 0, len(manager.sessions))
+	for _, session := range manager.sessions {
+		sessions = append(sessions, session)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].id < sessions[j].id
+	})
+
+	return sessions
+}
+
+//SetActive chooses session used when user doesn't choose other one
+func (manager *SessionManager) SetActive(id uint32) error {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	if _, ok := manager.sessions[id]; !ok {
+		return fmt.Errorf("SessionManager: No session with ID %d", id)
+	}
+
+	manager.active = id
+	return nil
+}
+
+//Active returns ID of active session. 0 if there are no sessions
+func (manager *SessionManager) Active() uint32 {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	return manager.active
+}
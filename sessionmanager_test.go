@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestSessionManagerActive(t *testing.T) {
+	manager := SessionManagerInit()
+	first, second, third := &Session{}, &Session{}, &Session{}
+
+	manager.Add(first)
+	manager.Add(second)
+	manager.Add(third)
+
+	if manager.Active() != first.id {
+		t.Errorf("First session should be active, got %d", manager.Active())
+	}
+
+	if err := manager.SetActive(third.id); err != nil {
+		t.Fatal(err)
+	}
+
+	manager.Remove(third)
+	if manager.Active() != first.id {
+		t.Errorf("Session with lowest ID should become active, got %d", manager.Active())
+	}
+
+	if manager.Remove(third) {
+		t.Error("Removed session should not be removed again")
+	}
+
+	if _, err := manager.Get(third.id); err == nil {
+		t.Error("Removed session should not be found")
+	}
+
+	if list := manager.List(); len(list) != 2 || list[0] != first || list[1] != second {
+		t.Error("List should return remaining sessions ordered by ID")
+	}
+}
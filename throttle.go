@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+//Limits of connection attempts from single IP address. Set from command line
+var (
+	//Connections per second allowed from IP address and how many can come at once
+	connectionRate  = 1.0
+	connectionBurst = 10
+	//HELLO prompts waiting for user at once. Further HELLO requests are refused as busy
+	maxPendingPrompts = 3
+	//IP address is banned for banDuration after this many failed handshakes. Failures older than banDuration are forgotten
+	banAfterFailures = 5
+	banDuration      = 10 * time.Minute
+)
+
+//Addresses tracked at once. Idle ones are forgotten when there are more
+const maxThrottledAddresses = 4096
+
+//ThrottleStats counts connections refused by throttle
+type ThrottleStats struct {
+	//Incoming connections let through and refused because of rate or ban
+	Allowed     uint64
+	RateLimited uint64
+	Banned      uint64
+	//Failed handshakes (rejected HELLO, wrong magic number, TLS or pairing failure) and bans they caused
+	Failures uint64
+	Bans     uint64
+	//HELLO requests refused because too many prompts were waiting for user
+	PromptsRefused uint64
+	//Prompts and bans in force now
+	PendingPrompts int
+	ActiveBans     int
+}
+
+func (stats ThrottleStats) String() string {
+	return fmt.Sprintf("allowed %d, rate limited %d, refused while banned %d, failed handshakes %d, bans %d (%d active), prompts pending %d/%d, prompts refused %d",
+		stats.Allowed, stats.RateLimited, stats.Banned, stats.Failures, stats.Bans, stats.ActiveBans, stats.PendingPrompts,
+		maxPendingPrompts, stats.PromptsRefused)
+}
+
+//Throttle limits rate of incoming connections per IP address, HELLO prompts waiting for user and bans addresses whose handshakes keep failing.
+//It's safe to use from many goroutines
+type Throttle struct {
+	mutex     sync.Mutex
+	addresses map[string]*addressThrottle
+	stats     ThrottleStats
+}
+
+//addressThrottle is token bucket and failure count of single IP address
+type addressThrottle struct {
+	tokens      float64
+	lastRefill  time.Time
+	failures    int
+	lastFailure time.Time
+	bannedUntil time.Time
+}
+
+//ThrottleInit returns throttle which doesn't know any address yet
+func ThrottleInit() *Throttle {
+	return &Throttle{addresses: make(map[string]*addressThrottle)}
+}
+
+//addressIP returns IP address of peer. Unix domain socket peers have none and aren't throttled
+func addressIP(addr net.Addr) string {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP.String()
+	case *net.UDPAddr:
+		return addr.IP.String()
+	}
+	return ""
+}
+
+//address returns state of IP address refilled up to now
+func (throttle *Throttle) address(ip string, now time.Time) *addressThrottle {
+	address, ok := throttle.addresses[ip]
+	if !ok {
+		if len(throttle.addresses) >= maxThrottledAddresses {
+			throttle.forgetIdle(now)
+		}
+		address = &addressThrottle{tokens: float64(connectionBurst), lastRefill: now}
+		throttle.addresses[ip] = address
+	}
+
+	address.tokens += now.Sub(address.lastRefill).Seconds() * connectionRate
+	if address.tokens > float64(connectionBurst) {
+		address.tokens = float64(connectionBurst)
+	}
+	address.lastRefill = now
+	if now.Sub(address.lastFailure) > banDuration {
+		address.failures = 0
+	}
+	return address
+}
+
+//forgetIdle removes addresses with full bucket, no ban and no recent failure. They would be created the same again
+func (throttle *Throttle) forgetIdle(now time.Time) {
+	for ip, address := range throttle.addresses {
+		full := address.tokens+now.Sub(address.lastRefill).Seconds()*connectionRate >= float64(connectionBurst)
+		if full && now.After(address.bannedUntil) && now.Sub(address.lastFailure) > banDuration {
+			delete(throttle.addresses, ip)
+		}
+	}
+}
+
+//Allow takes token of IP address for new connection. Returns error if address is banned or sends connections too fast
+func (throttle *Throttle) Allow(ip string, now time.Time) error {
+	throttle.mutex.Lock()
+	defer throttle.mutex.Unlock()
+
+	if ip == "" {
+		throttle.stats.Allowed++
+		return nil
+	}
+
+	address := throttle.address(ip, now)
+	if now.Before(address.bannedUntil) {
+		throttle.stats.Banned++
+		return fmt.Errorf("Throttle.Allow: %s is banned for %v after failed handshakes", ip, address.bannedUntil.Sub(now).Round(time.Second))
+	}
+	if address.tokens < 1 {
+		throttle.stats.RateLimited++
+		return fmt.Errorf("Throttle.Allow: %s connects faster than %g connections per second", ip, connectionRate)
+	}
+
+	address.tokens--
+	throttle.stats.Allowed++
+	return nil
+}
+
+//Failure counts failed handshake of IP address and bans it after banAfterFailures of them
+func (throttle *Throttle) Failure(ip string, now time.Time) {
+	throttle.mutex.Lock()
+	defer throttle.mutex.Unlock()
+
+	throttle.stats.Failures++
+	if ip == "" {
+		return
+	}
+
+	address := throttle.address(ip, now)
+	address.failures++
+	address.lastFailure = now
+	if address.failures >= banAfterFailures {
+		address.failures = 0
+		address.bannedUntil = now.Add(banDuration)
+		throttle.stats.Bans++
+		fmt.Printf("Banned %s for %v after %d failed handshakes\n", ip, banDuration, banAfterFailures)
+	}
+}
+
+//StartPrompt reserves place for HELLO prompt. Returns false if maxPendingPrompts are already waiting for user
+func (throttle *Throttle) StartPrompt() bool {
+	throttle.mutex.Lock()
+	defer throttle.mutex.Unlock()
+
+	if throttle.stats.PendingPrompts >= maxPendingPrompts {
+		throttle.stats.PromptsRefused++
+		return false
+	}
+	throttle.stats.PendingPrompts++
+	return true
+}
+
+//EndPrompt frees place of answered prompt
+func (throttle *Throttle) EndPrompt() {
+	throttle.mutex.Lock()
+	defer throttle.mutex.Unlock()
+	throttle.stats.PendingPrompts--
+}
+
+//Stats returns copy of counters
+func (throttle *Throttle) Stats() ThrottleStats {
+	throttle.mutex.Lock()
+	defer throttle.mutex.Unlock()
+
+	stats := throttle.stats
+	now := time.Now()
+	for _, address := range throttle.addresses {
+		if now.Before(address.bannedUntil) {
+			stats.ActiveBans++
+		}
+	}
+	return stats
+}
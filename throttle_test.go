@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestThrottleRate(t *testing.T) {
+	defer func(rate float64, burst int) { connectionRate, connectionBurst = rate, burst }(connectionRate, connectionBurst)
+	connectionRate, connectionBurst = 2, 3
+
+	throttle := ThrottleInit()
+	now := time.Now()
+	for i := 0; i < connectionBurst; i++ {
+		if err := throttle.Allow("192.0.2.1", now); err != nil {
+			t.Fatalf("Connection %d of burst should be allowed: %v", i, err)
+		}
+	}
+	if err := throttle.Allow("192.0.2.1", now); err == nil {
+		t.Error("Connection after burst should be rate limited")
+	}
+	if err := throttle.Allow("192.0.2.2", now); err != nil {
+		t.Errorf("Other address has its own bucket: %v", err)
+	}
+	if err := throttle.Allow("", now); err != nil {
+		t.Errorf("Unix domain socket peers should not be throttled: %v", err)
+	}
+
+	//Half a second gives one token back
+	now = now.Add(500 * time.Millisecond)
+	if throttle.Allow("192.0.2.1", now) != nil || throttle.Allow("192.0.2.1", now) == nil {
+		t.Error("Exactly one connection should be allowed after refill")
+	}
+
+	if stats := throttle.Stats(); stats.Allowed != 6 || stats.RateLimited != 2 {
+		t.Errorf("Expected 6 allowed and 2 rate limited, got %s", stats)
+	}
+}
+
+func TestThrottleBan(t *testing.T) {
+	defer func(failures int, duration time.Duration) { banAfterFailures, banDuration = failures, duration }(banAfterFailures, banDuration)
+	banAfterFailures, banDuration = 2, time.Minute
+
+	throttle := ThrottleInit()
+	now := time.Now()
+
+	//Failures older than ban duration are forgotten
+	throttle.Failure("192.0.2.1", now.Add(-2*time.Minute))
+	throttle.Failure("192.0.2.1", now)
+	if err := throttle.Allow("192.0.2.1", now); err != nil {
+		t.Errorf("Old failure should be forgotten: %v", err)
+	}
+
+	throttle.Failure("192.0.2.1", now)
+	if err := throttle.Allow("192.0.2.1", now); err == nil {
+		t.Error("Address should be banned after failures")
+	}
+	if stats := throttle.Stats(); stats.Bans != 1 || stats.ActiveBans != 1 || stats.Failures != 3 || stats.Banned != 1 {
+		t.Errorf("Expected 1 active ban after 3 failures, got %s", stats)
+	}
+	if err := throttle.Allow("192.0.2.1", now.Add(banDuration+time.Second)); err != nil {
+		t.Errorf("Ban should expire: %v", err)
+	}
+}
+
+func TestThrottlePrompts(t *testing.T) {
+	defer func(prompts int) { maxPendingPrompts = prompts }(maxPendingPrompts)
+	maxPendingPrompts = 2
+
+	throttle := ThrottleInit()
+	if !throttle.StartPrompt() || !throttle.StartPrompt() {
+		t.Fatal("Prompts up to limit should be shown")
+	}
+	if throttle.StartPrompt() {
+		t.Error("Prompt over limit should be refused")
+	}
+	throttle.EndPrompt()
+	if !throttle.StartPrompt() {
+		t.Error("Answered prompt should free its place")
+	}
+	if stats := throttle.Stats(); stats.PendingPrompts != 2 || stats.PromptsRefused != 1 {
+		t.Errorf("Expected 2 pending and 1 refused prompt, got %s", stats)
+	}
+}
+
+func TestRejectedHandshakesBan(t *testing.T) {
+	defer func(failures int) { banAfterFailures = failures }(banAfterFailures)
+	banAfterFailures = 2
+
+	var nullGuiApp GUIApp
+	initiator, responder := testNetClient(t), testNetClient(t)
+	defer os.RemoveAll(initiator.receiveDir)
+	defer os.RemoveAll(responder.receiveDir)
+	responder.acceptPolicy, _ = AcceptPolicyInit("reject", "", nil)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go responder.serveListener(listener, &nullGuiApp)
+
+	//Rejected HELLO and wrong magic number are failures
+	if _, err = initiator.SendHello(listener.Addr().String(), &nullGuiApp); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(func() bool { return responder.ThrottleStats().Failures == 1 }) {
+		t.Fatal("Rejected HELLO should count as failed handshake")
+	}
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("GET / HTTP/1.1\r\n"))
+	conn.Close()
+	if !waitFor(func() bool { return responder.ThrottleStats().ActiveBans == 1 }) {
+		t.Fatal("Address should be banned after failed handshakes")
+	}
+
+	//Banned address is closed before preface is read
+	if conn, err = net.Dial("tcp", listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err == nil {
+		t.Error("Connection from banned address should be closed")
+	} else if netError, ok := err.(net.Error); ok && netError.Timeout() {
+		t.Error("Connection from banned address should be closed right after accept")
+	}
+	if stats := responder.ThrottleStats(); stats.Banned != 1 {
+		t.Errorf("Expected 1 connection refused by ban, got %s", stats)
+	}
+}
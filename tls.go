@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+)
+
+//First byte of TLS record carrying ClientHello. Plain sessions start with magicnumber
+const tlsHandshakeRecord = 0x16
+
+//tlsmode tells if sessions are wrapped in TLS
+type tlsmode byte
+
+// Structure representing TLS modes
+const (
+	//Plain connections are made. Incoming TLS connections are accepted too
+	TLSOFF = iota
+	//TLS connections are made. Incoming plain connections are accepted too
+	TLSON
+	//Only TLS connections are made and accepted
+	TLSREQUIRED
+)
+
+var tlsModeNames = [...]string{"off", "on", "required"}
+
+func (mode tlsmode) String() string {
+	if int(mode) < len(tlsModeNames) {
+		return tlsModeNames[mode]
+	}
+	return fmt.Sprintf("mode %d", byte(mode))
+}
+
+//parseTLSMode returns TLS mode with given name
+func parseTLSMode(name string) (tlsmode, error) {
+	for i, modeName := range tlsModeNames {
+		if strings.EqualFold(strings.TrimSpace(name), modeName) {
+			return tlsmode(i), nil
+		}
+	}
+	return TLSOFF, fmt.Errorf("parseTLSMode: Unknown TLS mode %q. Use off, on or required", name)
+}
+
+//TLSTransport wraps connections in TLS 1.3 hiding frame types and sizes (and magic number) from observers.
+//Certificate is self-signed and made from identity key. TLS doesn't verify peer certificate, its key is pinned to public key
+//sent in HELLO instead, so it's approved together with peer fingerprint
+type TLSTransport struct {
+	config *tls.Config
+	mode   tlsmode
+}
+
+//TLSTransportInit creates transport with certificate made from identity private key (PEM encoded)
+func TLSTransportInit(privKey []byte, mode tlsmode) (*TLSTransport, error) {
+	key, err := importPrivateKey(privKey)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "sstt"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates:          []tls.Certificate{{Certificate: [][]byte{certificate}, PrivateKey: key}},
+		MinVersion:            tls.VersionTLS13,
+		InsecureSkipVerify:    true,
+		ClientAuth:            tls.RequireAnyClientCert,
+		VerifyPeerCertificate: verifyPeerCertificate,
+	}
+	return &TLSTransport{config: config, mode: mode}, nil
+}
+
+//verifyPeerCertificate checks that peer sent one certificate with RSA key. Key is compared with HELLO later
+func verifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(rawCerts) != 1 {
+		return fmt.Errorf("Expected 1 peer certificate, got %d", len(rawCerts))
+	}
+	certificate, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	if _, ok := certificate.PublicKey.(*rsa.PublicKey); !ok {
+		return errors.New("Peer certificate doesn't have RSA key")
+	}
+	return nil
+}
+
+//Client wraps connection opened by us in TLS unless TLS is off. Transport can be nil
+func (transport *TLSTransport) Client(conn net.Conn) (net.Conn, error) {
+	if transport == nil || transport.mode == TLSOFF {
+		return conn, nil
+	}
+	return tlsHandshake(tls.Client(conn, transport.config))
+}
+
+//Server wraps accepted connection in TLS if peer starts TLS handshake. Plain connection is refused if TLS is required.
+//Transport can be nil, then only plain connections are accepted
+func (transport *TLSTransport) Server(conn net.Conn) (net.Conn, error) {
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(prefaceTimeout))
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+	conn = &bufferedConn{Conn: conn, reader: reader}
+
+	if first[0] != tlsHandshakeRecord {
+		if transport != nil && transport.mode == TLSREQUIRED {
+			return nil, errors.New("TLSTransport: Plain connection refused, TLS is required")
+		}
+		return conn, nil
+	}
+
+	if transport == nil {
+		return nil, errors.New("TLSTransport: Peer uses TLS which is not enabled")
+	}
+	return tlsHandshake(tls.Server(conn, transport.config))
+}
+
+//tlsHandshake runs TLS handshake limited by prefaceTimeout
+func tlsHandshake(conn *tls.Conn) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(prefaceTimeout))
+	if err := conn.Handshake(); err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+//certificateFingerprint returns fingerprint of peer certificate key in the same form as fingerprint of HELLO public key.
+//Empty for plain connection
+func certificateFingerprint(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok || len(tlsConn.ConnectionState().PeerCertificates) == 0 {
+		return ""
+	}
+	key, ok := tlsConn.ConnectionState().PeerCertificates[0].PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return ""
+	}
+	return fingerprint(exportPublicKey(key))
+}
+
+//checkCertificatePin makes sure that TLS peer certificate (if any) has key sent in HELLO
+func checkCertificatePin(session *Session, peerFingerprint string) error {
+	if session.certificateFingerprint != "" && session.certificateFingerprint != peerFingerprint {
+		return sessionErrorf(ERRORCERTIFICATE, "TLS certificate key %s differs from public key %s", session.certificateFingerprint,
+			peerFingerprint)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestParseTLSMode(t *testing.T) {
+	for name, expected := range map[string]tlsmode{"off": TLSOFF, "ON": TLSON, " required": TLSREQUIRED} {
+		if mode, err := parseTLSMode(name); err != nil || mode != expected {
+			t.Errorf("%q: expected %s, got %s %v", name, expected, mode, err)
+		}
+	}
+	if _, err := parseTLSMode("yes"); err == nil {
+		t.Error("Unknown mode should not be accepted")
+	}
+}
+
+//testTLSTransport returns transport made from new identity key along with its public key
+func testTLSTransport(t *testing.T, mode tlsmode) (*TLSTransport, []byte) {
+	privKey, pubKey, err := GenerateKeyPair(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport, err := TLSTransportInit(privKey, mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return transport, pubKey
+}
+
+func TestTLSCertificatePinnedToIdentityKey(t *testing.T) {
+	clientTransport, clientKey := testTLSTransport(t, TLSON)
+	serverTransport, serverKey := testTLSTransport(t, TLSOFF)
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := serverTransport.Server(serverConn)
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+
+	conn, err := clientTransport.Client(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverSide := <-accepted
+	if serverSide == nil {
+		t.FailNow()
+	}
+
+	//Peer certificates have the same fingerprints as public keys sent in HELLO
+	if certificateFingerprint(conn) != fingerprint(serverKey) || certificateFingerprint(serverSide) != fingerprint(clientKey) {
+		t.Error("Certificate fingerprint should match identity key fingerprint")
+	}
+
+	session := sessionInit(conn, "peer")
+	if session.Transport() != "TLS" {
+		t.Errorf("Expected TLS session, got %s", session.Transport())
+	}
+	if err = checkCertificatePin(session, fingerprint(serverKey)); err != nil {
+		t.Error(err)
+	}
+	if err, ok := checkCertificatePin(session, fingerprint(clientKey)).(*SessionError); !ok || err.code != ERRORCERTIFICATE {
+		t.Errorf("HELLO with other key should be refused, got %v", err)
+	}
+}
+
+func TestTLSModes(t *testing.T) {
+	required, _ := testTLSTransport(t, TLSREQUIRED)
+	var disabled *TLSTransport
+	for _, transport := range []*TLSTransport{required, disabled} {
+		clientConn, serverConn := net.Pipe()
+		go binary.Write(clientConn, endianness, magicnumber)
+		conn, err := transport.Server(serverConn)
+		if (transport == required) != (err != nil) {
+			t.Errorf("Plain connection should be refused only if TLS is required, got %v", err)
+		}
+		if err == nil && certificateFingerprint(conn) != "" {
+			t.Error("Plain connection should not have certificate")
+		}
+		clientConn.Close()
+		serverConn.Close()
+	}
+
+	//Connection without TLS support can't accept TLS
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	go required.Client(clientConn)
+	if _, err := disabled.Server(serverConn); err == nil {
+		t.Error("TLS connection should be refused without TLS transport")
+	}
+}
+
+func TestHandshakeAndFileOverTLS(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testTransfer(t, listener, listener.Addr().String(), func(initiator *NetClient, responder *NetClient) {
+		for i, netClient := range []*NetClient{initiator, responder} {
+			transport, err := TLSTransportInit(netClient.messageHandler.myPrivateKey, tlsmode(TLSON+i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			netClient.SetTLSTransport(transport)
+		}
+	})
+}
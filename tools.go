@@ -1,6 +1,14 @@
 package main
 
-import "math/rand"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+)
 
 const charset = "abcdefghijklmnopqrstuvwxyz" +
 	"ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
@@ -13,18 +21,6 @@ func randString(length int) string {
 	return string(b)
 }
 
-func fillString(retunString string, toLength int) string {
-	for {
-		lengtString := len(retunString)
-		if lengtString < toLength {
-			retunString = retunString + ":"
-			continue
-		}
-		break
-	}
-	return retunString
-}
-
 func verifyPathString(org string) string {
 	if org[len(org)-1] == '\\' {
 		return org
@@ -32,3 +28,98 @@ func verifyPathString(org string) string {
 
 	return org + "\\"
 }
+
+//fingerprint returns hex encoded SHA-256 hash of public key
+func fingerprint(pubKey []byte) string {
+	hash := sha256.Sum256(pubKey)
+	return hex.EncodeToString(hash[:])
+}
+
+//normalizeAddress returns address in host:port form accepted by net.Dial. Port is optional, IPv6 literal can be given with or without brackets,
+//e.g. ::1, [::1] or [::1]:27002
+func normalizeAddress(address string, defaultPort int) (string, error) {
+	address = strings.TrimSpace(address)
+	if address == "" {
+		return "", fmt.Errorf("normalizeAddress: Empty address")
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		//No port given. Bare IPv6 literal has many colons, so it can't be split
+		host, port = strings.TrimSuffix(strings.TrimPrefix(address, "["), "]"), strconv.Itoa(defaultPort)
+		if ip := strings.SplitN(host, "%", 2)[0]; strings.Contains(ip, ":") && net.ParseIP(ip) == nil {
+			return "", fmt.Errorf("normalizeAddress: Wrong address %s", address)
+		}
+	}
+
+	if host == "" {
+		return "", fmt.Errorf("normalizeAddress: No host in address %s", address)
+	}
+
+	if number, err := strconv.ParseUint(port, 10, 16); err != nil || number == 0 {
+		return "", fmt.Errorf("normalizeAddress: Wrong port in address %s", address)
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+//addressScheme splits optional unix:// (or unix:) and tcp:// scheme from address. Address without scheme is TCP unless it's path
+func addressScheme(address string) (network string, rest string) {
+	address = strings.TrimSpace(address)
+	switch {
+	case strings.HasPrefix(address, "unix://"):
+		return "unix", strings.TrimPrefix(address, "unix://")
+	case strings.HasPrefix(address, "unix:"):
+		return "unix", strings.TrimPrefix(address, "unix:")
+	case strings.HasPrefix(address, "tcp://"):
+		return "tcp", strings.TrimPrefix(address, "tcp://")
+	case strings.Contains(address, "/"):
+		return "unix", address
+	}
+	return "tcp", address
+}
+
+//addressName returns address with scheme prefix for Unix domain socket paths, e.g. unix:///run/sstt.sock
+func addressName(network string, address string) string {
+	if network == "unix" {
+		return "unix://" + address
+	}
+	return address
+}
+
+//parseDialAddress returns network and address of peer. Address is Unix domain socket path with unix:// scheme, e.g. unix:///run/sstt.sock,
+//or TCP address accepted by normalizeAddress
+func parseDialAddress(address string, defaultPort int) (network string, dialAddress string, err error) {
+	network, address = addressScheme(address)
+	if network == "unix" {
+		if address == "" {
+			return "", "", fmt.Errorf("parseDialAddress: Empty socket path")
+		}
+		return network, address, nil
+	}
+
+	dialAddress, err = normalizeAddress(address, defaultPort)
+	return network, dialAddress, err
+}
+
+//parseListenAddress returns network and address of bind address. Paths (with / or unix:// prefix) are Unix domain sockets.
+//Host can be empty (all interfaces) and port 0 (ephemeral port chosen by system), e.g. 127.0.0.1, [::1]:0, :27002 or unix:///tmp/sstt.sock
+func parseListenAddress(address string, defaultPort int) (network string, bindAddress string, err error) {
+	network, address = addressScheme(address)
+	if network == "unix" {
+		if address == "" {
+			return "", "", fmt.Errorf("parseListenAddress: Empty socket path")
+		}
+		return network, address, nil
+	}
+
+	if host, port, err := net.SplitHostPort(address); err == nil && (host == "" || port == "0") {
+		if _, err = strconv.ParseUint(port, 10, 16); err != nil {
+			return "", "", fmt.Errorf("parseListenAddress: Wrong port in address %s", address)
+		}
+		return "tcp", net.JoinHostPort(host, port), nil
+	}
+
+	bindAddress, err = normalizeAddress(address, defaultPort)
+	return "tcp", bindAddress, err
+}
@@ -0,0 +1,746 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gotk3/gotk3/glib"
+)
+
+//Length of transfer ID identifying resumable file transfer
+const transferIDLen = 16
+
+//Directory in receive directory holding decrypted parts of files being received and list of files being sent
+const partialDir = ".partial"
+
+//Plain file content sent in single FILEDATA frame of resumable transfer
+const fileChunkSize = bufsize
+
+//How long sender waits for FILEOFFSET answer
+const fileOfferTimeout = 30 * time.Second
+
+//How long sender waits for FILERESULT after FILEDONE
+const fileResultTimeout = 30 * time.Second
+
+//Parts of file read and hashed ahead of the one being encrypted and sent. It bounds memory used by transfer
+const fileReadAhead = 4
+
+//How many times file is sent from start when receiver gets content different from announced one
+const maxTransferAttempts = 2
+
+//fileOffer announces resumable file. Transfer ID is derived from name, size and modification time of file and receiver,
+//so the same file sent again to the same peer continues where previous transfer stopped. Content hash comes in FILEDONE
+// Schema of frame
+// |fileSize uint64|offer (encrypted) [rest]byte|
+// Schema of offer
+// |transferID [16]byte|fileName [rest]byte|
+type fileOffer struct {
+	id   []byte
+	size int64
+	name string
+}
+
+func (offer *fileOffer) encode(keys *directionKeys) ([]byte, error) {
+	var nullGuiApp GUIApp
+	body := string(offer.id) + offer.name
+	encrypted, err := EncryptTextMessage(keys.aesKey, keys.iv, body, keys.cipherMode, &nullGuiApp)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, endianness, uint64(offer.size))
+	buf.Write(encrypted)
+	return buf.Bytes(), nil
+}
+
+func decodeFileOffer(payload []byte, keys *directionKeys) (*fileOffer, error) {
+	if len(payload) < 8 {
+		return nil, sessionErrorf(ERRORPROTOCOL, "File offer too short")
+	}
+	offer := &fileOffer{size: int64(endianness.Uint64(payload))}
+	if offer.size < 0 {
+		return nil, sessionErrorf(ERRORPROTOCOL, "Wrong file size")
+	}
+	if maxFileSize > 0 && offer.size > maxFileSize {
+		return nil, sessionErrorf(ERRORLIMIT, "File of %d bytes exceeds limit of %d bytes", offer.size, maxFileSize)
+	}
+
+	var nullGuiApp GUIApp
+	body, err := DecryptTextMessage(keys.aesKey, keys.iv, payload[8:], keys.cipherMode, &nullGuiApp)
+	if err != nil || len(body) < transferIDLen {
+		return nil, sessionErrorf(ERRORPROTOCOL, "Malformed file offer")
+	}
+	offer.id = []byte(body[:transferIDLen])
+	offer.name = body[transferIDLen:]
+	if !utf8.ValidString(offer.name) {
+		offer.name = randString(10)
+	}
+	offer.name = path.Base(offer.name)
+	return offer, nil
+}
+
+//Schema of FILEOFFSET frame
+// |transferID [16]byte|offset uint64|
+func encodeFileOffset(id []byte, offset int64) []byte {
+	buf := new(bytes.Buffer)
+	buf.Write(id)
+	binary.Write(buf, endianness, uint64(offset))
+	return buf.Bytes()
+}
+
+//fileOffset is answer to our offer: plain bytes of file receiver already verified
+type fileOffset struct {
+	id     []byte
+	offset int64
+}
+
+func decodeFileOffset(payload []byte) (fileOffset, error) {
+	if len(payload) != transferIDLen+8 {
+		return fileOffset{}, sessionErrorf(ERRORPROTOCOL, "File offset of wrong length %d", len(payload))
+	}
+	return fileOffset{id: payload[:transferIDLen], offset: int64(endianness.Uint64(payload[transferIDLen:]))}, nil
+}
+
+//fileDone ends resumable file after its last part. Content hash is computed while file is read and sent, so file is read only once
+// Schema of frame
+// |transferID [16]byte|hash (encrypted) [rest]byte|
+type fileDone struct {
+	id   []byte
+	hash []byte
+}
+
+func (done *fileDone) encode(keys *directionKeys) ([]byte, error) {
+	var nullGuiApp GUIApp
+	encrypted, err := EncryptTextMessage(keys.aesKey, keys.iv, string(done.hash), keys.cipherMode, &nullGuiApp)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, done.id...), encrypted...), nil
+}
+
+func decodeFileDone(payload []byte, keys *directionKeys) (fileDone, error) {
+	if len(payload) < transferIDLen {
+		return fileDone{}, sessionErrorf(ERRORPROTOCOL, "End of file transfer too short")
+	}
+	var nullGuiApp GUIApp
+	contentHash, err := DecryptTextMessage(keys.aesKey, keys.iv, payload[transferIDLen:], keys.cipherMode, &nullGuiApp)
+	if err != nil || len(contentHash) != sha256.Size {
+		return fileDone{}, sessionErrorf(ERRORPROTOCOL, "Malformed content hash")
+	}
+	return fileDone{id: payload[:transferIDLen], hash: []byte(contentHash)}, nil
+}
+
+type transferresult byte
+
+// Structure representing results of resumable transfer sent in FILERESULT
+const (
+	//Content hash matches and file is moved to receive directory
+	TRANSFERRECEIVED transferresult = iota
+	//Content hash differs. Receiver removed its part, so file is sent again from start
+	TRANSFERCORRUPTED
+	//File couldn't be saved. Receiver keeps verified part, so file is sent again when peer connects next time
+	TRANSFERNOTSAVED
+)
+
+//Schema of FILERESULT frame
+// |transferID [16]byte|result byte|
+func encodeFileResult(id []byte, result transferresult) []byte {
+	return append(append([]byte{}, id...), byte(result))
+}
+
+//fileResult is receiver's result of our resumable transfer
+type fileResult struct {
+	id     []byte
+	result transferresult
+}
+
+func decodeFileResult(payload []byte) (fileResult, error) {
+	if len(payload) != transferIDLen+1 || transferresult(payload[transferIDLen]) > TRANSFERNOTSAVED {
+		return fileResult{}, sessionErrorf(ERRORPROTOCOL, "Malformed file transfer result")
+	}
+	return fileResult{id: payload[:transferIDLen], result: transferresult(payload[transferIDLen])}, nil
+}
+
+//transferID identifies file with given name, size and modification time sent to peer. File changed since previous transfer
+//gets new ID, so it's sent from start
+func transferID(stat os.FileInfo, peerFingerprint string) []byte {
+	id := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%d\x00%s", stat.Name(), stat.Size(), stat.ModTime().UnixNano(), strings.ToLower(peerFingerprint))))
+	return id[:transferIDLen]
+}
+
+//fileChunk is part of file read by readFileChunks. Content hash of whole file comes with the last one
+type fileChunk struct {
+	data []byte
+	last bool
+	hash []byte
+	err  error
+}
+
+//readFileChunks reads size bytes of file from offset in parts sent to chunks and closes chunks. Part before offset is only hashed,
+//so content hash sent with the last part covers whole file. It stops when stop is closed
+func readFileChunks(file io.ReadSeeker, offset int64, size int64, chunks chan<- fileChunk, stop <-chan struct{}) {
+	defer close(chunks)
+
+	send := func(chunk fileChunk) bool {
+		select {
+		case chunks <- chunk:
+			return true
+		case <-stop:
+			return false
+		}
+	}
+
+	contentHash := sha256.New()
+	_, err := file.Seek(0, io.SeekStart)
+	if err == nil {
+		_, err = io.CopyN(contentHash, file, offset)
+	}
+	if err != nil {
+		send(fileChunk{err: err})
+		return
+	}
+
+	for {
+		data := make([]byte, fileChunkSize)
+		read, err := io.ReadFull(file, data)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			send(fileChunk{err: err})
+			return
+		}
+		if offset+int64(read) > size {
+			read = int(size - offset)
+		}
+		if read < len(data) && offset+int64(read) < size {
+			send(fileChunk{err: fmt.Errorf("readFileChunks: File is shorter than announced %d bytes", size)})
+			return
+		}
+		contentHash.Write(data[:read])
+		offset += int64(read)
+
+		chunk := fileChunk{data: data[:read], last: offset >= size}
+		if chunk.last {
+			chunk.hash = contentHash.Sum(nil)
+		}
+		if !send(chunk) || chunk.last {
+			return
+		}
+	}
+}
+
+//fileChunkIV derives IV of chunk starting at offset, so no two chunks are encrypted with the same key and IV
+func fileChunkIV(iv []byte, id []byte, offset int64) []byte {
+	buf := new(bytes.Buffer)
+	buf.Write(iv)
+	buf.Write(id)
+	binary.Write(buf, endianness, uint64(offset))
+	chunkIV := sha256.Sum256(buf.Bytes())
+	return chunkIV[:len(iv)]
+}
+
+func encryptFileChunk(keys *directionKeys, id []byte, offset int64, chunk []byte) ([]byte, error) {
+	var nullGuiApp GUIApp
+	return EncryptTextMessage(keys.aesKey, fileChunkIV(keys.iv, id, offset), string(chunk), keys.cipherMode, &nullGuiApp)
+}
+
+func decryptFileChunk(keys *directionKeys, id []byte, offset int64, data []byte) ([]byte, error) {
+	var nullGuiApp GUIApp
+	chunk, err := DecryptTextMessage(keys.aesKey, fileChunkIV(keys.iv, id, offset), data, keys.cipherMode, &nullGuiApp)
+	return []byte(chunk), err
+}
+
+//partialFile returns path of decrypted part of file received from peer. Other peers can't continue it
+func (netClient *NetClient) partialFile(peerFingerprint string, id []byte) string {
+	name := sha256.Sum256(append([]byte(strings.ToLower(peerFingerprint)), id...))
+	return path.Join(netClient.receiveDir, partialDir, hex.EncodeToString(name[:transferIDLen])+".part")
+}
+
+//OutgoingTransfers remembers files not sent completely, so they are sent again when peer connects, also after restart.
+//It's safe to use from many goroutines
+// Schema of line
+// |fingerprint hex|path|
+type OutgoingTransfers struct {
+	mutex sync.Mutex
+	//File holding the list, it's loaded on first use
+	file  string
+	files map[string][]string
+}
+
+//load reads list from file once. Missing file means no files are being sent
+func (transfers *OutgoingTransfers) load(file string) error {
+	if transfers.files != nil {
+		return nil
+	}
+	transfers.file = file
+	transfers.files = make(map[string][]string)
+
+	listFile, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	defer listFile.Close()
+
+	scanner := bufio.NewScanner(listFile)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "\t", 2)
+		if len(fields) == 2 {
+			peer := strings.ToLower(fields[0])
+			transfers.files[peer] = append(transfers.files[peer], fields[1])
+		}
+	}
+	return scanner.Err()
+}
+
+//save writes whole list to file. Mutex must be locked
+func (transfers *OutgoingTransfers) save() error {
+	os.MkdirAll(path.Dir(transfers.file), os.ModePerm)
+	file, err := os.Create(transfers.file)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	for peer, paths := range transfers.files {
+		for _, filePath := range paths {
+			if _, err = fmt.Fprintf(file, "%s\t%s\n", peer, filePath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//Add remembers file being sent to peer
+func (transfers *OutgoingTransfers) Add(fingerprint string, filePath string) error {
+	transfers.mutex.Lock()
+	defer transfers.mutex.Unlock()
+
+	fingerprint = strings.ToLower(fingerprint)
+	for _, known := range transfers.files[fingerprint] {
+		if known == filePath {
+			return nil
+		}
+	}
+	transfers.files[fingerprint] = append(transfers.files[fingerprint], filePath)
+	return transfers.save()
+}
+
+//Remove forgets file sent to peer completely
+func (transfers *OutgoingTransfers) Remove(fingerprint string, filePath string) error {
+	transfers.mutex.Lock()
+	defer transfers.mutex.Unlock()
+
+	fingerprint = strings.ToLower(fingerprint)
+	paths := transfers.files[fingerprint][:0]
+	for _, known := range transfers.files[fingerprint] {
+		if known != filePath {
+			paths = append(paths, known)
+		}
+	}
+	if len(paths) == 0 {
+		delete(transfers.files, fingerprint)
+	} else {
+		transfers.files[fingerprint] = paths
+	}
+	return transfers.save()
+}
+
+//Files returns paths of files not sent completely to peer
+func (transfers *OutgoingTransfers) Files(fingerprint string) []string {
+	transfers.mutex.Lock()
+	defer transfers.mutex.Unlock()
+	return append([]string(nil), transfers.files[strings.ToLower(fingerprint)]...)
+}
+
+//outgoingTransfers returns files not sent completely, loaded from receive directory on first use
+func (netClient *NetClient) outgoingTransfers() *OutgoingTransfers {
+	transfers := netClient.outgoing
+	transfers.mutex.Lock()
+	defer transfers.mutex.Unlock()
+	if err := transfers.load(path.Join(netClient.receiveDir, partialDir, "outgoing")); err != nil {
+		fmt.Println(err)
+	}
+	return transfers
+}
+
+//sendResumableFile offers file to peer and sends it from offset peer answers with. Files are sent one by one in session.
+//File is remembered until peer confirms it received it with matching content hash, so it's sent again when peer connects next time.
+//File whose content peer received corrupted is sent again from start
+func (netClient *NetClient) sendResumableFile(session *Session, file *os.File, app *GUIApp) error {
+	session.transferMutex.Lock()
+	defer session.transferMutex.Unlock()
+
+	filePath, err := filepath.Abs(file.Name())
+	if err != nil {
+		return err
+	}
+	if err = netClient.outgoingTransfers().Add(session.peerFingerprint, filePath); err != nil {
+		fmt.Println(err)
+	}
+
+	answer, result := make(chan fileOffset, 1), make(chan fileResult, 1)
+	session.answerMutex.Lock()
+	session.transferAnswer, session.transferResult = answer, result
+	session.answerMutex.Unlock()
+	defer func() {
+		session.answerMutex.Lock()
+		session.transferAnswer, session.transferResult = nil, nil
+		session.answerMutex.Unlock()
+	}()
+
+	for attempt := 1; ; attempt++ {
+		received, err := netClient.offerFile(session, file, answer, result, app)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case received == TRANSFERRECEIVED:
+			return netClient.outgoingTransfers().Remove(session.peerFingerprint, filePath)
+		case received == TRANSFERCORRUPTED && attempt < maxTransferAttempts:
+			app.ShowStatus(fmt.Sprintf("%s received %s corrupted, sending it again from start", session, path.Base(filePath)))
+		case received == TRANSFERCORRUPTED:
+			return fmt.Errorf("NetClient.sendResumableFile: %s received %s corrupted %d times", session, path.Base(filePath), attempt)
+		default:
+			return fmt.Errorf("NetClient.sendResumableFile: %s couldn't save %s, it's sent again next time", session, path.Base(filePath))
+		}
+	}
+}
+
+//offerFile sends single FILEOFFER and file data from answered offset. File is read and hashed by separate goroutine while
+//parts read before are encrypted and sent, so sending starts at once and only few parts are in memory.
+//Content hash is sent in FILEDONE and result peer sends when it checks it is returned
+func (netClient *NetClient) offerFile(session *Session, file *os.File, answer chan fileOffset, result chan fileResult, app *GUIApp) (transferresult, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	offer := fileOffer{id: transferID(stat, session.peerFingerprint), size: stat.Size(), name: stat.Name()}
+
+	if err = session.writeEncrypted(FILEOFFER, offer.encode); err != nil {
+		return 0, err
+	}
+
+	var offset int64
+	select {
+	case answered := <-answer:
+		if !bytes.Equal(answered.id, offer.id) || answered.offset < 0 || answered.offset > offer.size {
+			return 0, fmt.Errorf("NetClient.offerFile: Wrong answer to offer of %s", offer.name)
+		}
+		offset = answered.offset
+	case <-session.done:
+		return 0, fmt.Errorf("NetClient.offerFile: Session %s closed, sending %s cancelled", session, offer.name)
+	case <-time.After(fileOfferTimeout):
+		return 0, fmt.Errorf("NetClient.offerFile: Peer didn't answer offer of %s", offer.name)
+	}
+	if offset > 0 {
+		app.ShowStatus(fmt.Sprintf("Resuming %s to %s from %d of %d bytes", offer.name, session, offset, offer.size))
+	}
+
+	chunks, stop := make(chan fileChunk, fileReadAhead), make(chan struct{})
+	go readFileChunks(file, offset, offer.size, chunks, stop)
+	defer func() {
+		close(stop)
+		for range chunks {
+		}
+	}()
+
+	done := fileDone{id: offer.id}
+	startTime := time.Now()
+	duration := time.Now().Sub(startTime)
+	for chunk := range chunks {
+		if chunk.err != nil {
+			return 0, chunk.err
+		}
+
+		var flags byte
+		if chunk.last {
+			flags = FLAGLAST
+		}
+
+		chunkOffset := offset
+		err = session.writeEncryptedFrame(FILEDATA, flags, func(keys *directionKeys) ([]byte, error) {
+			return encryptFileChunk(keys, offer.id, chunkOffset, chunk.data)
+		})
+		if err != nil {
+			if session.Closed() {
+				return 0, fmt.Errorf("NetClient.offerFile: Session %s closed, sending %s paused at %d of %d bytes", session, offer.name, offset, offer.size)
+			}
+			return 0, err
+		}
+		offset += int64(len(chunk.data))
+
+		if app.uploadProgressBar != nil {
+			duration = time.Now().Sub(startTime)
+			value := float64(offset) / float64(offer.size)
+			glib.IdleAdd(func() {
+				app.UpdateUploadProgress(value, duration.String())
+			})
+		}
+
+		if chunk.last {
+			done.hash = chunk.hash
+			break
+		}
+	}
+	if done.hash == nil {
+		return 0, fmt.Errorf("NetClient.offerFile: Reading %s stopped before its end", offer.name)
+	}
+	if app.uploadProgressBar != nil {
+		glib.IdleAdd(func() {
+			app.UpdateUploadProgress(1.0, duration.String())
+		})
+	}
+
+	if err = session.writeEncrypted(FILEDONE, done.encode); err != nil {
+		return 0, err
+	}
+
+	select {
+	case received := <-result:
+		if !bytes.Equal(received.id, offer.id) {
+			return 0, fmt.Errorf("NetClient.offerFile: Result of other transfer received for %s", offer.name)
+		}
+		return received.result, nil
+	case <-session.done:
+		return 0, fmt.Errorf("NetClient.offerFile: Session %s closed before it confirmed %s", session, offer.name)
+	case <-time.After(fileResultTimeout):
+		return 0, fmt.Errorf("NetClient.offerFile: Peer didn't confirm %s", offer.name)
+	}
+}
+
+//resumeTransfers sends again files not sent completely to peer of newly established session
+func (netClient *NetClient) resumeTransfers(session *Session, app *GUIApp) {
+	if session.features&FEATURERESUME == 0 {
+		return
+	}
+	for _, filePath := range netClient.outgoingTransfers().Files(session.peerFingerprint) {
+		file, err := os.Open(filePath)
+		if err != nil {
+			fmt.Println(err)
+			netClient.outgoingTransfers().Remove(session.peerFingerprint, filePath)
+			continue
+		}
+		err = netClient.sendResumableFile(session, file, app)
+		file.Close()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+}
+
+//handleFileOffset passes answer to our offer to waiting sendResumableFile
+func (session *Session) handleFileOffset(payload []byte) error {
+	answered, err := decodeFileOffset(payload)
+	if err != nil {
+		return err
+	}
+
+	session.answerMutex.Lock()
+	answer := session.transferAnswer
+	session.answerMutex.Unlock()
+	if answer == nil {
+		return sessionErrorf(ERRORPROTOCOL, "Unexpected file offset")
+	}
+
+	select {
+	case answer <- answered:
+	default:
+		return sessionErrorf(ERRORPROTOCOL, "File offer answered twice")
+	}
+	return nil
+}
+
+//handleFileResult passes result of our transfer to waiting sendResumableFile. Result which comes after sender stopped waiting
+//is ignored, file is offered again next time
+func (session *Session) handleFileResult(payload []byte) error {
+	received, err := decodeFileResult(payload)
+	if err != nil {
+		return err
+	}
+
+	session.answerMutex.Lock()
+	result := session.transferResult
+	session.answerMutex.Unlock()
+	if result == nil {
+		return nil
+	}
+
+	select {
+	case result <- received:
+	default:
+		return sessionErrorf(ERRORPROTOCOL, "File transfer result sent twice")
+	}
+	return nil
+}
+
+//receiveFileOffer starts receiving resumable file. Decrypted part of file received before from the same peer is continued
+//and its length is sent back in FILEOFFSET. The part is hashed by separate goroutine before answer is sent, so read loop isn't blocked
+func (netClient *NetClient) receiveFileOffer(session *Session, payload []byte, app *GUIApp) error {
+	if session.incomingFile != nil {
+		return errors.New("NetClient.receiveFileOffer: Other file is being received")
+	}
+
+	offer, err := decodeFileOffer(payload, session.auth.recv)
+	if err != nil {
+		return err
+	}
+
+	partPath := netClient.partialFile(session.peerFingerprint, offer.id)
+	os.MkdirAll(path.Dir(partPath), os.ModePerm)
+	partFile, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	stat, err := partFile.Stat()
+	if err != nil {
+		partFile.Close()
+		return err
+	}
+	offset := stat.Size()
+	if offset > offer.size {
+		offset = 0
+	}
+	if err = partFile.Truncate(offset); err == nil {
+		_, err = partFile.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		partFile.Close()
+		return err
+	}
+
+	if app.messageTextBuffer != nil {
+		glib.IdleAdd(func() {
+			app.ShowDownloadFilePopup(offer.name)
+		})
+	}
+	if offset > 0 {
+		app.ShowStatus(fmt.Sprintf("Resuming %s from %s at %d of %d bytes", offer.name, session, offset, offer.size))
+	}
+
+	incomingFile := &fileReceive{name: offer.name, size: offer.size, received: offset, file: partFile, timeStart: time.Now(), offer: offer,
+		hashed: make(chan hash.Hash, 1)}
+	session.incomingFile = incomingFile
+	go func() {
+		//Part which can't be read gives wrong content hash, so file is sent again from start
+		prefixHash := sha256.New()
+		if _, err := io.Copy(prefixHash, io.NewSectionReader(partFile, 0, offset)); err != nil {
+			fmt.Println(err)
+		}
+		incomingFile.hashed <- prefixHash
+		err := session.reply(func() error {
+			return session.writePacket(FILEOFFSET, encodeFileOffset(offer.id, offset))
+		})
+		if err != nil {
+			fmt.Println(err)
+		}
+	}()
+	return nil
+}
+
+//receiveFileChunk decrypts part of resumable file with current receive keys, appends it to partial file and adds it to content hash
+func (netClient *NetClient) receiveFileChunk(session *Session, data []byte, last bool, app *GUIApp) error {
+	incomingFile := session.incomingFile
+	if incomingFile.hash == nil {
+		incomingFile.hash = <-incomingFile.hashed
+	}
+	if incomingFile.complete {
+		return sessionErrorf(ERRORPROTOCOL, "File part after the last one")
+	}
+
+	chunk, err := decryptFileChunk(session.auth.recv, incomingFile.offer.id, incomingFile.received, data)
+	if err != nil {
+		return err
+	}
+
+	if incomingFile.received+int64(len(chunk)) > incomingFile.size {
+		return errors.New("NetClient.receiveFileChunk: Received more data than announced")
+	}
+	if _, err = incomingFile.file.Write(chunk); err != nil {
+		return err
+	}
+	incomingFile.hash.Write(chunk)
+	incomingFile.received += int64(len(chunk))
+
+	duration := time.Now().Sub(incomingFile.timeStart)
+	if app.downloadProgressBar != nil {
+		value := float64(incomingFile.received) / float64(incomingFile.size)
+		glib.IdleAdd(func() {
+			app.UpdateDownloadProgress(value, duration.String())
+		})
+	}
+
+	if !last {
+		return nil
+	}
+	if incomingFile.received != incomingFile.size {
+		return errors.New("NetClient.receiveFileChunk: Received less data than announced")
+	}
+	incomingFile.complete = true
+	return nil
+}
+
+//receiveFileDone compares content hash sent after the last part of resumable file with hash of received file, moves file to
+//receive directory and sends result back in FILERESULT
+func (netClient *NetClient) receiveFileDone(session *Session, payload []byte, app *GUIApp) error {
+	incomingFile := session.incomingFile
+	if incomingFile == nil || incomingFile.offer == nil || !incomingFile.complete {
+		return sessionErrorf(ERRORPROTOCOL, "End of file transfer before its last part")
+	}
+	done, err := decodeFileDone(payload, session.auth.recv)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(done.id, incomingFile.offer.id) {
+		return sessionErrorf(ERRORPROTOCOL, "End of other file transfer")
+	}
+
+	session.incomingFile = nil
+	result, err := netClient.finishReceivedFile(incomingFile, done.hash, app)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return session.reply(func() error {
+		return session.writePacket(FILERESULT, encodeFileResult(done.id, result))
+	})
+}
+
+//finishReceivedFile checks content hash of completely received file and moves it to receive directory.
+//File with wrong content is removed, so it's received from the start again. Returns result sent to peer
+func (netClient *NetClient) finishReceivedFile(incomingFile *fileReceive, contentHash []byte, app *GUIApp) (transferresult, error) {
+	partPath := incomingFile.file.Name()
+	if err := incomingFile.file.Close(); err != nil {
+		return TRANSFERNOTSAVED, err
+	}
+
+	if !bytes.Equal(incomingFile.hash.Sum(nil), contentHash) {
+		os.Remove(partPath)
+		return TRANSFERCORRUPTED, fmt.Errorf("NetClient.finishReceivedFile: Content hash of %s differs from announced one", incomingFile.name)
+	}
+	if err := os.Rename(partPath, path.Join(netClient.receiveDir, incomingFile.name)); err != nil {
+		return TRANSFERNOTSAVED, err
+	}
+
+	app.ShowStatus(fmt.Sprintf("Received file %s", incomingFile.name))
+	return TRANSFERRECEIVED, nil
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestFileOfferEncoding(t *testing.T) {
+	keys := directionKeysInit([]byte("0123456789abcdef0123456789abcdef"), []byte("0123456789abcdef"), CBC, "initiator")
+	sentFile, err := ioutil.TempFile("", "sstt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(sentFile.Name())
+	sentFile.WriteString("content")
+	sentFile.Close()
+	stat, err := os.Stat(sentFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer := fileOffer{id: transferID(stat, "ABCD"), size: 7, name: "report.pdf"}
+
+	payload, err := offer.encode(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeFileOffer(payload, keys)
+	if err != nil || !bytes.Equal(decoded.id, offer.id) || decoded.size != 7 || decoded.name != "report.pdf" {
+		t.Errorf("Expected %+v, got %+v %v", offer, decoded, err)
+	}
+	if !bytes.Equal(offer.id, transferID(stat, "abcd")) || bytes.Equal(offer.id, transferID(stat, "other")) {
+		t.Error("Transfer ID should depend on file and receiver")
+	}
+	os.Chtimes(sentFile.Name(), time.Now(), stat.ModTime().Add(time.Hour))
+	if changed, _ := os.Stat(sentFile.Name()); bytes.Equal(offer.id, transferID(changed, "abcd")) {
+		t.Error("Changed file should get new transfer ID")
+	}
+
+	offset, err := decodeFileOffset(encodeFileOffset(offer.id, 1234))
+	if err != nil || !bytes.Equal(offset.id, offer.id) || offset.offset != 1234 {
+		t.Errorf("Expected offset 1234, got %+v %v", offset, err)
+	}
+
+	contentHash := sha256.Sum256([]byte("content"))
+	done := fileDone{id: offer.id, hash: contentHash[:]}
+	payload, err = done.encode(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded, err := decodeFileDone(payload, keys); err != nil || !bytes.Equal(decoded.id, offer.id) || !bytes.Equal(decoded.hash, done.hash) {
+		t.Errorf("Expected %+v, got %+v %v", done, decoded, err)
+	}
+	if _, err = decodeFileDone(payload[:transferIDLen+3], keys); err == nil {
+		t.Error("Malformed content hash should be refused")
+	}
+
+	if result, err := decodeFileResult(encodeFileResult(offer.id, TRANSFERCORRUPTED)); err != nil || !bytes.Equal(result.id, offer.id) || result.result != TRANSFERCORRUPTED {
+		t.Errorf("Expected corrupted transfer result, got %+v %v", result, err)
+	}
+	if _, err = decodeFileResult(encodeFileResult(offer.id, TRANSFERNOTSAVED+1)); err == nil {
+		t.Error("Unknown transfer result should be refused")
+	}
+
+	//Chunks at different offsets don't share IV. Empty file is sent as single empty chunk
+	for _, mode := range []cipherblockmode{ECB, CBC, CFB, OFB} {
+		keys.cipherMode = mode
+		for _, sent := range []string{"chunk", ""} {
+			encrypted, err := encryptFileChunk(keys, offer.id, 100, []byte(sent))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if chunk, err := decryptFileChunk(keys, offer.id, 100, encrypted); err != nil || string(chunk) != sent {
+				t.Errorf("%s: Expected %q, got %q %v", mode, sent, chunk, err)
+			}
+		}
+	}
+	if bytes.Equal(fileChunkIV(keys.iv, offer.id, 0), fileChunkIV(keys.iv, offer.id, fileChunkSize)) {
+		t.Error("Chunk IVs should differ")
+	}
+}
+
+//testSlowFile is file whose data after the first part is readable only after release is closed
+type testSlowFile struct {
+	*bytes.Reader
+	release chan struct{}
+}
+
+func (file *testSlowFile) Read(p []byte) (int, error) {
+	if position, _ := file.Seek(0, io.SeekCurrent); position >= fileChunkSize {
+		<-file.release
+	}
+	return file.Reader.Read(p)
+}
+
+//testReadChunks returns data and content hash of all parts read by readFileChunks
+func testReadChunks(t *testing.T, chunks chan fileChunk) ([]byte, []byte) {
+	var data, contentHash []byte
+	for chunk := range chunks {
+		if chunk.err != nil {
+			t.Fatal(chunk.err)
+		}
+		data = append(data, chunk.data...)
+		if chunk.last {
+			contentHash = chunk.hash
+		}
+	}
+	return data, contentHash
+}
+
+func TestReadFileChunks(t *testing.T) {
+	content := bytes.Repeat([]byte("pipelined "), fileChunkSize/4)
+	expectedHash := sha256.Sum256(content)
+
+	//First part is sent before the rest of file is read
+	file := &testSlowFile{Reader: bytes.NewReader(content), release: make(chan struct{})}
+	chunks := make(chan fileChunk, fileReadAhead)
+	go readFileChunks(file, 0, int64(len(content)), chunks, nil)
+	select {
+	case chunk := <-chunks:
+		if chunk.err != nil || !bytes.Equal(chunk.data, content[:fileChunkSize]) || chunk.last {
+			t.Fatalf("Expected first part, got %d bytes %v", len(chunk.data), chunk.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("First part should be read without waiting for the rest of file")
+	}
+	close(file.release)
+	if data, contentHash := testReadChunks(t, chunks); !bytes.Equal(data, content[fileChunkSize:]) || !bytes.Equal(contentHash, expectedHash[:]) {
+		t.Errorf("Expected rest of file and its content hash, got %d bytes and %x", len(data), contentHash)
+	}
+
+	//Resumed transfer reads only part after offset, but its content hash covers whole file
+	chunks = make(chan fileChunk, fileReadAhead)
+	go readFileChunks(bytes.NewReader(content), fileChunkSize+10, int64(len(content)), chunks, nil)
+	if data, contentHash := testReadChunks(t, chunks); !bytes.Equal(data, content[fileChunkSize+10:]) || !bytes.Equal(contentHash, expectedHash[:]) {
+		t.Errorf("Expected part after offset and content hash of whole file, got %d bytes and %x", len(data), contentHash)
+	}
+
+	//File shorter than announced is reported
+	chunks = make(chan fileChunk, fileReadAhead)
+	go readFileChunks(bytes.NewReader(content), 0, int64(len(content))+1, chunks, nil)
+	var err error
+	for chunk := range chunks {
+		err = chunk.err
+	}
+	if err == nil {
+		t.Error("File shorter than announced should be reported")
+	}
+
+	//Reading stops when sender stops
+	file = &testSlowFile{Reader: bytes.NewReader(content), release: make(chan struct{})}
+	chunks, stop := make(chan fileChunk), make(chan struct{})
+	go readFileChunks(file, 0, int64(len(content)), chunks, stop)
+	<-chunks
+	close(stop)
+	close(file.release)
+	for range chunks {
+	}
+}
+
+func TestOutgoingTransfers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sstt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	transfers := &OutgoingTransfers{}
+	transfers.load(path.Join(dir, "outgoing"))
+	transfers.Add("AB", "/tmp/first file")
+	transfers.Add("ab", "/tmp/second")
+	transfers.Add("ab", "/tmp/second")
+	transfers.Remove("ab", "/tmp/first file")
+
+	reloaded := &OutgoingTransfers{}
+	if err = reloaded.load(path.Join(dir, "outgoing")); err != nil {
+		t.Fatal(err)
+	}
+	if files := reloaded.Files("AB"); len(files) != 1 || files[0] != "/tmp/second" {
+		t.Errorf("Expected only second file after reload, got %q", files)
+	}
+}
+
+//testConnectedClients returns initiator and responder of established session and initiator session ID
+func testConnectedClients(t *testing.T, listener net.Listener, initiator *NetClient, responder *NetClient) uint32 {
+	var nullGuiApp GUIApp
+	go responder.serveListener(listener, &nullGuiApp)
+
+	sessionID, err := initiator.SendHello(listener.Addr().String(), &nullGuiApp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	established := func() bool {
+		return initiator.IsConnected(sessionID) && responder.IsConnected(responder.ActiveSession())
+	}
+	if !waitFor(established) {
+		t.Fatal("Session was not established")
+	}
+	return sessionID
+}
+
+//testSentFile returns file with content spanning several chunks
+func testSentFile(t *testing.T) (*os.File, []byte) {
+	content := bytes.Repeat([]byte("resumable file content "), fileChunkSize/8)
+	sentFile, err := ioutil.TempFile("", "sstt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sentFile.Write(content)
+	sentFile.Seek(0, 0)
+	return sentFile, content
+}
+
+func TestResumeFileTransfer(t *testing.T) {
+	var nullGuiApp GUIApp
+	initiator, responder := testNetClient(t), testNetClient(t)
+	defer os.RemoveAll(initiator.receiveDir)
+	defer os.RemoveAll(responder.receiveDir)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	sessionID := testConnectedClients(t, listener, initiator, responder)
+	defer initiator.Disconnect(sessionID, &nullGuiApp)
+
+	sentFile, content := testSentFile(t)
+	defer os.Remove(sentFile.Name())
+	defer sentFile.Close()
+	received := path.Join(responder.receiveDir, path.Base(sentFile.Name()))
+
+	//Resumable transfer is used by default
+	session, err := initiator.establishedSession(sessionID)
+	if err != nil || session.features&FEATURERESUME == 0 {
+		t.Fatalf("Expected resumable transfers in session with default features, got %v", err)
+	}
+
+	//Receiver kept part of file from interrupted transfer. It would be refused by content hash if whole file was sent again
+	stat, err := sentFile.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	initiatorFingerprint := fingerprint(initiator.messageHandler.myPublicKey)
+	id := transferID(stat, fingerprint(responder.messageHandler.myPublicKey))
+	partPath := responder.partialFile(initiatorFingerprint, id)
+	os.MkdirAll(path.Dir(partPath), os.ModePerm)
+	if err = ioutil.WriteFile(partPath, content[:fileChunkSize+100], 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = initiator.SendFile(sessionID, sentFile, &nullGuiApp); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(func() bool {
+		data, err := ioutil.ReadFile(received)
+		return err == nil && bytes.Equal(data, content)
+	}) {
+		t.Fatal("Resumed file differs from sent one")
+	}
+	if _, err = os.Stat(partPath); !os.IsNotExist(err) {
+		t.Error("Part of received file should be moved")
+	}
+	if files := initiator.outgoingTransfers().Files(fingerprint(responder.messageHandler.myPublicKey)); len(files) != 0 {
+		t.Errorf("Sent file should be forgotten when receiver confirms it, got %q", files)
+	}
+
+	//Part with wrong content is removed when hash differs and file is sent again from start
+	os.Remove(received)
+	ioutil.WriteFile(partPath, []byte("forged beginning"), 0600)
+	if err = initiator.SendFile(sessionID, sentFile, &nullGuiApp); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(received); err != nil || !bytes.Equal(data, content) {
+		t.Errorf("File should be sent again from start after receiver found it corrupted: %v", err)
+	}
+	if _, err = os.Stat(partPath); !os.IsNotExist(err) {
+		t.Error("Part with wrong content should be removed")
+	}
+}
+
+func TestUnconfirmedTransferKept(t *testing.T) {
+	var nullGuiApp GUIApp
+	initiator, responder := testNetClient(t), testNetClient(t)
+	defer os.RemoveAll(initiator.receiveDir)
+	defer os.RemoveAll(responder.receiveDir)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	sessionID := testConnectedClients(t, listener, initiator, responder)
+	defer initiator.Disconnect(sessionID, &nullGuiApp)
+
+	sentFile, _ := testSentFile(t)
+	defer os.Remove(sentFile.Name())
+	defer sentFile.Close()
+
+	//Receiver can't move received file to its place, so it's not confirmed
+	received := path.Join(responder.receiveDir, path.Base(sentFile.Name()))
+	if err = os.MkdirAll(path.Join(received, "occupied"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err = initiator.SendFile(sessionID, sentFile, &nullGuiApp); err == nil {
+		t.Error("File not saved by receiver should not be sent successfully")
+	}
+	if files := initiator.outgoingTransfers().Files(fingerprint(responder.messageHandler.myPublicKey)); len(files) != 1 {
+		t.Errorf("File not confirmed by receiver should be remembered, got %q", files)
+	}
+}
+
+func TestResumeAfterRestart(t *testing.T) {
+	var nullGuiApp GUIApp
+	initiator, responder := testNetClient(t), testNetClient(t)
+	defer os.RemoveAll(initiator.receiveDir)
+	defer os.RemoveAll(responder.receiveDir)
+
+	sentFile, content := testSentFile(t)
+	defer os.Remove(sentFile.Name())
+	sentFile.Close()
+
+	//Sender remembered file not sent completely before it was restarted
+	responderFingerprint := fingerprint(responder.messageHandler.myPublicKey)
+	if err := initiator.outgoingTransfers().Add(responderFingerprint, sentFile.Name()); err != nil {
+		t.Fatal(err)
+	}
+	initiator.outgoing = &OutgoingTransfers{}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	sessionID := testConnectedClients(t, listener, initiator, responder)
+	defer initiator.Disconnect(sessionID, &nullGuiApp)
+
+	received := path.Join(responder.receiveDir, path.Base(sentFile.Name()))
+	if !waitFor(func() bool {
+		data, err := ioutil.ReadFile(received)
+		return err == nil && bytes.Equal(data, content)
+	}) {
+		t.Fatal("Remembered file should be sent when peer connects")
+	}
+	if !waitFor(func() bool { return len(initiator.outgoingTransfers().Files(responderFingerprint)) == 0 }) {
+		t.Error("Sent file should be forgotten")
+	}
+}
+
+func TestFileTransferWithoutResume(t *testing.T) {
+	defer func(features featureflags) { supportedFeatures = features }(supportedFeatures)
+	supportedFeatures = FEATUREFILES
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testTransfer(t, listener, listener.Addr().String(), nil)
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+//listenUnix creates Unix domain socket accessible only by owner. Umask is restricted while socket is created,
+//so it's never accessible by others, not even before it's chmodded
+func listenUnix(address string) (net.Listener, error) {
+	umask := syscall.Umask(0077)
+	defer syscall.Umask(umask)
+	return net.Listen("unix", address)
+}
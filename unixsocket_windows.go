@@ -0,0 +1,8 @@
+package main
+
+import "net"
+
+//listenUnix creates Unix domain socket. Windows has no umask, access is given by ACL of directory
+func listenUnix(address string) (net.Listener, error) {
+	return net.Listen("unix", address)
+}
@@ -0,0 +1,31 @@
+//go:build go1.24
+// +build go1.24
+
+package main
+
+import "crypto/ecdh"
+
+//X25519 is taken from crypto/ecdh of standard library, so Noise handshake is offered
+const x25519Supported = true
+
+//x25519Public returns public key of X25519 private key
+func x25519Public(private []byte) ([]byte, error) {
+	key, err := ecdh.X25519().NewPrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	return key.PublicKey().Bytes(), nil
+}
+
+//x25519 returns shared secret of private key and peer public key. Low order public keys giving zero secret are refused
+func x25519(private []byte, public []byte) ([]byte, error) {
+	key, err := ecdh.X25519().NewPrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	peerKey, err := ecdh.X25519().NewPublicKey(public)
+	if err != nil {
+		return nil, err
+	}
+	return key.ECDH(peerKey)
+}
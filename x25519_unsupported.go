@@ -0,0 +1,19 @@
+//go:build !go1.24
+// +build !go1.24
+
+package main
+
+import "errors"
+
+//Standard library of older toolchains has no X25519, so Noise handshake is not offered and peers use version 1 handshake
+const x25519Supported = false
+
+var errX25519Unsupported = errors.New("x25519: Noise handshake needs Go 1.24 or newer")
+
+func x25519Public(private []byte) ([]byte, error) {
+	return nil, errX25519Unsupported
+}
+
+func x25519(private []byte, public []byte) ([]byte, error) {
+	return nil, errX25519Unsupported
+}